@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aybabtme/desim/pkg/desim"
+	"github.com/aybabtme/desim/pkg/experiment"
 	"github.com/aybabtme/desim/pkg/gen"
 	"github.com/aybabtme/desim/pkg/utilmath"
 	"github.com/urfave/cli"
@@ -25,39 +31,154 @@ func main() {
 	yearlyPropertyValueIncreaseFlag := cli.Float64Flag{Name: "property_value_increase", Value: 4, Usage: "year-over-year property value increase ", Required: true}
 	app := cli.App{
 		Name: "real-estate-investor",
+		Commands: []cli.Command{
+			{
+				Name:  "run",
+				Usage: "simulate the net worth of one investment",
+				Flags: []cli.Flag{
+					durationFlag,
+					rateFlag,
+					termsFlag,
+					ltvFlag,
+					stockMarketGrowthRateFlag,
+					brokerageFlag,
+					monthlyRentalPaymentFlag,
+					yearlyRentIncreaseFlag,
+					propertyValueFlag,
+					yearlyPropertyValueIncreaseFlag,
+				},
+				Action: func(cctx *cli.Context) error {
+					_, err := run(
+						context.Background(),
+						42,
+						desim.LogJSON(os.Stdout),
+						cctx.Int(durationFlag.Name),
+						cctx.Float64(rateFlag.Name),
+						cctx.Int(termsFlag.Name),
+						cctx.Float64(ltvFlag.Name),
+						cctx.Float64(stockMarketGrowthRateFlag.Name),
+						cctx.Float64(brokerageFlag.Name),
+						cctx.Float64(monthlyRentalPaymentFlag.Name),
+						cctx.Float64(yearlyRentIncreaseFlag.Name),
+						cctx.Float64(propertyValueFlag.Name),
+						cctx.Float64(yearlyPropertyValueIncreaseFlag.Name),
+					)
+					return err
+				},
+			},
+			sweepCommand(
+				durationFlag,
+				termsFlag,
+				brokerageFlag,
+				monthlyRentalPaymentFlag,
+				yearlyRentIncreaseFlag,
+				propertyValueFlag,
+				yearlyPropertyValueIncreaseFlag,
+			),
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func sweepCommand(durationFlag cli.IntFlag, termsFlag, brokerageFlag, monthlyRentalPaymentFlag, yearlyRentIncreaseFlag, propertyValueFlag, yearlyPropertyValueIncreaseFlag cli.Float64Flag) cli.Command {
+	rateLevelsFlag := cli.StringFlag{Name: "loan_rate", Value: "2.5,3.5,4.5", Usage: "comma separated yearly interest rates to evaluate"}
+	ltvLevelsFlag := cli.StringFlag{Name: "loan_ltv", Value: "50,65,80", Usage: "comma separated loan_to_values to evaluate"}
+	growthLevelsFlag := cli.StringFlag{Name: "stock_growth_rate", Value: "2,3.5,5", Usage: "comma separated annualized growth rates of the stock market to evaluate"}
+	designFlag := cli.StringFlag{Name: "design", Value: "factorial", Usage: "how to pick points: factorial, lhs or random; lhs and random draw between the smallest and largest levels"}
+	pointsFlag := cli.IntFlag{Name: "points", Value: 20, Usage: "number of points to draw with the lhs and random designs"}
+	replicationsFlag := cli.IntFlag{Name: "replications", Value: 1, Usage: "replications to run at each point"}
+	seedFlag := cli.Int64Flag{Name: "seed", Value: 42, Usage: "seed of the sweep"}
+	formatFlag := cli.StringFlag{Name: "format", Value: "csv", Usage: "format of the table: csv or jsonl"}
+	return cli.Command{
+		Name:  "sweep",
+		Usage: "evaluate the net worth across loan rate, loan to value and stock market growth rate",
 		Flags: []cli.Flag{
 			durationFlag,
-			rateFlag,
 			termsFlag,
-			ltvFlag,
-			stockMarketGrowthRateFlag,
 			brokerageFlag,
 			monthlyRentalPaymentFlag,
 			yearlyRentIncreaseFlag,
 			propertyValueFlag,
 			yearlyPropertyValueIncreaseFlag,
+			rateLevelsFlag,
+			ltvLevelsFlag,
+			growthLevelsFlag,
+			designFlag,
+			pointsFlag,
+			replicationsFlag,
+			seedFlag,
+			formatFlag,
 		},
 		Action: func(cctx *cli.Context) error {
-			return run(
-				cctx.Int(durationFlag.Name),
-				cctx.Float64(rateFlag.Name),
-				cctx.Int(termsFlag.Name),
-				cctx.Float64(ltvFlag.Name),
-				cctx.Float64(stockMarketGrowthRateFlag.Name),
-				cctx.Float64(brokerageFlag.Name),
-				cctx.Float64(monthlyRentalPaymentFlag.Name),
-				cctx.Float64(yearlyRentIncreaseFlag.Name),
-				cctx.Float64(propertyValueFlag.Name),
-				cctx.Float64(yearlyPropertyValueIncreaseFlag.Name),
-			)
+			var space []experiment.Param
+			for _, name := range []string{rateLevelsFlag.Name, ltvLevelsFlag.Name, growthLevelsFlag.Name} {
+				levels, err := parseLevels(cctx.String(name))
+				if err != nil {
+					return fmt.Errorf("invalid levels for %q: %w", name, err)
+				}
+				space = append(space, experiment.Levels(name, levels...))
+			}
+			var design experiment.Design
+			switch d := cctx.String(designFlag.Name); d {
+			case "factorial":
+				design = experiment.FullFactorial()
+			case "lhs":
+				design = experiment.LatinHypercube(cctx.Int(pointsFlag.Name), cctx.Int64(seedFlag.Name))
+			case "random":
+				design = experiment.RandomSampling(cctx.Int(pointsFlag.Name), cctx.Int64(seedFlag.Name))
+			default:
+				return fmt.Errorf("unknown design %q", d)
+			}
+			var table experiment.Table
+			switch f := cctx.String(formatFlag.Name); f {
+			case "csv":
+				table = experiment.CSVTable(os.Stdout)
+			case "jsonl":
+				table = experiment.JSONTable(os.Stdout)
+			default:
+				return fmt.Errorf("unknown format %q", f)
+			}
+			model := func(ctx context.Context, point experiment.Point, seed int64) (experiment.Outputs, error) {
+				return run(
+					ctx,
+					seed,
+					desim.LogJSON(ioutil.Discard),
+					cctx.Int(durationFlag.Name),
+					point[rateLevelsFlag.Name],
+					cctx.Int(termsFlag.Name),
+					point[ltvLevelsFlag.Name],
+					point[growthLevelsFlag.Name],
+					cctx.Float64(brokerageFlag.Name),
+					cctx.Float64(monthlyRentalPaymentFlag.Name),
+					cctx.Float64(yearlyRentIncreaseFlag.Name),
+					cctx.Float64(propertyValueFlag.Name),
+					cctx.Float64(yearlyPropertyValueIncreaseFlag.Name),
+				)
+			}
+			_, err := experiment.Sweep(context.Background(), space, design, experiment.Config{
+				Replications: cctx.Int(replicationsFlag.Name),
+				Seed:         cctx.Int64(seedFlag.Name),
+			}, model, table)
+			return err
 		},
 	}
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+}
+
+func parseLevels(s string) ([]float64, error) {
+	var levels []float64
+	for _, field := range strings.Split(s, ",") {
+		lvl, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, lvl)
 	}
+	return levels, nil
 }
 
-func run(simulMonths int, mortgageRate float64, mortgageTerm int, mortgageLTV, stockMarketGrowthRate, brokerageInitialAmount, monthlyRentalPayment, yearlyRentIncrease, propertyValue, yoyPropertyValueIncrease float64) error {
+func run(ctx context.Context, seed int64, logger desim.Logger, simulMonths int, mortgageRate float64, mortgageTerm int, mortgageLTV, stockMarketGrowthRate, brokerageInitialAmount, monthlyRentalPayment, yearlyRentIncrease, propertyValue, yoyPropertyValueIncrease float64) (experiment.Outputs, error) {
 	ltv := mortgageLTV / 100.0
 	mortgageAmount := ltv * propertyValue
 	downpaymentAmount := propertyValue - mortgageAmount
@@ -81,16 +202,16 @@ func run(simulMonths int, mortgageRate float64, mortgageTerm int, mortgageLTV, s
 		YearlyIncreasePercent: yearlyRentIncrease / 100.0,
 	}
 	var (
-		r     = rand.New(rand.NewSource(42))
+		r     = rand.New(rand.NewSource(seed))
 		start = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
 		end   = start.AddDate(0, simulMonths, 0)
 	)
-	evs := desim.New(
+	res, err := desim.New(
 		desim.NewLocalScheduler,
 		r,
 		gen.StaticTime(start),
 		gen.StaticTime(end),
-	).Run([]*desim.Actor{
+	).RunContext(ctx, []*desim.Actor{
 		desim.MakeActor("bank", makeBank(mortgageTerms)),
 		desim.MakeActor("investor", makeInvestor(assets, mortgageTerms)),
 		desim.MakeActor("stock_market", makeStockMarket(assets, stockMarketGrowthRate/100.0)),
@@ -98,14 +219,20 @@ func run(simulMonths int, mortgageRate float64, mortgageTerm int, mortgageLTV, s
 		desim.MakeActor("rental", makeRentalUnit(leaseTerms, assets)),
 	},
 		[]desim.Resource{mortgageTerms.Lock, assets.Lock, leaseTerms.Lock},
-		desim.LogJSON(os.Stdout),
+		logger,
 	)
-	_ = evs
-	// for _, ev := range evs {
-	// 	fmt.Printf("%v: %s - %s\n", ev.Time, ev.Actor, ev.Kind)
-	// }
-
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	for _, leak := range res.Leaks {
+		logger.KV("actor", leak.Actor).KV("resource", leak.Resource).Event("reservation was never released")
+	}
+	return experiment.Outputs{
+		"brokerage_value": assets.InvestedInBrokerage,
+		"property_value":  assets.PropertyValue,
+		"loan_balance":    mortgageTerms.LoanBalance,
+		"net_worth":       assets.InvestedInBrokerage + assets.PropertyValue - mortgageTerms.LoanBalance,
+	}, nil
 }
 
 type Assets struct {
@@ -190,19 +317,12 @@ func makeBank(mortgage *MortgageTerm) desim.Action {
 func makeInvestor(assets *Assets, mortgageTerms *MortgageTerm) desim.Action {
 	monthlyPayment := mortgageTerms.TermPayment()
 	return func(env desim.Env) bool {
-		releaseBrkrg, acquired := env.Acquire(assets.Lock, gen.StaticDuration(24*time.Hour))
+		release, acquired := env.AcquireAll([]desim.Resource{assets.Lock, mortgageTerms.Lock}, gen.StaticDuration(24*time.Hour))
 		if !acquired {
-			env.Log().Event("couldn't acquire brokerage resource")
+			env.Log().Event("couldn't acquire brokerage and mortgage resources")
 			return false
 		}
-		defer releaseBrkrg()
-
-		releaseMrtg, acquired := env.Acquire(mortgageTerms.Lock, gen.StaticDuration(24*time.Hour))
-		if !acquired {
-			env.Log().Event("couldn't acquire mortgage resource")
-			return false
-		}
-		defer releaseMrtg()
+		defer release()
 
 		netWorth := assets.InvestedInBrokerage + assets.PropertyValue - mortgageTerms.LoanBalance
 
@@ -334,15 +454,9 @@ func makeRentalUnit(lease *LeaseTerm, brokerage *Assets) desim.Action {
 		if renew.IsZero() {
 			renew = env.Now().AddDate(0, leaseLength, 0)
 		}
-		releaseRent, acquired := env.Acquire(lease.Lock, gen.StaticDuration(24*time.Hour))
-		if !acquired {
-			env.Log().Event("couldn't acquire lease resource")
-			return false
-		}
-
-		releaseBrkg, acquired := env.Acquire(lease.Lock, gen.StaticDuration(24*time.Hour))
+		release, acquired := env.AcquireAll([]desim.Resource{lease.Lock, brokerage.Lock}, gen.StaticDuration(24*time.Hour))
 		if !acquired {
-			env.Log().Event("couldn't acquire lease resource")
+			env.Log().Event("couldn't acquire lease and brokerage resources")
 			return false
 		}
 
@@ -363,8 +477,7 @@ func makeRentalUnit(lease *LeaseTerm, brokerage *Assets) desim.Action {
 		lease.TotalPaidRent += monthyPayment
 		env.Log().KVf("total_paid", lease.TotalPaidRent).Event("paying rent")
 
-		releaseRent()
-		releaseBrkg()
+		release()
 
 		nextEventIn := env.Now().AddDate(0, 1, 0).Sub(env.Now())
 
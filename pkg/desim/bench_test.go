@@ -3,6 +3,7 @@ package desim_test
 import (
 	"fmt"
 	"math/rand"
+	"runtime"
 	"testing"
 	"time"
 
@@ -28,6 +29,253 @@ func BenchmarkRun(b *testing.B) {
 	}
 }
 
+func BenchmarkScheduler10kActors(b *testing.B) {
+	if testing.Short() {
+		b.Skip()
+	}
+	schedulers := []struct {
+		name   string
+		mkSchd desim.SchedulerFn
+	}{
+		{"local", desim.NewLocalScheduler},
+		{"conservative", desim.NewConservativeScheduler(desim.HashPartition(runtime.GOMAXPROCS(0), time.Second))},
+	}
+	for _, schd := range schedulers {
+		b.Run(schd.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var (
+					begin = time.Unix(0, 0).UTC()
+					end   = begin.Add(10 * time.Second)
+				)
+				sim := desim.New(
+					schd.mkSchd,
+					rand.New(rand.NewSource(42)),
+					gen.StaticTime(begin),
+					gen.StaticTime(end),
+					desim.WithEventSink(desim.SinkRing(1)),
+				)
+				actors := make([]*desim.Actor, 0, 10000)
+				for actorID := 0; actorID < 10000; actorID++ {
+					actors = append(actors, desim.MakeActor(
+						fmt.Sprintf("actor%d", actorID),
+						infiniteclock(time.Duration(500+actorID%1000)*time.Millisecond),
+					))
+				}
+				_ = sim.Run(actors, nil, desim.LogMute())
+			}
+		})
+	}
+}
+
+// BenchmarkNetwork passes messages around a network of 10k nodes, whose
+// links take 50ms to 250ms.
+func BenchmarkNetwork(b *testing.B) {
+	if testing.Short() {
+		b.Skip()
+	}
+	const (
+		nodes     = 10000
+		lookahead = 50 * time.Millisecond
+	)
+	schedulers := []struct {
+		name   string
+		mkSchd desim.SchedulerFn
+	}{
+		{"local", desim.NewLocalScheduler},
+		{"conservative", desim.NewConservativeScheduler(desim.HashPartition(runtime.GOMAXPROCS(0), lookahead))},
+		{"optimistic", desim.NewOptimisticScheduler(desim.HashPartition(runtime.GOMAXPROCS(0), 0), lookahead)},
+	}
+	node := func(i int) string { return fmt.Sprintf("node%d", i) }
+	for _, schd := range schedulers {
+		b.Run(schd.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				begin := time.Unix(0, 0).UTC()
+				sim := desim.New(
+					schd.mkSchd,
+					rand.New(rand.NewSource(42)),
+					gen.StaticTime(begin),
+					gen.StaticTime(begin.Add(10*time.Second)),
+					desim.WithEventSink(desim.SinkRing(1)),
+				)
+				actors := make([]*desim.Actor, 0, nodes)
+				for n := 0; n < nodes; n++ {
+					n := n
+					actors = append(actors, desim.MakeActor(node(n), func(env desim.Env) bool {
+						if _, received := env.Receive(gen.StaticDuration(time.Second)); received {
+							env.Sleep(gen.StaticDuration(time.Millisecond))
+						}
+						link := gen.StaticDuration(lookahead * time.Duration(1+env.Rand().Intn(5)))
+						env.Send(node(env.Rand().Intn(nodes)), n, link)
+						return true
+					}))
+				}
+				_ = sim.Run(actors, nil, desim.LogMute())
+			}
+		})
+	}
+}
+
+// BenchmarkClusters passes messages for 5s within 4 clusters of 250
+// nodes, whose links take 1ms to 50ms. One message in a hundred goes to
+// another cluster, over links that take at least a second. Each cluster
+// is a logical process of the parallel schedulers.
+func BenchmarkClusters(b *testing.B) {
+	if testing.Short() {
+		b.Skip()
+	}
+	const (
+		clusters  = 4
+		nodes     = 250
+		lookahead = time.Second
+	)
+	partition := desim.Partition{
+		Processes: clusters,
+		Actor: func(name string) int {
+			var cluster, n int
+			_, _ = fmt.Sscanf(name, "cluster%d-node%d", &cluster, &n)
+			return cluster
+		},
+		Lookahead: func(from, to int) time.Duration { return lookahead },
+	}
+	schedulers := []struct {
+		name   string
+		mkSchd desim.SchedulerFn
+	}{
+		{"local", desim.NewLocalScheduler},
+		{"conservative", desim.NewConservativeScheduler(partition)},
+		{"optimistic", desim.NewOptimisticScheduler(partition, 0)},
+	}
+	node := func(cluster, n int) string { return fmt.Sprintf("cluster%d-node%d", cluster, n) }
+	for _, schd := range schedulers {
+		b.Run(schd.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				begin := time.Unix(0, 0).UTC()
+				sim := desim.New(
+					schd.mkSchd,
+					rand.New(rand.NewSource(42)),
+					gen.StaticTime(begin),
+					gen.StaticTime(begin.Add(5*time.Second)),
+					desim.WithEventSink(desim.SinkRing(1)),
+				)
+				actors := make([]*desim.Actor, 0, clusters*nodes)
+				for c := 0; c < clusters; c++ {
+					for n := 0; n < nodes; n++ {
+						c, n := c, n
+						actors = append(actors, desim.MakeActor(node(c, n), func(env desim.Env) bool {
+							env.Receive(gen.StaticDuration(100 * time.Millisecond))
+							if env.Rand().Intn(100) == 0 {
+								to := (c + 1 + env.Rand().Intn(clusters-1)) % clusters
+								env.Send(node(to, env.Rand().Intn(nodes)), n, gen.StaticDuration(lookahead))
+								return true
+							}
+							link := gen.StaticDuration(time.Duration(1+env.Rand().Intn(50)) * time.Millisecond)
+							env.Send(node(c, env.Rand().Intn(nodes)), n, link)
+							return true
+						}))
+					}
+				}
+				_ = sim.Run(actors, nil, desim.LogMute())
+			}
+		})
+	}
+}
+
+// BenchmarkWaitQueue has every actor queue on the same lock, with a
+// timeout, so the scheduler cancels a pending timeout each time the lock
+// changes hands.
+func BenchmarkWaitQueue(b *testing.B) {
+	if testing.Short() {
+		b.Skip()
+	}
+	for _, actorCount := range []int{1000, 5000, 20000} {
+		b.Run(fmt.Sprintf("%d actors", actorCount), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var (
+					begin = time.Unix(0, 0).UTC()
+					end   = begin.Add(time.Duration(actorCount) * time.Second)
+				)
+				sim := desim.New(
+					desim.NewLocalScheduler,
+					rand.New(rand.NewSource(42)),
+					gen.StaticTime(begin),
+					gen.StaticTime(end),
+					desim.WithEventSink(desim.SinkRing(1)),
+				)
+				lock := desim.MakeFIFOResource("lock", 1)
+				actors := make([]*desim.Actor, 0, actorCount)
+				for actorID := 0; actorID < actorCount; actorID++ {
+					actors = append(actors, desim.MakeActor(
+						fmt.Sprintf("actor%d", actorID),
+						func(env desim.Env) bool {
+							release, obtained := env.Acquire(lock, gen.StaticDuration(2*time.Duration(actorCount)*time.Second))
+							if obtained {
+								env.Sleep(gen.StaticDuration(time.Second))
+								release()
+							}
+							return true
+						},
+					))
+				}
+				_ = sim.Run(actors, []desim.Resource{lock}, desim.LogMute())
+			}
+		})
+	}
+}
+
+// BenchmarkHoldModel measures the event lists with the classic hold
+// model: a fixed number of events are queued, and each hold pops the
+// earliest event and queues another one a random increment later.
+func BenchmarkHoldModel(b *testing.B) {
+	lists := []struct {
+		name   string
+		mkList func() desim.EventList
+	}{
+		{"heap", desim.NewEventHeap},
+		{"calendar", desim.NewCalendarQueue},
+		{"ladder", desim.NewLadderQueue},
+	}
+	increments := []struct {
+		name string
+		gen  func(r *rand.Rand) time.Duration
+	}{
+		{"exponential", func(r *rand.Rand) time.Duration {
+			return time.Duration(r.ExpFloat64() * float64(time.Second))
+		}},
+		{"uniform", func(r *rand.Rand) time.Duration {
+			return time.Duration(r.Int63n(int64(2 * time.Second)))
+		}},
+		{"bimodal", func(r *rand.Rand) time.Duration {
+			if r.Intn(10) == 0 {
+				return time.Duration(r.Int63n(int64(time.Second))) + 100*time.Second
+			}
+			return time.Duration(r.Int63n(int64(time.Second)))
+		}},
+	}
+	for _, size := range []int{1000, 100000} {
+		for _, inc := range increments {
+			for _, list := range lists {
+				b.Run(fmt.Sprintf("%d/%s/%s", size, inc.name, list.name), func(b *testing.B) {
+					r := rand.New(rand.NewSource(42))
+					start := time.Unix(0, 0).UTC()
+					events := list.mkList()
+					id := 0
+					for ; id < size; id++ {
+						events.Push(&desim.Event{ID: id, Time: start.Add(inc.gen(r))})
+					}
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						// the popped event comes back later on
+						ev := events.Pop()
+						id++
+						ev.ID, ev.Time = id, ev.Time.Add(inc.gen(r))
+						events.Push(ev)
+					}
+				})
+			}
+		}
+	}
+}
+
 func doBenchmark(b *testing.B, maxHistory time.Duration, actors []*desim.Actor) {
 	if testing.Short() {
 		b.Skip()
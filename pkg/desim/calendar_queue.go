@@ -0,0 +1,194 @@
+package desim
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	minCalendarBuckets = 4
+	// calendarSamples is how many of the earliest events are sampled to
+	// pick the width of the days of the calendar
+	calendarSamples = 25
+)
+
+// NewCalendarQueue makes a calendar queue of events (R. Brown, 1988):
+// the events are filed in a ring of buckets, one per day of a year, and
+// the queue goes through the days in order. The number of days and their
+// width adapt to the events, for O(1) amortized operations when the
+// events are spread evenly in time.
+func NewCalendarQueue() EventList {
+	return &calendarQueue{
+		buckets: make([][]queued, minCalendarBuckets),
+		width:   int64(time.Second),
+	}
+}
+
+// calendarQueue files each event in the bucket of its day, whichever year
+// it happens, and keeps the buckets sorted. No live event happens before
+// the current day.
+type calendarQueue struct {
+	lazyList
+	buckets [][]queued
+	// width of a day, in nanoseconds
+	width int64
+	day   int64
+	// entries are the entries in the buckets, including the stale ones
+	entries int
+}
+
+func (q *calendarQueue) dayOf(ev *Event) int64 {
+	k := q.key(ev)
+	day := k / q.width
+	if k%q.width < 0 {
+		day--
+	}
+	return day
+}
+
+func (q *calendarQueue) bucketOf(day int64) int { return int(day & int64(len(q.buckets)-1)) }
+
+func (q *calendarQueue) Push(ev *Event) {
+	wasEmpty := q.n == 0
+	q.file(q.enqueue(ev))
+	if day := q.dayOf(ev); wasEmpty || day < q.day {
+		q.day = day
+	}
+	if q.entries > 2*len(q.buckets) {
+		q.resize()
+	}
+}
+
+func (q *calendarQueue) file(entry queued) {
+	b := q.bucketOf(q.dayOf(entry.ev))
+	q.buckets[b] = insertSorted(q.buckets[b], entry)
+	q.entries++
+}
+
+func (q *calendarQueue) Peek() *Event {
+	b := q.next()
+	if b < 0 {
+		return nil
+	}
+	return q.buckets[b][0].ev
+}
+
+func (q *calendarQueue) Pop() *Event {
+	b := q.next()
+	if b < 0 {
+		return nil
+	}
+	ev := q.buckets[b][0].ev
+	q.buckets[b] = q.buckets[b][1:]
+	q.entries--
+	q.dequeue(ev)
+	if q.n < len(q.buckets)/2 && len(q.buckets) > minCalendarBuckets {
+		q.resize()
+	}
+	return ev
+}
+
+// front is the first live entry of a bucket, dropping the stale entries
+// before it.
+func (q *calendarQueue) front(b int) *Event {
+	bucket := q.buckets[b]
+	for len(bucket) > 0 && !bucket[0].live() {
+		bucket = bucket[1:]
+		q.entries--
+	}
+	q.buckets[b] = bucket
+	if len(bucket) == 0 {
+		return nil
+	}
+	return bucket[0].ev
+}
+
+// next finds the bucket of the earliest event, going through the days
+// from the current one, or -1 if the queue is empty.
+func (q *calendarQueue) next() int {
+	if q.n == 0 {
+		return -1
+	}
+	for i := 0; i < len(q.buckets); i++ {
+		b := q.bucketOf(q.day)
+		if ev := q.front(b); ev != nil && q.dayOf(ev) == q.day {
+			return b
+		}
+		q.day++
+	}
+	// a whole year without an event, look for the earliest one instead
+	best := -1
+	for b := range q.buckets {
+		ev := q.front(b)
+		if ev != nil && (best < 0 || ev.Before(q.buckets[best][0].ev)) {
+			best = b
+		}
+	}
+	q.day = q.dayOf(q.buckets[best][0].ev)
+	return best
+}
+
+// resize files the live events again, in about as many buckets as there
+// are events, with days as wide as the events are apart.
+func (q *calendarQueue) resize() {
+	live := make([]queued, 0, q.n)
+	for _, bucket := range q.buckets {
+		for _, entry := range bucket {
+			if entry.live() {
+				live = append(live, entry)
+			}
+		}
+	}
+	size := minCalendarBuckets
+	for size < len(live) {
+		size *= 2
+	}
+	q.width = q.sampleWidth(live)
+	q.buckets = make([][]queued, size)
+	q.entries = 0
+	for i, entry := range live {
+		q.file(entry)
+		if day := q.dayOf(entry.ev); i == 0 || day < q.day {
+			q.day = day
+		}
+	}
+}
+
+// sampleWidth is three times the average time between the earliest
+// events, ignoring the gaps much wider than the others.
+func (q *calendarQueue) sampleWidth(live []queued) int64 {
+	// the earliest distinct times, in order
+	var keys []int64
+	for _, entry := range live {
+		k := q.key(entry.ev)
+		if len(keys) == calendarSamples && k >= keys[len(keys)-1] {
+			continue
+		}
+		i := sort.Search(len(keys), func(i int) bool { return keys[i] >= k })
+		if i < len(keys) && keys[i] == k {
+			continue
+		}
+		keys = append(keys, 0)
+		copy(keys[i+1:], keys[i:])
+		keys[i] = k
+		if len(keys) > calendarSamples {
+			keys = keys[:calendarSamples]
+		}
+	}
+	if len(keys) < 2 {
+		return q.width
+	}
+	avg := (keys[len(keys)-1] - keys[0]) / int64(len(keys)-1)
+	var sum, count int64
+	for i := 1; i < len(keys); i++ {
+		if gap := keys[i] - keys[i-1]; gap <= 2*avg {
+			sum += gap
+			count++
+		}
+	}
+	width := 3 * sum / count
+	if width < 1 {
+		width = 1
+	}
+	return width
+}
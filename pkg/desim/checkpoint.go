@@ -0,0 +1,501 @@
+package desim
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Checkpoint is the state of a simulation once every event until some
+// time happened, while every actor waits on the scheduler. A simulation
+// goes on from it with WithRestore.
+//
+// The scheduler is saved as it is: its events, reservations, queues and
+// mailboxes. The goroutines of the actors can't be, an actor is saved as
+// it was when the call to its action that waits on the scheduler started:
+// its state, the position of its random numbers, and the responses to the
+// requests it made since. The actors and resources are those of the
+// simulation, the actions of the actors it spawned are kept in memory.
+type Checkpoint struct {
+	// Start is when the simulation started, Time is when the checkpoint
+	// was taken.
+	Start time.Time
+	Time  time.Time
+	// Seed is the seed of the random numbers of the simulation.
+	Seed int64
+	// Events counts the events that happened, EventID is the last ID
+	// given to an event.
+	Events  int
+	EventID int
+	// Pending are the events still to come, earliest first.
+	Pending []CheckpointEvent
+	// Held are the reservations held by actors, and Waiting the actors
+	// waiting for a resource, a message or another actor.
+	Held    []CheckpointReservation
+	Waiting []CheckpointWait
+	// Mailboxes count the messages waiting to be received, by actor.
+	Mailboxes map[string]int
+	// Actors are the actors that were started, by name.
+	Actors []CheckpointActor
+	// Scheduler is the state of the scheduler, encoded with gob.
+	Scheduler []byte
+
+	// actions are those of the actors, for the spawned actors that the
+	// simulations going on from the checkpoint aren't given
+	actions map[string]Action
+}
+
+// A CheckpointEvent is an event still to come at a checkpoint.
+type CheckpointEvent struct {
+	Time     time.Time
+	Actor    string
+	Kind     string
+	Priority int32
+}
+
+// A CheckpointReservation is a reservation held at a checkpoint.
+type CheckpointReservation struct {
+	Resource string
+	Actor    string
+	Since    time.Time
+}
+
+// A CheckpointWait is an actor waiting on the scheduler at a checkpoint.
+type CheckpointWait struct {
+	Actor string
+	Since time.Time
+}
+
+// A CheckpointActor is an actor at a checkpoint, as it was when the call
+// to its action that waits on the scheduler started.
+type CheckpointActor struct {
+	Name string
+	Done bool
+	// Seed is the seed of its random numbers, Draws counts the numbers it
+	// drew before the call.
+	Seed  int64
+	Draws int64
+	// Now and Interruption are what the actor knew of the simulation
+	// then, State the snapshot of its state, if it has a Snapshotter.
+	Now          time.Time
+	Interruption *Interruption `json:",omitempty"`
+	State        []byte        `json:",omitempty"`
+	// Replies are the responses to the requests of the call, encoded with
+	// gob.
+	Replies []byte `json:",omitempty"`
+
+	// replies are the responses, when the checkpoint is kept in memory
+	// instead
+	replies []reply
+}
+
+// WriteTo writes the checkpoint as JSON.
+func (cp *Checkpoint) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadCheckpoint reads a checkpoint written by Checkpoint.WriteTo.
+func ReadCheckpoint(r io.Reader) (*Checkpoint, error) {
+	cp := new(Checkpoint)
+	if err := json.NewDecoder(r).Decode(cp); err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+// WithCheckpoint takes a checkpoint of the simulation once every event
+// until at happened, and hands it to save. It isn't taken if the
+// simulation ends first. The simulation fails if save returns an error.
+// The actors all wait on the scheduler meanwhile. Their Snapshotter is
+// called whenever a call to their action starts.
+func WithCheckpoint(at time.Time, save func(*Checkpoint) error) Option {
+	return func(sim *sim) {
+		sim.checkpoints = append(sim.checkpoints, checkpointRequest{at: at, save: save})
+	}
+}
+
+// WithRestore makes the simulation go on from a checkpoint of the same
+// simulation: the same actors, resources and scheduler. The scheduler
+// starts from its state at the checkpoint, the actors from the start of
+// the call to their action that waited on it: each restores its
+// Snapshotter, and its requests are answered from the responses it got
+// then, until it makes the request it was waiting on again. The
+// simulation fails with ErrNotDeterministic if it makes another one. The
+// interventions apply once every actor waits on the scheduler again, and
+// the events that follow go to the sink.
+//
+// Actors that keep state between calls to their action need a
+// Snapshotter, and the payloads of messages and items of stores must be
+// registered with gob.Register. Actors log again what they logged during
+// that call, and their clocks only have the timers made during it. The
+// statistics of the resources count what happened before the checkpoint.
+// A checkpoint read with ReadCheckpoint doesn't keep the actions of the
+// actors that were spawned: they must be given with the other actors.
+func WithRestore(cp *Checkpoint, interventions ...Intervention) Option {
+	return func(sim *sim) { sim.restore, sim.interventions = cp, interventions }
+}
+
+type checkpointRequest struct {
+	at   time.Time
+	save func(*Checkpoint) error
+}
+
+// checkpointingScheduler is implemented by the schedulers that can take
+// checkpoints.
+type checkpointingScheduler interface {
+	// checkpointAt has the scheduler call take with a checkpoint once it
+	// performed every event until at, while every actor waits on it.
+	checkpointAt(at time.Time, take func(cp *Checkpoint) error)
+	// local is the scheduler that the interventions on a simulation
+	// change
+	local() *localScheduler
+	// goOnFrom has the scheduler start from the state of a checkpoint,
+	// and call resumed once every actor of the checkpoint waits on it
+	// again.
+	goOnFrom(state *schedulerState, resumed func() error)
+}
+
+var _ checkpointingScheduler = (*localScheduler)(nil)
+
+type pendingCheckpoint struct {
+	at   time.Time
+	take func(cp *Checkpoint) error
+}
+
+func (schd *localScheduler) checkpointAt(at time.Time, take func(cp *Checkpoint) error) {
+	schd.checkpoints = append(schd.checkpoints, pendingCheckpoint{at: at, take: take})
+	sort.SliceStable(schd.checkpoints, func(i, j int) bool {
+		return schd.checkpoints[i].at.Before(schd.checkpoints[j].at)
+	})
+}
+
+func (schd *localScheduler) local() *localScheduler { return schd }
+
+// takeCheckpoints takes the checkpoints due before the next event.
+func (schd *localScheduler) takeCheckpoints() error {
+	for len(schd.checkpoints) > 0 {
+		due := schd.checkpoints[0]
+		next := schd.events.Peek()
+		if next == nil || !next.Time.After(due.at) {
+			return nil
+		}
+		schd.checkpoints = schd.checkpoints[1:]
+		cp, err := schd.checkpoint(due.at)
+		if err != nil {
+			return err
+		}
+		if err := due.take(cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint saves the state of the scheduler, and describes it.
+func (schd *localScheduler) checkpoint(at time.Time) (*Checkpoint, error) {
+	state := schd.save()
+	b, err := state.encode()
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{
+		Time:      at,
+		EventID:   state.EventID,
+		Mailboxes: make(map[string]int, len(state.Mailboxes)),
+		Scheduler: b,
+	}
+	for _, saved := range state.Events {
+		ev := saved.Event
+		cp.Pending = append(cp.Pending, CheckpointEvent{Time: ev.Time, Actor: ev.Actor, Kind: ev.Kind, Priority: ev.Priority})
+	}
+	for _, held := range state.Held {
+		cp.Held = append(cp.Held, CheckpointReservation{Resource: held.Resource, Actor: held.Actor, Since: held.Since})
+	}
+	for _, waiting := range state.Waiting {
+		cp.Waiting = append(cp.Waiting, CheckpointWait{Actor: waiting.Actor, Since: waiting.Since})
+	}
+	for actor, mailbox := range state.Mailboxes {
+		cp.Mailboxes[actor] = len(mailbox)
+	}
+	cp.Actors = state.checkpointActors()
+	return cp, nil
+}
+
+// A checkpointer completes the checkpoints taken by a scheduler with what
+// the simulation knows of its actors, and applies the interventions once
+// the simulation went on from one.
+type checkpointer struct {
+	seed  int64
+	start time.Time
+	sink  *checkpointSink
+	// memory is true if the checkpoints are kept in memory, the responses
+	// to the actors aren't encoded
+	memory bool
+	// fork is applied once the actors resumed, if the simulation has
+	// interventions
+	fork *Fork
+
+	mu     sync.Mutex
+	actors map[string]*startedActor
+}
+
+type startedActor struct {
+	seed   int64
+	env    *env
+	action Action
+	state  Snapshotter
+}
+
+func newCheckpointer(seed int64, start time.Time, sink EventSink, restore *Checkpoint) *checkpointer {
+	c := &checkpointer{
+		seed:   seed,
+		start:  start,
+		sink:   &checkpointSink{sink: sink},
+		actors: make(map[string]*startedActor),
+	}
+	if restore != nil {
+		c.start, c.sink.events = restore.Start, restore.Events
+	}
+	return c
+}
+
+// started keeps track of an actor, started, spawned or resumed, and has
+// its env log its calls.
+func (c *checkpointer) started(actor *Actor, seed int64, env *env) {
+	env.call = new(actorCall)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actors[actor.name] = &startedActor{seed: seed, env: env, action: actor.action, state: actor.state}
+}
+
+// state is the Snapshotter of an actor, if it has one.
+func (c *checkpointer) state(name string) (Snapshotter, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	actor, ok := c.actors[name]
+	if !ok || actor.state == nil {
+		return nil, false
+	}
+	return actor.state, true
+}
+
+// complete adds the actors to a checkpoint.
+func (c *checkpointer) complete(cp *Checkpoint) error {
+	cp.Start, cp.Seed, cp.Events = c.start, c.seed, c.sink.events
+	cp.actions = make(map[string]Action)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range cp.Actors {
+		saved := &cp.Actors[i]
+		actor, ok := c.actors[saved.Name]
+		if !ok {
+			continue
+		}
+		cp.actions[saved.Name] = actor.action
+		if saved.Done {
+			continue
+		}
+		call := actor.env.call
+		saved.Seed, saved.Draws = actor.seed, call.draws
+		saved.Now, saved.Interruption, saved.State = call.now, call.interruption, call.state
+		if c.memory {
+			saved.replies = append([]reply(nil), call.replies...)
+			continue
+		}
+		replies, err := call.encode()
+		if err != nil {
+			return fmt.Errorf("saving actor %q: %w", saved.Name, err)
+		}
+		saved.Replies = replies
+	}
+	return nil
+}
+
+// save completes the checkpoints before handing them to save.
+func (c *checkpointer) save(save func(*Checkpoint) error) func(*Checkpoint) error {
+	return func(cp *Checkpoint) error {
+		if err := c.complete(cp); err != nil {
+			return err
+		}
+		return save(cp)
+	}
+}
+
+// resume makes the envs of the actors that go on from a checkpoint: the
+// actors given, by name, and those they spawned.
+func (c *checkpointer) resume(cp *Checkpoint, given map[string]*Actor, makeEnv func(actor *Actor, seed int64, now time.Time) *env) ([]*Actor, []*env, error) {
+	var (
+		resumed []*Actor
+		envs    []*env
+	)
+	for i := range cp.Actors {
+		at := &cp.Actors[i]
+		if at.Done {
+			continue
+		}
+		actor, ok := given[at.Name]
+		if !ok {
+			action, spawned := cp.actions[at.Name]
+			if !spawned {
+				return nil, nil, fmt.Errorf("actor %q of the checkpoint isn't in the simulation", at.Name)
+			}
+			actor = MakeActor(at.Name, action)
+		}
+		env := makeEnv(actor, at.Seed, at.Now)
+		// the actor draws the same numbers from there
+		for i := int64(0); i < at.Draws; i++ {
+			env.src.Uint64()
+		}
+		env.interruption = at.Interruption
+		c.started(actor, at.Seed, env)
+		if err := env.call.resume(at); err != nil {
+			return nil, nil, fmt.Errorf("resuming actor %q: %w", at.Name, err)
+		}
+		if actor.state != nil && at.State != nil {
+			if err := actor.state.Restore(at.State); err != nil {
+				return nil, nil, fmt.Errorf("restoring actor %q: %w", at.Name, err)
+			}
+		}
+		resumed, envs = append(resumed, actor), append(envs, env)
+	}
+	return resumed, envs, nil
+}
+
+// resumed applies the interventions, once the actors resumed.
+func (c *checkpointer) resumed() error {
+	if c.fork != nil {
+		return c.fork.intervene()
+	}
+	return nil
+}
+
+// checkpointSink counts the events.
+type checkpointSink struct {
+	sink   EventSink
+	events int
+}
+
+func (sink *checkpointSink) Handle(ev *Event) error {
+	sink.events++
+	return sink.sink.Handle(ev)
+}
+
+// An actorCall is what an actor that can be checkpointed knows when the
+// call to its action starts, and the responses to the requests it made
+// since. An actor resumed from a checkpoint gets the same responses to the
+// same requests, until it runs out of them.
+type actorCall struct {
+	now          time.Time
+	interruption *Interruption
+	draws        int64
+	state        []byte
+	replies      []reply
+	// replaying is true from when the actor resumes until it runs out of
+	// replies, resumed once it started the call again
+	replaying, resumed bool
+	replayed           int
+}
+
+// A reply is a response in the log of a call, and what it answered.
+type reply struct {
+	Request  string
+	Response *Response
+}
+
+// start a call of the actor, unless it's the one it resumes.
+func (call *actorCall) start(env *env, state Snapshotter) {
+	if call.replaying {
+		if call.resumed {
+			panic(fmt.Errorf("%w: actor %q returned after %d of the %d requests it made before the checkpoint", ErrNotDeterministic, env.actorName, call.replayed, len(call.replies)))
+		}
+		call.resumed = true
+		return
+	}
+	call.now, call.interruption = env.now, env.interruption
+	call.draws = atomic.LoadInt64(&env.src.draws)
+	call.replies = call.replies[:0]
+	call.state = nil
+	if state != nil {
+		snapshot, err := state.Snapshot()
+		if err != nil {
+			panic(fmt.Errorf("snapshotting actor %q: %w", env.actorName, err))
+		}
+		call.state = snapshot
+	}
+}
+
+// log the response to a request.
+func (call *actorCall) log(reqType *RequestType, resp *Response) {
+	call.replies = append(call.replies, reply{Request: requestKind(reqType), Response: resp})
+}
+
+// replay the response to a request the actor made before the checkpoint.
+func (call *actorCall) replay(actor string, reqType *RequestType) *Response {
+	r := call.replies[call.replayed]
+	call.replayed++
+	call.replaying = call.replayed < len(call.replies)
+	if kind := requestKind(reqType); kind != r.Request {
+		panic(fmt.Errorf("%w: actor %q asked to %s, instead of to %s, before the checkpoint", ErrNotDeterministic, actor, kind, r.Request))
+	}
+	return r.Response
+}
+
+func (call *actorCall) encode() ([]byte, error) {
+	if len(call.replies) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(call.replies); err != nil {
+		return nil, fmt.Errorf("encoding the responses to its requests: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// resume the call saved in a checkpoint.
+func (call *actorCall) resume(saved *CheckpointActor) error {
+	call.now, call.interruption = saved.Now, saved.Interruption
+	call.draws, call.state = saved.Draws, saved.State
+	if saved.replies != nil {
+		// the same checkpoint may be resumed from again
+		call.replies = append([]reply(nil), saved.replies...)
+		call.replaying = len(call.replies) > 0
+		return nil
+	}
+	if len(saved.Replies) == 0 {
+		return nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(saved.Replies)).Decode(&call.replies); err != nil {
+		return fmt.Errorf("decoding the responses to its requests: %w", err)
+	}
+	call.replaying = true
+	return nil
+}
+
+// countingSource counts the random numbers drawn from a source, to tell
+// how far along it an actor is.
+type countingSource struct {
+	rand.Source64
+	draws int64
+}
+
+func (src *countingSource) Int63() int64 {
+	atomic.AddInt64(&src.draws, 1)
+	return src.Source64.Int63()
+}
+
+func (src *countingSource) Uint64() uint64 {
+	atomic.AddInt64(&src.draws, 1)
+	return src.Source64.Uint64()
+}
@@ -0,0 +1,81 @@
+package desim
+
+import (
+	"reflect"
+	"time"
+)
+
+// A Clock tells the time and makes timers, like the time package. Code
+// that takes a Clock instead of calling the time package directly can run
+// for real with RealClock, or in simulated time in an actor with
+// Env.Clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+	// Wait is like a select receiving from the timers and tickers: it
+	// waits until one of them has a time, and returns its index and the
+	// time. A select on the channels of several timers of Env.Clock
+	// would wait on the first one it evaluates, Wait waits on the one
+	// due first.
+	Wait(timers ...Channel) (int, time.Time)
+}
+
+// A Channel is a Timer or a Ticker, what Wait receives a time from.
+type Channel interface {
+	C() <-chan time.Time
+}
+
+// A Timer is a time.Timer of a Clock.
+type Timer interface {
+	// C is where the time is sent when the timer fires. It's nil for the
+	// timers of AfterFunc.
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// A Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// RealClock is the clock of the time package.
+func RealClock() Clock { return realClock{} }
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) Wait(timers ...Channel) (int, time.Time) {
+	cases := make([]reflect.SelectCase, len(timers))
+	for i, t := range timers {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.C())}
+	}
+	i, v, ok := reflect.Select(cases)
+	if !ok {
+		// closed, like a receive of the zero time
+		return i, time.Time{}
+	}
+	return i, v.Interface().(time.Time)
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
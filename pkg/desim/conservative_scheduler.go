@@ -0,0 +1,761 @@
+package desim
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Partition splits the actors and resources of a simulation into
+// logical processes, that a parallel scheduler runs on cores of their own.
+//
+// Actors of different processes can only exchange messages, sent at least
+// the lookahead between their processes in advance. Those that share
+// resources, interrupt or join one another must be in the same process.
+type Partition struct {
+	// Processes is how many logical processes there are.
+	Processes int
+	// Actor is the process of an actor, from 0 to Processes-1. Actors are
+	// in the first process if it's nil. The actors spawned during the
+	// simulation are in the process of the actor that spawns them.
+	Actor func(name string) int
+	// Resource is the process of a resource, only its actors can use it.
+	// Resources are in the first process if it's nil.
+	Resource func(id string) int
+	// Lookahead is the shortest delay of the messages sent by the actors
+	// of a process to those of another. Processes that don't exchange
+	// messages have none, nor do any if it's nil. The longer it is, the
+	// further processes can run ahead of one another. The optimistic
+	// scheduler needs none, only messages that take some time.
+	Lookahead func(from, to int) time.Duration
+}
+
+// HashPartition splits actors and resources into processes by the hash of
+// their names, with the same lookahead between every process. It suits
+// models whose actors only exchange messages, like networks whose links
+// take at least the lookahead.
+func HashPartition(processes int, lookahead time.Duration) Partition {
+	byName := func(name string) int {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(name))
+		return int(h.Sum32() % uint32(processes))
+	}
+	return Partition{
+		Processes: processes,
+		Actor:     byName,
+		Resource:  byName,
+		Lookahead: func(from, to int) time.Duration { return lookahead },
+	}
+}
+
+func (p Partition) actor(name string) int {
+	if p.Actor == nil {
+		return 0
+	}
+	return p.Actor(name)
+}
+
+func (p Partition) resource(id string) int {
+	if p.Resource == nil {
+		return 0
+	}
+	return p.Resource(id)
+}
+
+func (p Partition) lookahead(from, to int) time.Duration {
+	if p.Lookahead == nil {
+		return 0
+	}
+	return p.Lookahead(from, to)
+}
+
+// NewConservativeScheduler makes a parallel scheduler, after Chandy, Misra
+// and Bryant. Each logical process of the partition has its own event
+// list and performs its events on a goroutine of its own, but only those
+// that no message from another process can precede: the processes tell
+// each other, with null messages, how soon their next messages can
+// arrive. The histories of the processes are merged into the same history
+// as with NewLocalScheduler.
+//
+// Options that change how events are performed, like pacing, deadlock
+// detection or other event lists, aren't supported. An actor that aborts
+// stops every process, those that ran ahead of it may have performed
+// events that NewLocalScheduler wouldn't have.
+func NewConservativeScheduler(partition Partition) SchedulerFn {
+	return func(actorCount int, resources []Resource) (Scheduler, SchedulerClient) {
+		if partition.Processes < 1 {
+			partition.Processes = 1
+		}
+		schd := &conservativeScheduler{
+			partition:  partition,
+			actorCount: actorCount,
+			resources:  resources,
+			processOf:  make(map[string]int),
+			initial:    make([]int, partition.Processes),
+			ready:      make(chan struct{}),
+			started:    make(chan struct{}),
+			over:       make(chan struct{}),
+			stopped:    make(chan struct{}),
+			aborted:    make(chan struct{}),
+			merge:      make(chan struct{}, 1),
+		}
+		if actorCount == 0 {
+			close(schd.ready)
+		}
+		return schd, schd
+	}
+}
+
+var (
+	_ Scheduler       = (*conservativeScheduler)(nil)
+	_ SchedulerClient = (*conservativeScheduler)(nil)
+	_ leakReporter    = (*conservativeScheduler)(nil)
+)
+
+// never is a time after every event, in nanoseconds.
+const never = math.MaxInt64
+
+type conservativeScheduler struct {
+	partition  Partition
+	actorCount int
+	resources  []Resource
+
+	mu sync.RWMutex
+	// processOf is the process of each actor that made a request
+	processOf map[string]int
+	// initial counts the actors of each process, until every actor made
+	// its first request and ready is closed
+	initial    []int
+	registered int
+	ready      chan struct{}
+	setupErr   error
+	// started is closed once the processes are made
+	started   chan struct{}
+	processes []*logicalProcess
+	// resourceOf is the process of each resource
+	resourceOf map[string]int
+
+	// idle counts the processes that wait for messages with nothing to do,
+	// over is closed once they all do and no message is on its way
+	idleMu   sync.Mutex
+	idle     int
+	inFlight int64
+	over     chan struct{}
+	isOver   bool
+
+	errMu sync.Mutex
+	err   error
+	// stopped is closed when the simulation fails
+	stopped chan struct{}
+	// aborted is closed when an actor aborts the simulation at abortedAt
+	abortOnce sync.Once
+	aborted   chan struct{}
+	abortedAt time.Time
+
+	// merge wakes up the goroutine that merges the histories
+	merge chan struct{}
+}
+
+func (schd *conservativeScheduler) Schedule(req *Request) *Response {
+	process, ok := schd.register(req.Actor)
+	<-schd.started
+	if !ok || schd.processes == nil {
+		return &Response{Done: true}
+	}
+	return schd.processes[process].Schedule(req)
+}
+
+// register finds the process of an actor, counting the actors of each
+// process until the simulation starts.
+func (schd *conservativeScheduler) register(actor string) (int, bool) {
+	schd.mu.RLock()
+	process, ok := schd.processOf[actor]
+	schd.mu.RUnlock()
+	if ok {
+		return process, true
+	}
+
+	schd.mu.Lock()
+	defer schd.mu.Unlock()
+	if process, ok := schd.processOf[actor]; ok {
+		return process, true
+	}
+	process = schd.partition.actor(actor)
+	if process < 0 || process >= schd.partition.Processes {
+		if schd.setupErr == nil {
+			schd.setupErr = fmt.Errorf("actor %q is in process %d of a partition of %d processes", actor, process, schd.partition.Processes)
+		}
+		return 0, false
+	}
+	schd.processOf[actor] = process
+	select {
+	case <-schd.ready:
+	default:
+		schd.initial[process]++
+		schd.registered++
+		if schd.registered == schd.actorCount {
+			close(schd.ready)
+		}
+	}
+	return process, true
+}
+
+// lookup finds the process of an actor, which may not have made a
+// request yet.
+func (schd *conservativeScheduler) lookup(actor string) int {
+	schd.mu.RLock()
+	process, ok := schd.processOf[actor]
+	schd.mu.RUnlock()
+	if ok {
+		return process
+	}
+	return schd.partition.actor(actor)
+}
+
+func (schd *conservativeScheduler) Run(ctx context.Context, r *rand.Rand, start, end time.Time, sink EventSink) error {
+	select {
+	case <-schd.ready:
+	case <-ctx.Done():
+		schd.mu.Lock()
+		schd.setupErr = ctx.Err()
+		schd.mu.Unlock()
+	}
+	if err := schd.setup(ctx, start, end); err != nil {
+		close(schd.started)
+		return err
+	}
+	close(schd.started)
+
+	merged := make(chan struct{})
+	processesDone := make(chan struct{})
+	go func() {
+		defer close(merged)
+		schd.mergeHistories(sink, processesDone)
+	}()
+
+	var wg sync.WaitGroup
+	for _, lp := range schd.processes {
+		wg.Add(1)
+		go func(lp *logicalProcess) {
+			defer wg.Done()
+			lp.run(ctx)
+		}(lp)
+	}
+	wg.Wait()
+
+	locals := make([]*localScheduler, 0, len(schd.processes))
+	for _, lp := range schd.processes {
+		locals = append(locals, lp.localScheduler)
+	}
+	finishTogether(end, locals)
+	close(processesDone)
+	<-merged
+
+	schd.errMu.Lock()
+	defer schd.errMu.Unlock()
+	return schd.err
+}
+
+// setup makes the processes, with the actors and resources of each, and
+// the links between them.
+func (schd *conservativeScheduler) setup(ctx context.Context, start, end time.Time) error {
+	schd.mu.Lock()
+	defer schd.mu.Unlock()
+	if schd.setupErr != nil {
+		return schd.setupErr
+	}
+	n := schd.partition.Processes
+	resources := make([][]Resource, n)
+	schd.resourceOf = make(map[string]int, len(schd.resources))
+	for _, res := range schd.resources {
+		process := schd.partition.resource(res.id())
+		if process < 0 || process >= n {
+			return fmt.Errorf("resource %q is in process %d of a partition of %d processes", res.id(), process, n)
+		}
+		resources[process] = append(resources[process], res)
+		schd.resourceOf[res.id()] = process
+	}
+
+	schd.processes = make([]*logicalProcess, n)
+	for i := range schd.processes {
+		lp := &logicalProcess{
+			localScheduler: newLocalScheduler(schd.initial[i], resources[i]),
+			index:          i,
+			parent:         schd,
+			clock:          start.UnixNano(),
+			wake:           make(chan struct{}, 1),
+		}
+		// the events of each process have IDs of their own
+		lp.eventID = i * (math.MaxInt / n)
+		lp.admit = lp.admitRequest
+		lp.forward = lp.forwardMessage
+		lp.begin(ctx, start, end, (*processSink)(lp))
+		schd.processes[i] = lp
+	}
+	for _, from := range schd.processes {
+		for _, to := range schd.processes {
+			if from == to {
+				continue
+			}
+			lookahead := schd.partition.lookahead(from.index, to.index)
+			if lookahead <= 0 {
+				continue
+			}
+			link := &processLink{to: to, lookahead: lookahead, bound: addTime(start.UnixNano(), lookahead)}
+			from.outs = append(from.outs, link)
+			to.ins = append(to.ins, link)
+		}
+	}
+	return nil
+}
+
+// fail stops every process, only the first error is kept.
+func (schd *conservativeScheduler) fail(err error) {
+	schd.errMu.Lock()
+	defer schd.errMu.Unlock()
+	if schd.err == nil {
+		schd.err = err
+		close(schd.stopped)
+	}
+}
+
+func (schd *conservativeScheduler) failed() error {
+	schd.errMu.Lock()
+	defer schd.errMu.Unlock()
+	return schd.err
+}
+
+// abort stops every process, an actor aborted the simulation.
+func (schd *conservativeScheduler) abort(at time.Time) {
+	schd.abortOnce.Do(func() {
+		schd.abortedAt = at
+		close(schd.aborted)
+	})
+}
+
+// setIdle counts a process that waits with nothing to do, or that has
+// something again. The simulation is over once every process waits and
+// no message is on its way.
+func (schd *conservativeScheduler) setIdle(lp *logicalProcess, idle bool) {
+	if lp.idle == idle {
+		return
+	}
+	lp.idle = idle
+	schd.idleMu.Lock()
+	defer schd.idleMu.Unlock()
+	if !idle {
+		schd.idle--
+		return
+	}
+	schd.idle++
+	if !schd.isOver && schd.idle == len(schd.processes) && atomic.LoadInt64(&schd.inFlight) == 0 {
+		schd.isOver = true
+		close(schd.over)
+	}
+}
+
+func (schd *conservativeScheduler) leaks() []*Leak {
+	locals := make([]*localScheduler, 0, len(schd.processes))
+	for _, lp := range schd.processes {
+		locals = append(locals, lp.localScheduler)
+	}
+	return mergeLeaks(locals)
+}
+
+// finishTogether finishes the schedulers of the processes of a simulation.
+// The resources are observed until the end of the whole simulation: the
+// end, if a process got to it, or the time of the last event otherwise.
+func finishTogether(end time.Time, processes []*localScheduler) {
+	var stoppedAt time.Time
+	for _, schd := range processes {
+		if schd.currentTime.After(stoppedAt) {
+			stoppedAt = schd.currentTime
+		}
+		if !end.IsZero() && schd.stoppedAt.Equal(end) {
+			stoppedAt = end
+			break
+		}
+	}
+	for _, schd := range processes {
+		schd.stoppedAt = stoppedAt
+		schd.finish()
+	}
+}
+
+// mergeLeaks lists the leaks found by the schedulers of the processes, in
+// the order they were found.
+func mergeLeaks(processes []*localScheduler) []*Leak {
+	var leaks []*Leak
+	for _, schd := range processes {
+		leaks = append(leaks, schd.foundLeaks...)
+	}
+	sort.SliceStable(leaks, func(i, j int) bool { return leaks[i].Time.Before(leaks[j].Time) })
+	return leaks
+}
+
+// mergeHistories hands the events of every process to the sink, in the
+// order NewLocalScheduler would have performed them: the next event of
+// the history is the first of the next events of the processes, once the
+// processes without one are known to perform theirs later.
+func (schd *conservativeScheduler) mergeHistories(sink EventSink, processesDone chan struct{}) {
+	var sinkErr error
+	for {
+		done := false
+		select {
+		case <-schd.merge:
+		case <-processesDone:
+			done = true
+		}
+		for {
+			var (
+				next      *Event
+				nextOf    *logicalProcess
+				unknownAt int64 = never
+			)
+			for _, lp := range schd.processes {
+				// the clock is read before the history, the events
+				// performed after the clock was read come after it
+				clock := atomic.LoadInt64(&lp.clock)
+				lp.historyMu.Lock()
+				var head *Event
+				if len(lp.history) > 0 {
+					head = lp.history[0]
+				}
+				lp.historyMu.Unlock()
+				if head == nil {
+					if clock < unknownAt {
+						unknownAt = clock
+					}
+					continue
+				}
+				if next == nil || head.Before(next) {
+					next, nextOf = head, lp
+				}
+			}
+			if next == nil || next.Time.UnixNano() >= unknownAt {
+				break
+			}
+			nextOf.historyMu.Lock()
+			nextOf.history[0] = nil
+			nextOf.history = nextOf.history[1:]
+			nextOf.historyMu.Unlock()
+			if sinkErr == nil {
+				if sinkErr = sink.Handle(next); sinkErr != nil {
+					schd.fail(sinkErr)
+				}
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// addTime adds a duration to a time in nanoseconds, up to never.
+func addTime(at int64, d time.Duration) int64 {
+	if at > never-int64(d) {
+		return never
+	}
+	return at + int64(d)
+}
+
+// A logicalProcess performs the events of some actors and resources,
+// those before the messages that other processes may still send it.
+type logicalProcess struct {
+	*localScheduler
+	index  int
+	parent *conservativeScheduler
+	// ins and outs are the links from and to the other processes
+	ins, outs []*processLink
+	// clock is a time, in nanoseconds, before any event the process will
+	// perform
+	clock int64
+	// wake is signaled when the process may be able to go on
+	wake chan struct{}
+	idle bool
+
+	inboxMu sync.Mutex
+	// inbox are the deliveries of messages sent by other processes
+	inbox  []*Event
+	closed bool
+
+	historyMu sync.Mutex
+	// history are the events performed, until they are merged
+	history []*Event
+}
+
+// A processLink carries messages from a process to another, the null
+// message on it is the time before which no more messages will arrive.
+type processLink struct {
+	to        *logicalProcess
+	lookahead time.Duration
+	// bound is the time of the null message, in nanoseconds
+	bound int64
+}
+
+// processSink keeps the history of a process, until it's merged.
+type processSink logicalProcess
+
+func (sink *processSink) Handle(ev *Event) error {
+	lp := (*logicalProcess)(sink)
+	if ev.Signals.Has(SignalAbort) {
+		lp.parent.abort(ev.Time)
+	}
+	lp.historyMu.Lock()
+	lp.history = append(lp.history, ev)
+	lp.historyMu.Unlock()
+	lp.parent.wakeMerger()
+	return nil
+}
+
+func (schd *conservativeScheduler) wakeMerger() {
+	select {
+	case schd.merge <- struct{}{}:
+	default:
+	}
+}
+
+func (lp *logicalProcess) signal() {
+	select {
+	case lp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run performs the events of the process, once every one of its actors
+// waits on it.
+func (lp *logicalProcess) run(ctx context.Context) {
+	defer lp.close()
+	for {
+		for lp.err == nil && len(lp.pendingResponse) != lp.actorsRunning {
+			select {
+			case env := <-lp.queue:
+				lp.recvRequest(env)
+			case <-lp.parent.stopped:
+				lp.fail(lp.parent.failed())
+			case <-ctx.Done():
+				lp.fail(ctx.Err())
+			}
+		}
+		if !lp.advance(ctx) {
+			return
+		}
+	}
+}
+
+// advance performs the next event of the process, waiting until no other
+// process can send it a message that comes first. It returns false when
+// the process is over.
+func (lp *logicalProcess) advance(ctx context.Context) bool {
+	aborted := lp.parent.aborted
+	for {
+		if lp.err != nil {
+			lp.parent.fail(lp.err)
+			return false
+		}
+		select {
+		case <-aborted:
+			aborted = nil
+			if !lp.aborted {
+				lp.abortNow(&Event{Time: lp.parent.abortedAt})
+			}
+		default:
+		}
+
+		// the bounds are read before the inbox, the messages sent before
+		// a bound was raised are in it
+		inBound := int64(never)
+		for _, link := range lp.ins {
+			if bound := atomic.LoadInt64(&link.bound); bound < inBound {
+				inBound = bound
+			}
+		}
+		lp.receive()
+
+		var next *Event
+		clock := inBound
+		if lp.events.Len() > 0 {
+			next = lp.events.Peek()
+			if at := next.Time.UnixNano(); at < clock {
+				clock = at
+			}
+		}
+		lp.publish(clock)
+
+		switch {
+		case clock == never:
+			// nothing will ever happen
+			return false
+		case !lp.end.IsZero() && clock > lp.end.UnixNano():
+			if next == nil {
+				next = &Event{Time: lp.end}
+			}
+			lp.abortNow(next)
+			lp.stoppedAt = lp.end
+			return false
+		case next != nil && next.Time.UnixNano() < inBound:
+			return lp.step()
+		}
+
+		// wait for the other processes
+		lp.parent.setIdle(lp, next == nil)
+		select {
+		case <-lp.wake:
+		case <-lp.parent.over:
+			return false
+		case <-lp.parent.stopped:
+			lp.fail(lp.parent.failed())
+		case <-aborted:
+		case <-ctx.Done():
+			lp.fail(ctx.Err())
+		}
+	}
+}
+
+// receive moves the messages sent by other processes to the event list.
+func (lp *logicalProcess) receive() {
+	lp.inboxMu.Lock()
+	inbox := lp.inbox
+	lp.inbox = nil
+	lp.inboxMu.Unlock()
+	if len(inbox) == 0 {
+		return
+	}
+	for _, ev := range inbox {
+		msg := ev.Message
+		ev.onHandle = func() {
+			lp.deliverMessage(msg)
+		}
+		lp.events.Push(ev)
+	}
+	// the process isn't idle before the messages stop being in flight
+	lp.parent.setIdle(lp, false)
+	atomic.AddInt64(&lp.parent.inFlight, -int64(len(inbox)))
+}
+
+// publish sends null messages: the process won't perform events before
+// clock, nor send messages before clock and the lookahead of each link.
+func (lp *logicalProcess) publish(clock int64) {
+	if clock > atomic.LoadInt64(&lp.clock) {
+		atomic.StoreInt64(&lp.clock, clock)
+		lp.parent.wakeMerger()
+	}
+	for _, link := range lp.outs {
+		bound := addTime(clock, link.lookahead)
+		if bound > atomic.LoadInt64(&link.bound) {
+			atomic.StoreInt64(&link.bound, bound)
+			link.to.signal()
+		}
+	}
+}
+
+// close tells the other processes and the merger that the process is
+// over, the messages sent to it are dropped: they come after its end.
+func (lp *logicalProcess) close() {
+	lp.inboxMu.Lock()
+	dropped := len(lp.inbox)
+	lp.inbox, lp.closed = nil, true
+	lp.inboxMu.Unlock()
+	atomic.AddInt64(&lp.parent.inFlight, -int64(dropped))
+	lp.publish(never)
+	lp.parent.setIdle(lp, true)
+	if lp.err != nil {
+		lp.parent.fail(lp.err)
+	}
+}
+
+// admitRequest fails the requests that reach across processes, except
+// messages sent far enough in advance.
+func (lp *logicalProcess) admitRequest(req *Request) error {
+	reqType := req.Type
+	switch {
+	case reqType.SendMessage != nil:
+		to := lp.parent.lookup(reqType.SendMessage.To)
+		if to == lp.index {
+			return nil
+		}
+		if to < 0 || to >= len(lp.parent.processes) {
+			return fmt.Errorf("actor %q is in process %d of a partition of %d processes", reqType.SendMessage.To, to, len(lp.parent.processes))
+		}
+		lookahead := lp.parent.partition.lookahead(lp.index, to)
+		if lookahead <= 0 {
+			return fmt.Errorf("%w: actor %q of process %d sent a message to %q of process %d, they have no lookahead", ErrCrossPartition, req.Actor, lp.index, reqType.SendMessage.To, to)
+		}
+		if req.AsyncDelay < lookahead {
+			return fmt.Errorf("%w: actor %q of process %d sent a message to %q of process %d in %v, under their lookahead of %v", ErrCrossPartition, req.Actor, lp.index, reqType.SendMessage.To, to, req.AsyncDelay, lookahead)
+		}
+		return nil
+	case reqType.Spawn != nil:
+		// the new actor stays in this process
+		lp.parent.mu.Lock()
+		lp.parent.processOf[reqType.Spawn.Actor] = lp.index
+		lp.parent.mu.Unlock()
+		return nil
+	}
+	return crossesPartition(req, lp.index, lp.parent.resourceOf, lp.parent.lookup)
+}
+
+// crossesPartition fails the requests of an actor that reach the
+// resources or the actors of other processes, other than by messages.
+func crossesPartition(req *Request, process int, resourceOf map[string]int, lookup func(actor string) int) error {
+	reqType := req.Type
+	var (
+		resources []string
+		actor     string
+	)
+	switch {
+	case reqType.AcquireResource != nil:
+		resources = []string{reqType.AcquireResource.ResourceID}
+	case reqType.ReleaseResource != nil:
+		resources = []string{reqType.ReleaseResource.ResourceID}
+	case reqType.AcquireResources != nil:
+		resources = reqType.AcquireResources.ResourceIDs
+	case reqType.ReleaseResources != nil:
+		resources = reqType.ReleaseResources.ResourceIDs
+	case reqType.PutContainer != nil, reqType.GetContainer != nil:
+		resources = []string{containerID(reqType)}
+	case reqType.PutStore != nil, reqType.GetStore != nil:
+		resources = []string{storeID(reqType)}
+	case reqType.Interrupt != nil:
+		actor = reqType.Interrupt.Actor
+	case reqType.Join != nil:
+		actor = reqType.Join.Actor
+	}
+	for _, id := range resources {
+		// unknown resources fail as they do with one process
+		if other, ok := resourceOf[id]; ok && other != process {
+			return fmt.Errorf("%w: actor %q of process %d can't use %q of process %d", ErrCrossPartition, req.Actor, process, id, other)
+		}
+	}
+	if actor != "" {
+		if other := lookup(actor); other != process {
+			return fmt.Errorf("%w: actor %q of process %d can't wait on or interrupt %q of process %d", ErrCrossPartition, req.Actor, process, actor, other)
+		}
+	}
+	return nil
+}
+
+// forwardMessage hands the delivery of a message to the process of its
+// recipient. The event keeps the ID it got here: events of the same actor
+// are ordered by ID, and they are all made by its process.
+func (lp *logicalProcess) forwardMessage(to string, ev *Event) bool {
+	process := lp.parent.lookup(to)
+	if process == lp.index {
+		return false
+	}
+	dest := lp.parent.processes[process]
+	dest.inboxMu.Lock()
+	if !dest.closed {
+		atomic.AddInt64(&lp.parent.inFlight, 1)
+		dest.inbox = append(dest.inbox, ev)
+	}
+	dest.inboxMu.Unlock()
+	dest.signal()
+	return true
+}
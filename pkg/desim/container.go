@@ -0,0 +1,387 @@
+package desim
+
+import (
+	"time"
+)
+
+// A Container is a resource holding a continuous quantity, like the fuel
+// in a tank or the cash in an account. Actors put amounts in it and get
+// amounts out of it, waiting until there's enough room or enough left.
+type Container interface {
+	Resource
+	// Level is the amount in the container. Actors can look at it
+	// during their actions.
+	Level() float64
+	// Capacity is the largest amount the container can hold.
+	Capacity() float64
+
+	monitor() *containerMonitor
+	// request to put or get an amount, serving the requests that can be
+	// satisfied. The request waits in line if it isn't served.
+	request(put bool, byActor string, amount float64, now time.Time, notify func(*containerRequest)) *containerRequest
+	// cancel gives up on a request that is waiting in line. The requests
+	// it was holding up must be served afterward.
+	cancel(req *containerRequest, now time.Time, timedout bool)
+	// serve the requests that can be satisfied, in the order they were
+	// made
+	serve(now time.Time, notify func(*containerRequest))
+	// save describes the level, the requests in line and the statistics
+	// of the container, restore sets them back
+	save() *savedContainer
+	restore(saved *savedContainer)
+	// waitingFor is the request of an actor waiting in line, or nil
+	waitingFor(actor string, put bool) *containerRequest
+}
+
+// MakeContainer makes a container holding up to capacity, starting with
+// the initial amount. Puts and gets are each served in first-in first-out
+// order: a request that can't be satisfied holds up the ones behind it.
+func MakeContainer(name string, capacity, initial float64) Container {
+	return &container{name: name, capacity: capacity, initial: initial, level: initial}
+}
+
+type containerRequest struct {
+	put         bool
+	actor       string
+	amount      float64
+	requestedAt time.Time
+
+	served    bool
+	waiting   bool
+	cancelled bool
+}
+
+type container struct {
+	name     string
+	capacity float64
+	initial  float64
+	level    float64
+
+	puts    []*containerRequest
+	gets    []*containerRequest
+	waiting int
+
+	mon containerMonitor
+}
+
+func (c *container) id() string                 { return c.name }
+func (c *container) Level() float64             { return c.level }
+func (c *container) Capacity() float64          { return c.capacity }
+func (c *container) monitor() *containerMonitor { return &c.mon }
+
+func (c *container) begin(now time.Time) {
+	c.level = c.initial
+	c.puts, c.gets, c.waiting = nil, nil, 0
+	c.mon.begin(c.name, c.capacity, c.level, now)
+}
+
+func (c *container) end(now time.Time) { c.mon.end(now) }
+
+func (c *container) request(put bool, byActor string, amount float64, now time.Time, notify func(*containerRequest)) *containerRequest {
+	req := &containerRequest{put: put, actor: byActor, amount: amount, requestedAt: now}
+	if put {
+		c.puts = append(c.puts, req)
+	} else {
+		c.gets = append(c.gets, req)
+	}
+	c.serve(now, notify)
+	if !req.served {
+		req.waiting = true
+		c.waiting++
+		c.mon.setQueued(now, c.waiting)
+	}
+	return req
+}
+
+func (c *container) cancel(req *containerRequest, now time.Time, timedout bool) {
+	if req.cancelled || req.served {
+		return
+	}
+	// it will be skipped when its turn comes
+	req.cancelled = true
+	c.waiting--
+	c.mon.setQueued(now, c.waiting)
+	if timedout {
+		c.mon.timedout()
+	}
+}
+
+func (c *container) serve(now time.Time, notify func(*containerRequest)) {
+	for progress := true; progress; {
+		progress = false
+		for len(c.puts) > 0 {
+			req := c.puts[0]
+			if !req.cancelled {
+				if c.level+req.amount > c.capacity {
+					break
+				}
+				c.level += req.amount
+				c.served(req, now, notify)
+				progress = true
+			}
+			c.puts[0] = nil
+			c.puts = c.puts[1:]
+		}
+		for len(c.gets) > 0 {
+			req := c.gets[0]
+			if !req.cancelled {
+				if c.level < req.amount {
+					break
+				}
+				c.level -= req.amount
+				c.served(req, now, notify)
+				progress = true
+			}
+			c.gets[0] = nil
+			c.gets = c.gets[1:]
+		}
+	}
+}
+
+func (c *container) served(req *containerRequest, now time.Time, notify func(*containerRequest)) {
+	req.served = true
+	if req.waiting {
+		c.waiting--
+		c.mon.setQueued(now, c.waiting)
+	}
+	c.mon.served(now, req.put, req.requestedAt, c.level)
+	notify(req)
+}
+
+// ContainerStats are gathered on a container while a simulation runs.
+type ContainerStats struct {
+	Name     string
+	Capacity float64
+
+	// AvgLevel is the time-weighted average of the level.
+	AvgLevel float64
+	MinLevel float64
+	MaxLevel float64
+	// Level records the level each time it changed, if the simulation
+	// keeps samples.
+	Level []Sample
+
+	// AvgQueueLength is the time-weighted average of the number of
+	// requests waiting in line.
+	AvgQueueLength float64
+	MaxQueueLength int
+	// PutWait and GetWait sum up how long the requests waited.
+	PutWait WaitStats
+	GetWait WaitStats
+	// PutWaits and GetWaits record how long each request waited, if the
+	// simulation keeps samples.
+	PutWaits []time.Duration
+	GetWaits []time.Duration
+
+	Puts     int
+	Gets     int
+	Timeouts int
+}
+
+// containerMonitor keeps time-weighted statistics about the level of a
+// container, or the number of items in a store.
+type containerMonitor struct {
+	stats ContainerStats
+
+	start, last time.Time
+	level       float64
+	queued      int
+	levelArea   float64
+	queueArea   float64
+	// samples is true if the samples of the statistics are kept
+	samples bool
+}
+
+func (mon *containerMonitor) begin(name string, capacity, level float64, now time.Time) {
+	*mon = containerMonitor{
+		stats: ContainerStats{
+			Name:     name,
+			Capacity: capacity,
+			MinLevel: level,
+			MaxLevel: level,
+		},
+		start:   now,
+		last:    now,
+		level:   level,
+		samples: mon.samples,
+	}
+	if mon.samples {
+		mon.stats.Level = []Sample{{Time: now, Value: level}}
+	}
+}
+
+// advance accumulates the areas under the curves up to now.
+func (mon *containerMonitor) advance(now time.Time) {
+	elapsed := now.Sub(mon.last).Seconds()
+	if elapsed > 0 {
+		mon.levelArea += mon.level * elapsed
+		mon.queueArea += float64(mon.queued) * elapsed
+		mon.last = now
+	}
+}
+
+func (mon *containerMonitor) setQueued(now time.Time, queued int) {
+	mon.advance(now)
+	mon.queued = queued
+	if queued > mon.stats.MaxQueueLength {
+		mon.stats.MaxQueueLength = queued
+	}
+}
+
+func (mon *containerMonitor) timedout() {
+	mon.stats.Timeouts++
+}
+
+func (mon *containerMonitor) served(now time.Time, put bool, requestedAt time.Time, level float64) {
+	mon.advance(now)
+	mon.level = level
+	if level < mon.stats.MinLevel {
+		mon.stats.MinLevel = level
+	}
+	if level > mon.stats.MaxLevel {
+		mon.stats.MaxLevel = level
+	}
+	wait := now.Sub(requestedAt)
+	if put {
+		mon.stats.Puts++
+		mon.stats.PutWait.add(wait)
+	} else {
+		mon.stats.Gets++
+		mon.stats.GetWait.add(wait)
+	}
+	if !mon.samples {
+		return
+	}
+	mon.stats.Level = append(mon.stats.Level, Sample{Time: now, Value: level})
+	if put {
+		mon.stats.PutWaits = append(mon.stats.PutWaits, wait)
+	} else {
+		mon.stats.GetWaits = append(mon.stats.GetWaits, wait)
+	}
+}
+
+// end stops the observation and computes the averages.
+func (mon *containerMonitor) end(now time.Time) {
+	mon.advance(now)
+	elapsed := mon.last.Sub(mon.start).Seconds()
+	if elapsed <= 0 {
+		mon.stats.AvgLevel = mon.level
+		return
+	}
+	mon.stats.AvgLevel = mon.levelArea / elapsed
+	mon.stats.AvgQueueLength = mon.queueArea / elapsed
+}
+
+// savedContainerMonitor is a containerMonitor in a checkpoint.
+type savedContainerMonitor struct {
+	Stats                ContainerStats
+	Start, Last          time.Time
+	Level                float64
+	Queued               int
+	LevelArea, QueueArea float64
+}
+
+func (mon *containerMonitor) save() savedContainerMonitor {
+	return savedContainerMonitor{
+		Stats:     mon.stats,
+		Start:     mon.start,
+		Last:      mon.last,
+		Level:     mon.level,
+		Queued:    mon.queued,
+		LevelArea: mon.levelArea,
+		QueueArea: mon.queueArea,
+	}
+}
+
+func (mon *containerMonitor) restore(saved savedContainerMonitor) {
+	*mon = containerMonitor{
+		stats:     saved.Stats,
+		start:     saved.Start,
+		last:      saved.Last,
+		level:     saved.Level,
+		queued:    saved.Queued,
+		levelArea: saved.LevelArea,
+		queueArea: saved.QueueArea,
+		samples:   mon.samples,
+	}
+}
+
+// savedContainer is a container in a checkpoint.
+type savedContainer struct {
+	Name       string
+	Level      float64
+	Puts, Gets []savedContainerRequest
+	Waiting    int
+	Monitor    savedContainerMonitor
+}
+
+// savedContainerRequest is a containerRequest waiting in line in a
+// checkpoint.
+type savedContainerRequest struct {
+	Actor       string
+	Amount      float64
+	RequestedAt time.Time
+	Waiting     bool
+	Cancelled   bool
+}
+
+func saveContainerRequests(reqs []*containerRequest) []savedContainerRequest {
+	saved := make([]savedContainerRequest, 0, len(reqs))
+	for _, req := range reqs {
+		saved = append(saved, savedContainerRequest{
+			Actor:       req.actor,
+			Amount:      req.amount,
+			RequestedAt: req.requestedAt,
+			Waiting:     req.waiting,
+			Cancelled:   req.cancelled,
+		})
+	}
+	return saved
+}
+
+func restoreContainerRequests(put bool, saved []savedContainerRequest) []*containerRequest {
+	reqs := make([]*containerRequest, 0, len(saved))
+	for _, req := range saved {
+		reqs = append(reqs, &containerRequest{
+			put:         put,
+			actor:       req.Actor,
+			amount:      req.Amount,
+			requestedAt: req.RequestedAt,
+			waiting:     req.Waiting,
+			cancelled:   req.Cancelled,
+		})
+	}
+	return reqs
+}
+
+func (c *container) save() *savedContainer {
+	return &savedContainer{
+		Name:    c.name,
+		Level:   c.level,
+		Puts:    saveContainerRequests(c.puts),
+		Gets:    saveContainerRequests(c.gets),
+		Waiting: c.waiting,
+		Monitor: c.mon.save(),
+	}
+}
+
+func (c *container) restore(saved *savedContainer) {
+	c.level, c.waiting = saved.Level, saved.Waiting
+	c.puts = restoreContainerRequests(true, saved.Puts)
+	c.gets = restoreContainerRequests(false, saved.Gets)
+	c.mon.restore(saved.Monitor)
+}
+
+// waitingFor is the request of the actor that waits in line, or nil.
+func (c *container) waitingFor(actor string, put bool) *containerRequest {
+	reqs := c.gets
+	if put {
+		reqs = c.puts
+	}
+	for _, req := range reqs {
+		if req.actor == actor && !req.cancelled {
+			return req
+		}
+	}
+	return nil
+}
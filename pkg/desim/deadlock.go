@@ -0,0 +1,265 @@
+package desim
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A DeadlockPolicy says what a simulation does about deadlocks.
+type DeadlockPolicy int
+
+const (
+	// IgnoreDeadlocks doesn't look for deadlocks. Deadlocked actors wait
+	// until their requests time out.
+	IgnoreDeadlocks DeadlockPolicy = iota
+	// ReportDeadlocks records each deadlock in Result.Deadlocks and lets
+	// the simulation go on.
+	ReportDeadlocks
+	// AbortOnDeadlock stops the simulation with a *DeadlockError at the
+	// first deadlock.
+	AbortOnDeadlock
+)
+
+// A Deadlock is a set of actors that can't get what they are waiting for,
+// because it is held by actors of the set or by actors that were done
+// without releasing it, or because they join actors of the set. Only a
+// timeout or an interruption can wake them up.
+type Deadlock struct {
+	Time time.Time
+	// Actors are the deadlocked actors, by name.
+	Actors []string
+	// Cycles are cycles of actors waiting on one another, among the
+	// deadlocked actors.
+	Cycles [][]WaitFor
+	// Leaked are the deadlocked actors waiting for a resource that an
+	// actor that is done still holds.
+	Leaked []WaitFor
+}
+
+func (d *Deadlock) String() string {
+	cycles := make([]string, 0, len(d.Cycles))
+	for _, cycle := range d.Cycles {
+		edges := make([]string, 0, len(cycle))
+		for _, wf := range cycle {
+			edges = append(edges, wf.String())
+		}
+		cycles = append(cycles, strings.Join(edges, ", "))
+	}
+	for _, wf := range d.Leaked {
+		cycles = append(cycles, wf.String()+", which is done")
+	}
+	return fmt.Sprintf("%s deadlocked at %v: %s", strings.Join(d.Actors, ", "), d.Time, strings.Join(cycles, "; "))
+}
+
+// WaitFor is an edge of the wait-for graph: an actor waiting for a
+// resource held by another actor, or joining another actor.
+type WaitFor struct {
+	Actor string
+	// Resource is the resource the actor waits for, or empty if the actor
+	// joins the holder.
+	Resource string
+	Holder   string
+}
+
+func (wf WaitFor) String() string {
+	if wf.Resource == "" {
+		return fmt.Sprintf("%s joins %s", wf.Actor, wf.Holder)
+	}
+	return fmt.Sprintf("%s waits for %s held by %s", wf.Actor, wf.Resource, wf.Holder)
+}
+
+// deadlockDetector is implemented by the schedulers that can look for
+// deadlocks.
+type deadlockDetector interface {
+	detectDeadlocks(policy DeadlockPolicy)
+	deadlocks() []*Deadlock
+}
+
+var _ deadlockDetector = (*localScheduler)(nil)
+
+func (schd *localScheduler) detectDeadlocks(policy DeadlockPolicy) { schd.deadlockPolicy = policy }
+func (schd *localScheduler) deadlocks() []*Deadlock                { return schd.foundDeadlocks }
+
+// checkDeadlocks looks for a deadlock while every actor is waiting on the
+// scheduler, once waitsChanged says there may be a new one. A deadlock is
+// reported once, until the set of deadlocked actors changes.
+func (schd *localScheduler) checkDeadlocks() {
+	d := schd.findDeadlock()
+	if d == nil {
+		schd.lastDeadlock, schd.deadlocked = "", nil
+		return
+	}
+	key := strings.Join(d.Actors, "\x00")
+	schd.deadlocked = make(map[string]bool, len(d.Actors))
+	for _, actor := range d.Actors {
+		schd.deadlocked[actor] = true
+	}
+	if key == schd.lastDeadlock {
+		return
+	}
+	schd.lastDeadlock = key
+	schd.foundDeadlocks = append(schd.foundDeadlocks, d)
+	if schd.deadlockPolicy == AbortOnDeadlock {
+		schd.fail(&DeadlockError{Deadlock: d})
+	}
+}
+
+// blockedActor is what an actor waits for: slots of resources, or
+// another actor to be done.
+type blockedActor struct {
+	claims []claim
+	joins  string
+}
+
+// findDeadlock reduces the wait-for graph: the actors that aren't blocked
+// will give back what they hold, and so will the blocked actors whose
+// requests can then be satisfied. The actors left are deadlocked.
+func (schd *localScheduler) findDeadlock() *Deadlock {
+	blocked := make(map[string]*blockedActor)
+	for actor, waiting := range schd.actorsWaitingForService {
+		reqType := waiting.envelope.req.Type
+		switch {
+		case reqType.AcquireResource != nil && waiting.reservation != nil:
+			resource := schd.resources[reqType.AcquireResource.ResourceID].(slotResource)
+			blocked[actor] = &blockedActor{claims: []claim{{resource: resource, units: waiting.reservation.units}}}
+		case reqType.AcquireResources != nil:
+			blocked[actor] = &blockedActor{claims: waiting.claims}
+		case reqType.Join != nil && !schd.actorsDone[reqType.Join.Actor]:
+			blocked[actor] = &blockedActor{joins: reqType.Join.Actor}
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	free := make(map[string]int)
+	held := make(map[string][]claim)
+	holders := make(map[string][]string)
+	for _, rsc := range schd.resources {
+		resource, ok := rsc.(slotResource)
+		if !ok {
+			continue
+		}
+		free[resource.id()] += resource.slots()
+		for _, res := range resource.holding() {
+			if h, ok := schd.held[heldKey{resource: resource.id(), key: res.key()}]; ok && h.releasing {
+				// it's released later on, whatever its actor does
+				continue
+			}
+			free[resource.id()] -= res.units
+			holders[resource.id()] = append(holders[resource.id()], res.actor)
+			if schd.actorsDone[res.actor] {
+				// leaked, it's never given back
+				continue
+			}
+			held[res.actor] = append(held[res.actor], claim{resource: resource, units: res.units})
+		}
+	}
+	giveBack := func(actor string) {
+		for _, c := range held[actor] {
+			free[c.resource.id()] += c.units
+		}
+	}
+	for actor := range held {
+		if _, ok := blocked[actor]; !ok {
+			giveBack(actor)
+		}
+	}
+	canProceed := func(b *blockedActor) bool {
+		if b.joins != "" {
+			_, joinsBlocked := blocked[b.joins]
+			return !joinsBlocked
+		}
+		for _, c := range b.claims {
+			if free[c.resource.id()] < c.units {
+				return false
+			}
+		}
+		return true
+	}
+	for progress := true; progress; {
+		progress = false
+		for actor, b := range blocked {
+			if canProceed(b) {
+				delete(blocked, actor)
+				giveBack(actor)
+				progress = true
+			}
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	d := &Deadlock{Time: schd.currentTime}
+	for actor := range blocked {
+		d.Actors = append(d.Actors, actor)
+	}
+	sort.Strings(d.Actors)
+	// the first thing a deadlocked actor waits for, that a deadlocked
+	// actor holds
+	waitsFor := func(actor string) (WaitFor, bool) {
+		b := blocked[actor]
+		if b.joins != "" {
+			return WaitFor{Actor: actor, Holder: b.joins}, true
+		}
+		for _, c := range b.claims {
+			for _, holder := range holders[c.resource.id()] {
+				if _, ok := blocked[holder]; ok {
+					return WaitFor{Actor: actor, Resource: c.resource.id(), Holder: holder}, true
+				}
+			}
+		}
+		return WaitFor{}, false
+	}
+	for _, actor := range d.Actors {
+		for _, c := range blocked[actor].claims {
+			for _, holder := range holders[c.resource.id()] {
+				if schd.actorsDone[holder] {
+					d.Leaked = append(d.Leaked, WaitFor{Actor: actor, Resource: c.resource.id(), Holder: holder})
+					break
+				}
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		onPath
+		visited
+	)
+	state := make(map[string]int, len(d.Actors))
+	for _, start := range d.Actors {
+		if state[start] != unvisited {
+			continue
+		}
+		var path []WaitFor
+		for actor := start; ; {
+			state[actor] = onPath
+			wf, ok := waitsFor(actor)
+			if !ok {
+				break
+			}
+			path = append(path, wf)
+			if state[wf.Holder] == onPath {
+				for i, edge := range path {
+					if edge.Actor == wf.Holder {
+						d.Cycles = append(d.Cycles, path[i:])
+						break
+					}
+				}
+				break
+			}
+			if state[wf.Holder] == visited {
+				break
+			}
+			actor = wf.Holder
+		}
+		state[start] = visited
+		for _, wf := range path {
+			state[wf.Actor] = visited
+		}
+	}
+	return d
+}
@@ -0,0 +1,272 @@
+package desim
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aybabtme/desim/pkg/gen"
+)
+
+// forever is how long the clock sleeps when the actor waits on nothing the
+// clock can wake it up with
+const forever = 1 << 62
+
+// Clock is the clock of the actor, made the first time it is needed.
+func (env *env) Clock() Clock {
+	if env.clock == nil {
+		env.clock = &envClock{env: env}
+	}
+	return env.clock
+}
+
+// envClock keeps the timers of an actor. Each pending timer is an event of
+// the scheduler, the actor waits on it with a request the event answers.
+type envClock struct {
+	env *env
+	// ids numbers the timers, for the scheduler
+	ids int
+	// timers are pending, by when they fire, then by when they were set
+	timers []*envTimer
+}
+
+func (c *envClock) Now() time.Time { return c.env.Now() }
+
+func (c *envClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.await(c.NewTimer(d).(*envTimer))
+}
+
+func (c *envClock) After(d time.Duration) <-chan time.Time { return c.NewTimer(d).C() }
+
+func (c *envClock) NewTimer(d time.Duration) Timer {
+	t := c.newTimer(make(chan time.Time, 1), nil)
+	t.Reset(d)
+	return t
+}
+
+func (c *envClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := c.newTimer(nil, f)
+	t.Reset(d)
+	return t
+}
+
+func (c *envClock) NewTicker(d time.Duration) Ticker {
+	t := &envTicker{c.newTimer(make(chan time.Time, 1), nil)}
+	t.Reset(d)
+	return t
+}
+
+func (c *envClock) newTimer(ch chan time.Time, f func()) *envTimer {
+	c.ids++
+	return &envTimer{clock: c, id: c.ids, c: ch, f: f}
+}
+
+// Wait fires the timers that are due, and waits until the next of the
+// timers, or of a function, while none of the timers has a time. Of the
+// timers that have one, the first is received from.
+func (c *envClock) Wait(timers ...Channel) (int, time.Time) {
+	waited := make([]*envTimer, len(timers))
+	for i, t := range timers {
+		waited[i] = c.timerOf(t)
+	}
+	for {
+		c.fireDue()
+		for i, t := range waited {
+			select {
+			case at := <-t.c:
+				return i, at
+			default:
+			}
+		}
+		if next := c.next(waited); next != nil {
+			c.waitOn(next)
+			continue
+		}
+		// an interrupted actor keeps waiting on its timers
+		_ = c.env.Sleep(gen.StaticDuration(forever))
+	}
+}
+
+// timerOf is the timer of a Timer or a Ticker of the clock, whose channel
+// Wait receives from without waiting in C.
+func (c *envClock) timerOf(ch Channel) *envTimer {
+	var t *envTimer
+	switch ch := ch.(type) {
+	case *envTimer:
+		t = ch
+	case *envTicker:
+		t = ch.envTimer
+	}
+	if t == nil || t.clock != c {
+		panic("desim: waiting on a timer of another clock")
+	}
+	return t
+}
+
+// await fires the timers that are due until the timer has a time for its
+// channel, or calls its function. It returns at once if it's stopped.
+func (c *envClock) await(t *envTimer) {
+	for {
+		c.fireDue()
+		if len(t.c) > 0 || !c.pending(t) {
+			return
+		}
+		c.waitOn(c.timers[0])
+	}
+}
+
+// waitOn a pending timer, until it fires.
+func (c *envClock) waitOn(t *envTimer) {
+	_ = c.env.send(0, &RequestType{
+		WaitTimer: &RequestWaitTimer{Timer: t.id},
+	}, 0, false, 0)
+}
+
+// next is the first pending timer that is one of the waited ones, or
+// calls a function.
+func (c *envClock) next(waited []*envTimer) *envTimer {
+	for _, t := range c.timers {
+		if t.f != nil {
+			return t
+		}
+		for _, w := range waited {
+			if w == t {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// fireDue fires the timers that are due, in order. The scheduler fired
+// them already.
+func (c *envClock) fireDue() {
+	now := c.env.Now()
+	for len(c.timers) > 0 && !c.timers[0].when.After(now) {
+		c.fire(c.timers[0], now)
+	}
+}
+
+// fire a timer that is due. A ticker is scheduled again, for its first
+// tick after now.
+func (c *envClock) fire(t *envTimer, now time.Time) {
+	c.remove(t)
+	at := t.when
+	if t.period > 0 {
+		missed := now.Sub(at) / t.period
+		c.start(t, at.Add((missed+1)*t.period))
+	}
+	switch {
+	case t.f != nil:
+		t.f()
+	default:
+		select {
+		case t.c <- at:
+		default:
+			// like a ticker, drop the tick nobody received yet
+		}
+	}
+}
+
+// start schedules a timer, or moves it if it's pending.
+func (c *envClock) start(t *envTimer, when time.Time) {
+	c.remove(t)
+	t.when = when
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].when.After(when)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	_ = c.env.send(0, &RequestType{
+		SetTimer: &RequestSetTimer{Timer: t.id, At: when},
+	}, 0, false, 0)
+}
+
+// stop unschedules a timer, returning true if it was scheduled.
+func (c *envClock) stop(t *envTimer) bool {
+	if !c.remove(t) {
+		return false
+	}
+	_ = c.env.send(0, &RequestType{
+		StopTimer: &RequestStopTimer{Timer: t.id},
+	}, 0, false, 0)
+	return true
+}
+
+// remove a timer from the pending ones, returning true if it was.
+func (c *envClock) remove(t *envTimer) bool {
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *envClock) pending(t *envTimer) bool {
+	for _, pending := range c.timers {
+		if pending == t {
+			return true
+		}
+	}
+	return false
+}
+
+// envTimer is a timer, ticker or function of an envClock.
+type envTimer struct {
+	clock  *envClock
+	id     int
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+	f      func()
+}
+
+// C waits until the timer has a time to receive, so that receiving from
+// it doesn't block the simulation.
+func (t *envTimer) C() <-chan time.Time {
+	if t.c == nil {
+		return nil
+	}
+	t.clock.await(t)
+	return t.c
+}
+
+func (t *envTimer) Stop() bool {
+	t.drain()
+	return t.clock.stop(t)
+}
+
+func (t *envTimer) Reset(d time.Duration) bool {
+	t.drain()
+	pending := t.clock.pending(t)
+	t.clock.start(t, t.clock.env.Now().Add(d))
+	return pending
+}
+
+// drain the time the timer sent that wasn't received, like the timers of
+// the time package do when they are stopped or reset.
+func (t *envTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+// envTicker is an envTimer that fires every period.
+type envTicker struct{ *envTimer }
+
+func (t *envTicker) Stop() { t.envTimer.Stop() }
+
+func (t *envTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("desim: non-positive interval for a ticker")
+	}
+	t.drain()
+	t.period = d
+	t.clock.start(t.envTimer, t.clock.env.Now().Add(d))
+}
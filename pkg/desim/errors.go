@@ -0,0 +1,68 @@
+package desim
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrUnknownResource is returned when an actor uses a resource that
+	// wasn't given to the simulation.
+	ErrUnknownResource = errors.New("unknown resource")
+	// ErrDoubleRelease is returned when a reservation is released more
+	// than once.
+	ErrDoubleRelease = errors.New("reservation released more than once")
+	// ErrForeignRelease is returned when an actor releases a reservation
+	// held by another actor.
+	ErrForeignRelease = errors.New("reservation released by an actor that doesn't hold it")
+	// ErrReleaseAfterEnd is returned when a release function is called
+	// after its actor is done or the simulation ended.
+	ErrReleaseAfterEnd = errors.New("reservation released after the end of its actor")
+	// ErrWrongResourceKind is returned when an actor uses a resource in a
+	// way its kind doesn't support, like acquiring a container.
+	ErrWrongResourceKind = errors.New("wrong kind of resource")
+	// ErrInvalidAmount is returned when an actor puts or gets an amount
+	// that a container can never satisfy.
+	ErrInvalidAmount = errors.New("invalid amount")
+	// ErrCrossPartition is returned when actors of different logical
+	// processes interact in a way that a parallel scheduler can't keep in
+	// order, like sharing a resource or sending a message faster than the
+	// lookahead between their processes.
+	ErrCrossPartition = errors.New("interaction across logical processes")
+	// ErrNotDeterministic is returned when actors that run again, after a
+	// rollback or to go on from a checkpoint, don't do what they did the
+	// first time, like those whose state isn't restored.
+	ErrNotDeterministic = errors.New("actor did something else when it ran again")
+	// ErrDuplicateActor is returned when an actor spawns another with the
+	// name of an actor of the simulation.
+	ErrDuplicateActor = errors.New("duplicate actor name")
+)
+
+// ActorPanicError is returned when an actor panics during a simulation.
+type ActorPanicError struct {
+	Actor string
+	Time  time.Time
+	Value interface{}
+	Stack []byte
+}
+
+func (err *ActorPanicError) Error() string {
+	return fmt.Sprintf("actor %q panicked at %v: %v", err.Actor, err.Time, err.Value)
+}
+
+// Unwrap returns the value the actor panicked with, if it's an error.
+func (err *ActorPanicError) Unwrap() error {
+	e, _ := err.Value.(error)
+	return e
+}
+
+// DeadlockError is returned when a simulation that aborts on deadlocks
+// finds one.
+type DeadlockError struct {
+	Deadlock *Deadlock
+}
+
+func (err *DeadlockError) Error() string {
+	return err.Deadlock.String()
+}
@@ -12,7 +12,8 @@ func (h eventHeap) compare(a, b *Event) int { return a.compare(b) }
 
 // eventHeap is a container of *Event, where the elements can be efficiently
 // retrieved in their decreasing order (according to their comparison
-// rules).
+// rules). Each event knows its slot in the heap, so that it can be removed
+// or moved efficiently.
 type eventHeap struct {
 	n  int
 	pq []*Event
@@ -25,6 +26,9 @@ func newEventHeap(keys ...*Event) *eventHeap {
 		n:  len(keys),
 		pq: append(make([]*Event, 1), keys...),
 	}
+	for i, k := range keys {
+		k.index = i + 1
+	}
 	h.Fix()
 	return h
 }
@@ -33,8 +37,18 @@ func newEventHeap(keys ...*Event) *eventHeap {
 func (h *eventHeap) Len() int { return h.n }
 
 // Peek at the largest element (according to their comparison rules), without
-// removing it from the heap.
-func (h *eventHeap) Peek() *Event { return h.pq[1] }
+// removing it from the heap. It returns nil if the heap is empty.
+func (h *eventHeap) Peek() *Event {
+	if h.n == 0 {
+		return nil
+	}
+	return h.pq[1]
+}
+
+// Contains is true if k is in the heap.
+func (h *eventHeap) Contains(k *Event) bool {
+	return k.index > 0 && k.index <= h.n && h.pq[k.index] == k
+}
 
 // Fix re-establishes the heap ordering. This is useful if elements
 // of the heap have had their comparison value changed. It is equivalent to,
@@ -52,6 +66,7 @@ func (h *eventHeap) Fix() {
 func (h *eventHeap) Push(k *Event) {
 	h.n++
 	h.pq = append(h.pq, k)
+	k.index = h.n
 	h.swim(h.n)
 }
 
@@ -60,44 +75,40 @@ func (h *eventHeap) Push(k *Event) {
 func (h *eventHeap) Pop() *Event {
 	val := h.pq[1]
 	h.swap(1, h.n)
+	h.pq[h.n] = nil
 	h.pq = h.pq[:h.n]
 	h.n--
 	h.sink(1, h.n)
 
+	val.index = 0
 	return val
 }
 
-// Remove removes k from the heap, if it exists. Equality is defined by
-// Compare == 0.
-// The complexity is O(n+log(n)) where n == h.Len().
+// Remove removes k from the heap, if it's in it.
+// The complexity is O(log(n)) where n == h.Len().
 func (h *eventHeap) Remove(k *Event) bool {
-
-	cmp := h.compare(h.pq[1], k)
-	if cmp == 0 {
-		_ = h.Pop()
-		return true
-	}
-	if cmp < 0 {
-		// larger than largest, don't try to find it
+	if !h.Contains(k) {
 		return false
 	}
-
-	i := 0
-	for _, j := range h.pq[1:] {
-		i++
-		if h.compare(j, k) != 0 {
-			continue
-		}
-		h.swap(i, 1)
+	i := k.index
+	h.swap(i, h.n)
+	h.pq[h.n] = nil
+	h.pq = h.pq[:h.n]
+	h.n--
+	if i <= h.n {
+		// the element that took its slot may belong above or below it
 		h.sink(i, h.n)
-		_ = h.Pop()
-		return true
+		h.swim(i)
 	}
-	// not in the heap
-	return false
+	k.index = 0
+	return true
 }
 
-func (h *eventHeap) swap(i, j int)      { h.pq[i], h.pq[j] = h.pq[j], h.pq[i] }
+func (h *eventHeap) swap(i, j int) {
+	h.pq[i], h.pq[j] = h.pq[j], h.pq[i]
+	h.pq[i].index = i
+	h.pq[j].index = j
+}
 func (h *eventHeap) less(i, j int) bool { return h.compare(h.pq[i], h.pq[j]) < 0 }
 
 func (h *eventHeap) swim(k int) {
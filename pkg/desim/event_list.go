@@ -0,0 +1,117 @@
+package desim
+
+import (
+	"sort"
+	"time"
+)
+
+// An EventList is the future event list of a scheduler: the events that
+// are yet to happen. It gives them back earliest first, in the order of
+// Event.Before, so that every event list produces the same histories.
+type EventList interface {
+	// Len is the number of events in the list.
+	Len() int
+	// Push adds an event to the list.
+	Push(ev *Event)
+	// Peek at the earliest event, without removing it from the list. It
+	// returns nil if the list is empty.
+	Peek() *Event
+	// Pop removes the earliest event from the list and returns it.
+	Pop() *Event
+	// Remove removes an event from the list, if it's in it.
+	Remove(ev *Event) bool
+	// Contains is true if the event is in the list.
+	Contains(ev *Event) bool
+}
+
+var (
+	_ EventList = (*eventHeap)(nil)
+	_ EventList = (*calendarQueue)(nil)
+	_ EventList = (*ladderQueue)(nil)
+)
+
+// Before is true if the event happens before the other one: it's earlier,
+// or it has a higher priority, or it breaks the tie first.
+func (e *Event) Before(other *Event) bool { return e.compare(other) > 0 }
+
+// NewEventHeap makes a binary heap of events, the event list used by
+// default. Every operation is O(log n).
+func NewEventHeap() EventList { return newEventHeap() }
+
+// WithEventList makes the scheduler keep its future events in the event
+// lists made by mkList, instead of a binary heap.
+func WithEventList(mkList func() EventList) Option {
+	return func(sim *sim) { sim.mkList = mkList }
+}
+
+// eventLister is implemented by the schedulers that can keep their events
+// in any EventList.
+type eventLister interface {
+	useEventList(list EventList)
+}
+
+var _ eventLister = (*localScheduler)(nil)
+
+func (schd *localScheduler) useEventList(list EventList) { schd.events = list }
+
+// queued is an event in the buckets of a list that removes events lazily:
+// it stays in its bucket until it's reached, but it's stale once the event
+// was removed or queued again.
+type queued struct {
+	ev  *Event
+	seq int
+}
+
+func (q queued) live() bool { return q.ev.index == q.seq }
+
+// lazyList keeps the sequence numbers and the count of the events of a
+// list that removes events lazily. An event in such a list has its index
+// set to the sequence number of its live entry.
+type lazyList struct {
+	n      int
+	seq    int
+	origin time.Time
+	anchor bool
+}
+
+func (l *lazyList) Len() int { return l.n }
+
+func (l *lazyList) Contains(ev *Event) bool { return ev.index != 0 }
+
+// enqueue marks an event as being in the list, returning its entry.
+func (l *lazyList) enqueue(ev *Event) queued {
+	if !l.anchor {
+		l.origin, l.anchor = ev.Time, true
+	}
+	l.n++
+	l.seq++
+	ev.index = l.seq
+	return queued{ev: ev, seq: l.seq}
+}
+
+// dequeue marks an event as no longer being in the list.
+func (l *lazyList) dequeue(ev *Event) {
+	l.n--
+	ev.index = 0
+}
+
+func (l *lazyList) Remove(ev *Event) bool {
+	if !l.Contains(ev) {
+		return false
+	}
+	l.dequeue(ev)
+	return true
+}
+
+// key is the time of an event, as nanoseconds since the first event that
+// was queued.
+func (l *lazyList) key(ev *Event) int64 { return int64(ev.Time.Sub(l.origin)) }
+
+// insertSorted adds an entry to a slice sorted earliest first.
+func insertSorted(entries []queued, q queued) []queued {
+	i := sort.Search(len(entries), func(i int) bool { return q.ev.Before(entries[i].ev) })
+	entries = append(entries, queued{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = q
+	return entries
+}
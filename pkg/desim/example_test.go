@@ -1,10 +1,14 @@
 package desim_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"os"
 	"time"
 
 	"github.com/aybabtme/desim/pkg/desim"
@@ -57,7 +61,7 @@ func ExampleNew() {
 	// 1970-01-01 00:00:05.4 +0000 UTC: slow
 }
 
-func ExampleNewByTime() {
+func ExampleNew_byTime() {
 	var (
 		r     = rand.New(rand.NewSource(42))
 		begin = time.Unix(0, 0).UTC()
@@ -94,7 +98,54 @@ func ExampleNewByTime() {
 	//
 }
 
-func ExampleResourceSharing() {
+func ExampleWithPacing() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(2 * time.Second)
+	)
+
+	// a simulated second takes 10ms
+	pacer := desim.NewPacer(100)
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+		desim.WithPacing(pacer),
+	)
+
+	// hold the simulation back for a while, then let it go
+	pacer.Pause()
+	time.AfterFunc(50*time.Millisecond, pacer.Resume)
+
+	began := time.Now()
+	evs := sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("slow", clock(6, 900*time.Millisecond)),
+			desim.MakeActor("fast", clock(6, 400*time.Millisecond)),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	took := time.Since(began)
+	for _, ev := range evs {
+		fmt.Printf("%v: %v\n", ev.Time, ev.Labels["name"])
+	}
+	fmt.Printf("took at least 50ms + 20ms: %v\n", took >= 70*time.Millisecond)
+
+	// Output:
+	// 1970-01-01 00:00:00.4 +0000 UTC: fast
+	// 1970-01-01 00:00:00.8 +0000 UTC: fast
+	// 1970-01-01 00:00:00.9 +0000 UTC: slow
+	// 1970-01-01 00:00:01.2 +0000 UTC: fast
+	// 1970-01-01 00:00:01.6 +0000 UTC: fast
+	// 1970-01-01 00:00:01.8 +0000 UTC: slow
+	// 1970-01-01 00:00:02 +0000 UTC: fast
+	// took at least 50ms + 20ms: true
+}
+
+func ExampleMakeFIFOResource() {
 	var (
 		r     = rand.New(rand.NewSource(42))
 		start = time.Unix(0, 0).UTC()
@@ -155,7 +206,7 @@ func ExampleResourceSharing() {
 	// 1970-01-01 00:00:00.5 +0000 UTC: acquired resource after waiting
 }
 
-func ExampleResourceTimeout() {
+func ExampleMakeFIFOResource_timeout() {
 	var (
 		r     = rand.New(rand.NewSource(42))
 		start = time.Unix(0, 0).UTC()
@@ -206,7 +257,413 @@ func ExampleResourceTimeout() {
 	// 1970-01-01 00:00:00.1 +0000 UTC: actor is done
 }
 
-func ExampleAsyncResourceUsage() {
+func ExampleMakePriorityResource() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	doctor := desim.MakePriorityResource("doctor", 1)
+
+	patient := func(arrival time.Duration, severity int32) desim.Action {
+		return func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(arrival))
+			release, obtained := env.Acquire(doctor, gen.StaticDuration(time.Hour), desim.WithPriority(severity))
+			if !obtained {
+				return false
+			}
+			env.Sleep(gen.StaticDuration(10 * time.Minute))
+			release()
+			return false
+		}
+	}
+
+	evs := sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("walk-in", patient(0, 0)),
+			desim.MakeActor("sprain", patient(time.Minute, 1)),
+			desim.MakeActor("cold", patient(2*time.Minute, 0)),
+			desim.MakeActor("cardiac", patient(3*time.Minute, 10)),
+			desim.MakeActor("cut", patient(4*time.Minute, 1)),
+		},
+		[]desim.Resource{doctor},
+		desim.LogJSON(ioutil.Discard),
+	)
+	for _, ev := range evs {
+		if ev.ReservationKey != "" {
+			fmt.Printf("%v: %s (priority %d) %s\n", ev.Time.Sub(start), ev.Actor, ev.Priority, ev.Kind)
+		}
+	}
+
+	// Output:
+	// 0s: walk-in (priority 0) acquired resource immediately
+	// 10m0s: cardiac (priority 10) acquired resource after waiting
+	// 20m0s: sprain (priority 1) acquired resource after waiting
+	// 30m0s: cut (priority 1) acquired resource after waiting
+	// 40m0s: cold (priority 0) acquired resource after waiting
+}
+
+func ExampleMakePreemptiveResource() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	machine := desim.MakePreemptiveResource("machine", 1)
+
+	remaining := 30 * time.Minute
+	job := func(env desim.Env) bool {
+		release, obtained := env.Acquire(machine, gen.StaticDuration(time.Hour))
+		if !obtained {
+			return false
+		}
+		fmt.Printf("%v: job works for %v\n", env.Now().Sub(start), remaining)
+		interrupted := env.Sleep(gen.StaticDuration(remaining))
+		intr := env.Interruption()
+		release()
+		if interrupted && intr.Cause == desim.CausePreempted {
+			remaining = intr.Remaining
+			fmt.Printf("%v: job preempted by %s, %v left\n", env.Now().Sub(start), intr.By, remaining)
+			return true
+		}
+		fmt.Printf("%v: job is done\n", env.Now().Sub(start))
+		return false
+	}
+	breakdown := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(10 * time.Minute))
+		release, obtained := env.Acquire(machine, gen.StaticDuration(time.Hour), desim.WithPriority(10))
+		if !obtained {
+			return false
+		}
+		fmt.Printf("%v: machine is being repaired\n", env.Now().Sub(start))
+		env.Sleep(gen.StaticDuration(5 * time.Minute))
+		release()
+		return false
+	}
+
+	res, err := sim.RunContext(context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("job", job),
+			desim.MakeActor("breakdown", breakdown),
+		},
+		[]desim.Resource{machine},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("preemptions: %d\n", res.Resources["machine"].Preemptions)
+
+	// Output:
+	// 0s: job works for 30m0s
+	// 10m0s: machine is being repaired
+	// 10m0s: job preempted by breakdown, 20m0s left
+	// 15m0s: job works for 20m0s
+	// 35m0s: job is done
+	// preemptions: 1
+}
+
+func ExampleMakeContainer() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+		// keep each level
+		desim.WithSamples(),
+	)
+
+	tank := desim.MakeContainer("tank", 100, 40)
+
+	cars := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(10 * time.Minute))
+		if env.Get(tank, 30, gen.StaticDuration(time.Hour)) {
+			fmt.Printf("%v: car filled up, %g left\n", env.Now().Sub(start), tank.Level())
+		}
+		return true
+	}
+	tanker := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(25 * time.Minute))
+		if env.Put(tank, 80, gen.StaticDuration(time.Hour)) {
+			fmt.Printf("%v: tanker refilled, %g left\n", env.Now().Sub(start), tank.Level())
+		}
+		return false
+	}
+
+	res, err := sim.RunContext(context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("cars", cars),
+			desim.MakeActor("tanker", tanker),
+		},
+		[]desim.Resource{tank},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	stats := res.Containers["tank"]
+	fmt.Printf("level: avg %.1f, min %g, max %g\n", stats.AvgLevel, stats.MinLevel, stats.MaxLevel)
+	for _, sample := range stats.Level {
+		fmt.Printf("%v: %g\n", sample.Time.Sub(start), sample.Value)
+	}
+
+	// Output:
+	// 10m0s: car filled up, 10 left
+	// 25m0s: tanker refilled, 60 left
+	// 25m0s: car filled up, 60 left
+	// 35m0s: car filled up, 30 left
+	// 45m0s: car filled up, 0 left
+	// level: avg 24.2, min 0, max 90
+	// 0s: 40
+	// 10m0s: 10
+	// 25m0s: 90
+	// 25m0s: 60
+	// 35m0s: 30
+	// 45m0s: 0
+}
+
+func ExampleMakeStore() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	buffer := desim.MakeStore("buffer", 2)
+
+	parts := 0
+	cutter := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(3 * time.Minute))
+		parts++
+		part := fmt.Sprintf("part%d", parts)
+		env.StorePut(buffer, part)
+		fmt.Printf("%v: cut %s\n", env.Now().Sub(start), part)
+		return parts < 5
+	}
+	welder := func(env desim.Env) bool {
+		part, ok := env.StoreGet(buffer, gen.StaticDuration(time.Hour))
+		if !ok {
+			return false
+		}
+		env.Sleep(gen.StaticDuration(10 * time.Minute))
+		fmt.Printf("%v: welded %s\n", env.Now().Sub(start), part)
+		return true
+	}
+
+	res, err := sim.RunContext(context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("cutter", cutter),
+			desim.MakeActor("welder", welder),
+		},
+		[]desim.Resource{buffer},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("max waiting in buffer: %g\n", res.Stores["buffer"].MaxLevel)
+
+	// Output:
+	// 3m0s: cut part1
+	// 6m0s: cut part2
+	// 9m0s: cut part3
+	// 13m0s: welded part1
+	// 13m0s: cut part4
+	// 23m0s: welded part2
+	// 23m0s: cut part5
+	// 33m0s: welded part3
+	// 43m0s: welded part4
+	// 53m0s: welded part5
+	// max waiting in buffer: 2
+}
+
+func ExampleMakeFilterStore() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	type part struct {
+		id    int
+		color string
+	}
+	finished := desim.MakeFilterStore("finished", 10)
+
+	painter := func(env desim.Env) bool {
+		for i, color := range []string{"red", "blue", "blue", "red"} {
+			env.Sleep(gen.StaticDuration(time.Minute))
+			env.StorePut(finished, part{id: i, color: color})
+		}
+		return false
+	}
+	picker := func(color string) desim.Action {
+		return func(env desim.Env) bool {
+			item, ok := env.StoreGetFilter(finished, func(item interface{}) bool {
+				return item.(part).color == color
+			}, gen.StaticDuration(time.Hour))
+			if !ok {
+				return false
+			}
+			fmt.Printf("%v: picked %s part %d\n", env.Now().Sub(start), color, item.(part).id)
+			return true
+		}
+	}
+
+	sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("painter", painter),
+			desim.MakeActor("blue_picker", picker("blue")),
+		},
+		[]desim.Resource{finished},
+		desim.LogJSON(ioutil.Discard),
+	)
+
+	// Output:
+	// 2m0s: picked blue part 1
+	// 3m0s: picked blue part 2
+}
+
+func ExampleEnv_AcquireN() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	berths := desim.MakeFIFOResource("berths", 3)
+
+	ship := func(name string, arrival, docked time.Duration, size int) desim.Action {
+		return func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(arrival))
+			release, obtained := env.AcquireN(berths, size, gen.StaticDuration(time.Hour))
+			if !obtained {
+				return false
+			}
+			fmt.Printf("%v: %s docked on %d berths\n", env.Now().Sub(start), name, size)
+			env.Sleep(gen.StaticDuration(docked))
+			release()
+			return false
+		}
+	}
+
+	res, err := sim.RunContext(context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("ferry", ship("ferry", 0, 20*time.Minute, 1)),
+			desim.MakeActor("tug", ship("tug", time.Minute, 10*time.Minute, 1)),
+			desim.MakeActor("tanker", ship("tanker", 2*time.Minute, 20*time.Minute, 2)),
+			desim.MakeActor("yacht", ship("yacht", 3*time.Minute, 5*time.Minute, 1)),
+		},
+		[]desim.Resource{berths},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("utilization: %.2f\n", res.Resources["berths"].Utilization)
+
+	// Output:
+	// 0s: ferry docked on 1 berths
+	// 1m0s: tug docked on 1 berths
+	// 11m0s: tanker docked on 2 berths
+	// 20m0s: yacht docked on 1 berths
+	// utilization: 0.81
+}
+
+func ExampleEnv_AcquireAll() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(30 * time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	forks := []desim.Resource{
+		desim.MakeFIFOResource("fork0", 1),
+		desim.MakeFIFOResource("fork1", 1),
+		desim.MakeFIFOResource("fork2", 1),
+	}
+	philosopher := func(i int) desim.Action {
+		left, right := forks[i], forks[(i+1)%len(forks)]
+		return func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(time.Minute))
+			release, obtained := env.AcquireAll([]desim.Resource{left, right}, gen.StaticDuration(time.Hour))
+			if !obtained {
+				return false
+			}
+			fmt.Printf("%v: philosopher%d eats\n", env.Now().Sub(start), i)
+			env.Sleep(gen.StaticDuration(10 * time.Minute))
+			release()
+			return true
+		}
+	}
+
+	sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("philosopher0", philosopher(0)),
+			desim.MakeActor("philosopher1", philosopher(1)),
+			desim.MakeActor("philosopher2", philosopher(2)),
+		},
+		forks,
+		desim.LogJSON(ioutil.Discard),
+	)
+
+	// Output:
+	// 1m0s: philosopher0 eats
+	// 11m0s: philosopher2 eats
+	// 21m0s: philosopher1 eats
+}
+
+func ExampleEnv_UseAsync() {
 	var (
 		r     = rand.New(rand.NewSource(42))
 		start = time.Unix(0, 0).UTC()
@@ -265,7 +722,7 @@ func ExampleAsyncResourceUsage() {
 	// 1970-01-01 00:00:00.1 +0000 UTC: released resource async
 }
 
-func ExampleAsyncAndSyncResourceUsage() {
+func ExampleEnv_UseAsync_withAcquire() {
 	var (
 		r     = rand.New(rand.NewSource(42))
 		start = time.Unix(0, 0).UTC()
@@ -333,7 +790,7 @@ func ExampleAsyncAndSyncResourceUsage() {
 	// 1970-01-01 00:00:00.2 +0000 UTC: sync-user - actor is done
 }
 
-func ExampleAsyncReentrantUsage() {
+func ExampleEnv_UseAsync_reentrant() {
 	var (
 		r     = rand.New(rand.NewSource(42))
 		start = time.Unix(0, 0).UTC()
@@ -410,17 +867,691 @@ func ExampleAsyncReentrantUsage() {
 	// 1970-01-01 00:00:00.2 +0000 UTC: user - released resource async
 }
 
-func clock(iter int, dur time.Duration) desim.Action {
-	pdur := gen.StaticDuration(dur)
-	return func(env desim.Env) bool {
-		iter--
-		env.Log().Event("woke up, about to sleep")
+func ExampleEnv_Send() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Second)
+	)
 
-		if env.Sleep(pdur) {
-			env.Log().Event("couldn't sleep")
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	latency := gen.StaticDuration(10 * time.Millisecond)
+	timeoutAfter := gen.StaticDuration(time.Second)
+
+	type ping struct{ seq int }
+	type pong struct{ seq int }
+
+	seq := 0
+	client := func(env desim.Env) bool {
+		seq++
+		env.Send("server", ping{seq: seq}, latency)
+		msg, received := env.Receive(timeoutAfter)
+		if !received {
+			env.Log().Event("server didn't answer")
 			return false
 		}
-		return iter > 0
+		return msg.Payload.(pong).seq < 2
+	}
+
+	server := func(env desim.Env) bool {
+		msg, received := env.Receive(timeoutAfter)
+		if !received {
+			return false
+		}
+		req := msg.Payload.(ping)
+		env.Sleep(gen.StaticDuration(5 * time.Millisecond))
+		env.Send(msg.From, pong{seq: req.seq}, latency)
+		return true
+	}
+
+	evs := sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("client", client),
+			desim.MakeActor("server", server),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	for _, ev := range evs {
+		if ev.Message != nil {
+			fmt.Printf("%v: %s - %s (%s -> %s: %s)\n", ev.Time, ev.Actor, ev.Kind, ev.Message.From, ev.Message.To, ev.Message.Kind())
+		} else {
+			fmt.Printf("%v: %s - %s\n", ev.Time, ev.Actor, ev.Kind)
+		}
+	}
+
+	// Output:
+	// 1970-01-01 00:00:00.01 +0000 UTC: client - delivered message (client -> server: desim_test.ping)
+	// 1970-01-01 00:00:00.01 +0000 UTC: server - received message after waiting (client -> server: desim_test.ping)
+	// 1970-01-01 00:00:00.015 +0000 UTC: server - waited a delay
+	// 1970-01-01 00:00:00.025 +0000 UTC: server - delivered message (server -> client: desim_test.pong)
+	// 1970-01-01 00:00:00.025 +0000 UTC: client - received message after waiting (server -> client: desim_test.pong)
+	// 1970-01-01 00:00:00.035 +0000 UTC: client - delivered message (client -> server: desim_test.ping)
+	// 1970-01-01 00:00:00.035 +0000 UTC: server - received message after waiting (client -> server: desim_test.ping)
+	// 1970-01-01 00:00:00.04 +0000 UTC: server - waited a delay
+	// 1970-01-01 00:00:00.05 +0000 UTC: server - delivered message (server -> client: desim_test.pong)
+	// 1970-01-01 00:00:00.05 +0000 UTC: client - received message after waiting (server -> client: desim_test.pong)
+	// 1970-01-01 00:00:00.05 +0000 UTC: client - actor is done
+}
+
+func ExampleEnv_Interrupt() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	var cause string
+	worker := func(env desim.Env) bool {
+		if interrupted := env.Sleep(gen.StaticDuration(10 * time.Second)); interrupted {
+			cause = env.Interruption().Cause
+		}
+		return false
+	}
+
+	watchdog := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(time.Second))
+		env.Interrupt("worker", "took too long")
+		return false
+	}
+
+	evs := sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("worker", worker),
+			desim.MakeActor("watchdog", watchdog),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	fmt.Printf("worker was interrupted: %s\n", cause)
+	for _, ev := range evs {
+		fmt.Printf("%v: %s - %s\n", ev.Time, ev.Actor, ev.Kind)
+	}
+
+	// Output:
+	// worker was interrupted: took too long
+	// 1970-01-01 00:00:01 +0000 UTC: watchdog - waited a delay
+	// 1970-01-01 00:00:01 +0000 UTC: watchdog - interrupting actor
+	// 1970-01-01 00:00:01 +0000 UTC: watchdog - actor is done
+	// 1970-01-01 00:00:01 +0000 UTC: worker - interrupted
+	// 1970-01-01 00:00:01 +0000 UTC: worker - actor is done
+}
+
+// waitReady is written against a Clock, it doesn't know about desim: it
+// polls until a service is ready, backing off twice as long after each
+// try, and gives up after a while.
+func waitReady(clock desim.Clock, ready func() bool, giveUpAfter time.Duration) (time.Time, error) {
+	giveUp := clock.NewTimer(giveUpAfter)
+	defer giveUp.Stop()
+	backoff := 100 * time.Millisecond
+	for !ready() {
+		retry := clock.NewTimer(backoff)
+		if i, _ := clock.Wait(giveUp, retry); i == 0 {
+			retry.Stop()
+			return clock.Now(), errors.New("gave up")
+		}
+		backoff *= 2
+	}
+	return clock.Now(), nil
+}
+
+func ExampleEnv_Clock() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	var (
+		ready bool
+		log   []string
+	)
+	service := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(1700 * time.Millisecond))
+		ready = true
+		return false
+	}
+	client := func(env desim.Env) bool {
+		at, err := waitReady(env.Clock(), func() bool { return ready }, 5*time.Second)
+		log = append(log, fmt.Sprintf("client: ready at %v, err=%v", at.Sub(start), err))
+		_, err = waitReady(env.Clock(), func() bool { return false }, 2*time.Second)
+		log = append(log, fmt.Sprintf("client: %v at %v", err, env.Now().Sub(start)))
+		return false
+	}
+	heartbeat := func(env desim.Env) bool {
+		clock := env.Clock()
+		ticker := clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		for i := 0; i < 3; i++ {
+			at := <-ticker.C()
+			log = append(log, fmt.Sprintf("heartbeat: %v", at.Sub(start)))
+		}
+		return false
+	}
+
+	_ = sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("service", service),
+			desim.MakeActor("client", client),
+			desim.MakeActor("heartbeat", heartbeat),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	for _, line := range log {
+		fmt.Println(line)
+	}
+
+	// Output:
+	// heartbeat: 1s
+	// heartbeat: 2s
+	// heartbeat: 3s
+	// client: ready at 3.1s, err=<nil>
+	// client: gave up at 5.1s
+}
+
+func ExampleEnv_Spawn() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	counter := desim.MakeFIFOResource("counter", 1)
+	serviceTime := gen.StaticDuration(3 * time.Second)
+	timeoutAfter := gen.StaticDuration(time.Minute)
+
+	customer := func(env desim.Env) bool {
+		release, obtained := env.Acquire(counter, timeoutAfter)
+		if !obtained {
+			return false
+		}
+		env.Sleep(serviceTime)
+		release()
+		return false
+	}
+
+	arrivals := 0
+	source := func(env desim.Env) bool {
+		arrivals++
+		name := fmt.Sprintf("customer%d", arrivals)
+		env.Spawn(name, customer)
+		if arrivals < 2 {
+			env.Sleep(gen.StaticDuration(time.Second))
+			return true
+		}
+		// wait for the last customer to leave
+		env.Join(name, timeoutAfter)
+		return false
+	}
+
+	evs := sim.Run(
+		[]*desim.Actor{
+			desim.MakeActor("source", source),
+		},
+		[]desim.Resource{counter},
+		desim.LogJSON(ioutil.Discard),
+	)
+	for _, ev := range evs {
+		fmt.Printf("%v: %s - %s\n", ev.Time, ev.Actor, ev.Kind)
+	}
+
+	// Output:
+	// 1970-01-01 00:00:00 +0000 UTC: source - spawned actor
+	// 1970-01-01 00:00:00 +0000 UTC: customer1 - acquired resource immediately
+	// 1970-01-01 00:00:01 +0000 UTC: source - waited a delay
+	// 1970-01-01 00:00:01 +0000 UTC: source - spawned actor
+	// 1970-01-01 00:00:03 +0000 UTC: customer1 - waited a delay
+	// 1970-01-01 00:00:03 +0000 UTC: customer1 - released resource
+	// 1970-01-01 00:00:03 +0000 UTC: customer1 - actor is done
+	// 1970-01-01 00:00:03 +0000 UTC: customer2 - acquired resource after waiting
+	// 1970-01-01 00:00:06 +0000 UTC: customer2 - waited a delay
+	// 1970-01-01 00:00:06 +0000 UTC: customer2 - released resource
+	// 1970-01-01 00:00:06 +0000 UTC: customer2 - actor is done
+	// 1970-01-01 00:00:06 +0000 UTC: source - joined actor after waiting
+	// 1970-01-01 00:00:06 +0000 UTC: source - actor is done
+}
+
+func ExampleSimulation_RunContext() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	// this resource isn't given to the simulation
+	forgotten := desim.MakeFIFOResource("forgotten", 1)
+
+	user := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(time.Second))
+		env.Acquire(forgotten, gen.StaticDuration(time.Second))
+		return false
+	}
+
+	_, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("user", user),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	fmt.Println(errors.Is(err, desim.ErrUnknownResource))
+	fmt.Println(err)
+
+	// Output:
+	// true
+	// unknown resource: actor "user" can't acquire "forgotten"
+}
+
+func ExampleSimulation_RunContext_panic() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	buggy := func(env desim.Env) bool {
+		env.Sleep(gen.StaticDuration(time.Second))
+		var assets map[string]float64
+		assets["brokerage"] = 1e3
+		return false
+	}
+
+	_, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("clock", infiniteclock(100*time.Millisecond)),
+			desim.MakeActor("buggy", buggy),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	var panicErr *desim.ActorPanicError
+	if errors.As(err, &panicErr) {
+		fmt.Printf("%s panicked at %v: %v\n", panicErr.Actor, panicErr.Time, panicErr.Value)
+	}
+
+	// Output:
+	// buggy panicked at 1970-01-01 00:00:01 +0000 UTC: assignment to entry in nil map
+}
+
+func ExampleWithEventSink() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(10 * time.Second)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+		desim.WithEventSink(desim.SinkJSON(os.Stdout)),
+	)
+
+	res, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("clock", clock(2, time.Second)),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("kept %d events in memory\n", len(res.History))
+
+	// Output:
+	// {"id":1,"time":"1970-01-01T00:00:01Z","actor":"clock","kind":"waited a delay","labels":{"name":"clock"}}
+	// {"id":2,"time":"1970-01-01T00:00:02Z","actor":"clock","kind":"waited a delay","labels":{"name":"clock"}}
+	// {"id":3,"time":"1970-01-01T00:00:02Z","actor":"clock","kind":"actor is done","labels":{"name":"clock"}}
+	// kept 0 events in memory
+}
+
+func ExampleWithDeadlockDetection() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(24 * time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+		desim.WithDeadlockDetection(desim.AbortOnDeadlock),
+	)
+
+	forks := []desim.Resource{
+		desim.MakeFIFOResource("fork0", 1),
+		desim.MakeFIFOResource("fork1", 1),
+		desim.MakeFIFOResource("fork2", 1),
+	}
+	// every philosopher picks up the left fork, then the right one
+	philosopher := func(i int) desim.Action {
+		left, right := forks[i], forks[(i+1)%len(forks)]
+		return func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(time.Minute))
+			releaseLeft, obtained := env.Acquire(left, gen.StaticDuration(time.Hour))
+			if !obtained {
+				return false
+			}
+			defer releaseLeft()
+			env.Sleep(gen.StaticDuration(time.Minute))
+			releaseRight, obtained := env.Acquire(right, gen.StaticDuration(time.Hour))
+			if !obtained {
+				return false
+			}
+			defer releaseRight()
+			env.Sleep(gen.StaticDuration(10 * time.Minute))
+			return true
+		}
+	}
+
+	_, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("philosopher0", philosopher(0)),
+			desim.MakeActor("philosopher1", philosopher(1)),
+			desim.MakeActor("philosopher2", philosopher(2)),
+		},
+		forks,
+		desim.LogJSON(ioutil.Discard),
+	)
+	var deadlockErr *desim.DeadlockError
+	if errors.As(err, &deadlockErr) {
+		deadlock := deadlockErr.Deadlock
+		fmt.Printf("deadlock after %v between %v\n", deadlock.Time.Sub(start), deadlock.Actors)
+		for _, wf := range deadlock.Cycles[0] {
+			fmt.Println(wf)
+		}
+	}
+
+	// Output:
+	// deadlock after 2m0s between [philosopher0 philosopher1 philosopher2]
+	// philosopher0 waits for fork1 held by philosopher1
+	// philosopher1 waits for fork2 held by philosopher2
+	// philosopher2 waits for fork0 held by philosopher0
+}
+
+func ExampleLeak() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	till := desim.MakeFIFOResource("till", 1)
+	drawer := desim.MakeFIFOResource("drawer", 1)
+	cashier := func(env desim.Env) bool {
+		releaseTill, obtained := env.Acquire(till, gen.StaticDuration(time.Minute))
+		if !obtained {
+			return false
+		}
+		env.Sleep(gen.StaticDuration(time.Minute))
+		releaseDrawer, obtained := env.Acquire(drawer, gen.StaticDuration(time.Minute))
+		if !obtained {
+			// forgot to release the till
+			return false
+		}
+		env.Sleep(gen.StaticDuration(time.Minute))
+		releaseDrawer()
+		releaseTill()
+		return true
+	}
+	auditor := func(env desim.Env) bool {
+		// holds the drawer until the end
+		_, obtained := env.Acquire(drawer, gen.StaticDuration(time.Minute))
+		env.Sleep(gen.StaticDuration(2 * time.Hour))
+		return obtained
+	}
+
+	res, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("cashier", cashier),
+			desim.MakeActor("auditor", auditor),
+		},
+		[]desim.Resource{till, drawer},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	for _, leak := range res.Leaks {
+		fmt.Println(leak)
+	}
+
+	// Output:
+	// actor "cashier" was done at 1970-01-01 00:02:00 +0000 UTC still holding "till", acquired at 1970-01-01 00:00:00 +0000 UTC
+	// actor "auditor" still held "drawer" when the simulation ended at 1970-01-01 01:00:00 +0000 UTC, acquired at 1970-01-01 00:00:00 +0000 UTC
+}
+
+func ExampleSinkRing() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Hour)
+	)
+
+	last := desim.SinkRing(2)
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+		desim.WithEventSink(last),
+	)
+
+	_, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("clock", clock(1000, time.Second)),
+		},
+		nil,
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	for _, ev := range last.Events() {
+		fmt.Printf("%v: %s - %s\n", ev.Time, ev.Actor, ev.Kind)
+	}
+
+	// Output:
+	// 1970-01-01 00:16:40 +0000 UTC: clock - waited a delay
+	// 1970-01-01 00:16:40 +0000 UTC: clock - actor is done
+}
+
+func ExampleServeRemoteActors() {
+	var (
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(10 * time.Second)
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the actors of ExampleNew run in a process of their own, this one
+	// runs the scheduler
+	go func() {
+		remote := desim.New(
+			desim.RemoteScheduler("tcp", l.Addr().String()),
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(start),
+			gen.StaticTime(end),
+		)
+		_, err := remote.RunContext(context.Background(),
+			[]*desim.Actor{
+				desim.MakeActor("slow", clock(6, 900*time.Millisecond)),
+				desim.MakeActor("fast", clock(6, 400*time.Millisecond)),
+			},
+			nil,
+			desim.LogJSON(ioutil.Discard),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	sim := desim.New(
+		desim.ServeRemoteActors(l, 2, desim.NewLocalScheduler),
+		rand.New(rand.NewSource(0)),
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+	evs := sim.Run(nil, nil, desim.LogJSON(ioutil.Discard))
+	for _, ev := range evs {
+		fmt.Printf("%v: %v\n", ev.Time, ev.Labels["name"])
+	}
+
+	// Output:
+	// 1970-01-01 00:00:00.4 +0000 UTC: fast
+	// 1970-01-01 00:00:00.8 +0000 UTC: fast
+	// 1970-01-01 00:00:00.9 +0000 UTC: slow
+	// 1970-01-01 00:00:01.2 +0000 UTC: fast
+	// 1970-01-01 00:00:01.6 +0000 UTC: fast
+	// 1970-01-01 00:00:01.8 +0000 UTC: slow
+	// 1970-01-01 00:00:02 +0000 UTC: fast
+	// 1970-01-01 00:00:02.4 +0000 UTC: fast
+	// 1970-01-01 00:00:02.4 +0000 UTC: fast
+	// 1970-01-01 00:00:02.7 +0000 UTC: slow
+	// 1970-01-01 00:00:03.6 +0000 UTC: slow
+	// 1970-01-01 00:00:04.5 +0000 UTC: slow
+	// 1970-01-01 00:00:05.4 +0000 UTC: slow
+	// 1970-01-01 00:00:05.4 +0000 UTC: slow
+}
+
+func ExampleResourceStats() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(10 * time.Second)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+		// keep each wait and each length of the line
+		desim.WithSamples(),
+	)
+
+	teller := desim.MakeFIFOResource("teller", 1)
+
+	customer := func(arrival time.Duration) desim.Action {
+		return func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(arrival))
+			release, obtained := env.Acquire(teller, gen.StaticDuration(3*time.Second))
+			if !obtained {
+				return false
+			}
+			env.Sleep(gen.StaticDuration(2 * time.Second))
+			release()
+			return false
+		}
+	}
+
+	res, err := sim.RunContext(
+		context.Background(),
+		[]*desim.Actor{
+			desim.MakeActor("alice", customer(0)),
+			desim.MakeActor("bob", customer(time.Second)),
+			desim.MakeActor("carol", customer(time.Second)),
+		},
+		[]desim.Resource{teller},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		panic(err)
+	}
+	stats := res.Resources["teller"]
+	fmt.Printf("utilization: %.2f\n", stats.Utilization)
+	fmt.Printf("average queue length: %.2f\n", stats.AvgQueueLength)
+	fmt.Printf("acquisitions: %d, timeouts: %d\n", stats.Acquisitions, stats.Timeouts)
+	fmt.Printf("mean wait: %v, max: %v\n", stats.Wait.Mean(), stats.Wait.Max)
+	fmt.Printf("waits: %v\n", stats.Waits)
+	for _, sample := range stats.QueueLength {
+		fmt.Printf("%v: %v waiting\n", sample.Time, sample.Value)
+	}
+
+	// Output:
+	// utilization: 1.00
+	// average queue length: 0.67
+	// acquisitions: 3, timeouts: 0
+	// mean wait: 1.333333333s, max: 3s
+	// waits: [0s 1s 3s]
+	// 1970-01-01 00:00:01 +0000 UTC: 1 waiting
+	// 1970-01-01 00:00:01 +0000 UTC: 2 waiting
+	// 1970-01-01 00:00:02 +0000 UTC: 1 waiting
+	// 1970-01-01 00:00:04 +0000 UTC: 0 waiting
+}
+
+func clock(iter int, dur time.Duration) desim.Action {
+	pdur := gen.StaticDuration(dur)
+	return func(env desim.Env) bool {
+		iter--
+		env.Log().Event("woke up, about to sleep")
+
+		if env.Sleep(pdur) {
+			env.Log().Event("couldn't sleep")
+			return false
+		}
+		return iter > 0
 	}
 }
 
@@ -440,3 +1571,64 @@ func randomRateClock(seed int64, avgRate time.Duration) desim.Action {
 		return !env.Sleep(pdur)
 	}
 }
+
+func ExampleBranch_Fork() {
+	var (
+		r     = rand.New(rand.NewSource(42))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(time.Minute)
+	)
+
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	// a customer arrives every second, and keeps a server busy for 1.5s
+	model := func() ([]*desim.Actor, []desim.Resource) {
+		servers := desim.MakeFIFOResource("servers", 1)
+		customer := func(env desim.Env) bool {
+			release, obtained := env.Acquire(servers, gen.StaticDuration(time.Hour))
+			if obtained {
+				env.Sleep(gen.StaticDuration(1500 * time.Millisecond))
+				release()
+			}
+			return false
+		}
+		// the actor keeps no state between its calls, that the forks
+		// would need to restore
+		arrivals := desim.MakeActor("arrivals", func(env desim.Env) bool {
+			arrived := env.Now().Sub(start)/time.Second + 1
+			env.Spawn(fmt.Sprintf("customer%d", arrived), customer)
+			return !env.Sleep(gen.StaticDuration(time.Second))
+		})
+		return []*desim.Actor{arrivals}, []desim.Resource{servers}
+	}
+
+	// what if we added a server after 30s?
+	branch, err := sim.RunUntil(context.Background(), start.Add(30*time.Second), model, desim.LogMute())
+	if err != nil {
+		panic(err)
+	}
+	stats := branch.Result.Resources["servers"]
+	fmt.Printf("after 30s: %d customers served, %v mean wait\n", stats.Acquisitions, stats.MeanWait())
+
+	results, err := branch.Forks(context.Background(),
+		nil,
+		[]desim.Intervention{desim.SetCapacity("servers", 2)},
+	)
+	if err != nil {
+		panic(err)
+	}
+	for _, res := range results {
+		stats := res.Resources["servers"]
+		fmt.Printf("%d servers: %d customers served, %v mean wait, %.2f utilization\n", stats.Capacity, stats.Acquisitions, stats.MeanWait(), stats.Utilization)
+	}
+
+	// Output:
+	// after 30s: 21 customers served, 5s mean wait
+	// 1 servers: 41 customers served, 10s mean wait, 1.00 utilization
+	// 2 servers: 61 customers served, 4.680327868s mean wait, 0.99 utilization
+}
@@ -0,0 +1,217 @@
+package desim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aybabtme/desim/pkg/gen"
+)
+
+// A Model makes the actors and resources of a simulation. It makes new
+// ones every time it's called, so that each run has its own.
+type Model func() ([]*Actor, []Resource)
+
+// A Branch is a simulation that ran until some time, and that forks go on
+// from with different interventions.
+//
+// Each fork goes on from the checkpoint of the branch, like a simulation
+// restored with WithRestore: it doesn't run the history before the branch
+// again, its scheduler starts from the state of the checkpoint, and its
+// actors from the calls to their action that waited on it. The
+// interventions apply once every actor waits on the scheduler again.
+type Branch struct {
+	// Result of the simulation until the time of the branch, as if it
+	// ended then.
+	Result *Result
+	// Checkpoint of the simulation at the time of the branch.
+	Checkpoint *Checkpoint
+
+	sim      sim
+	model    Model
+	actorlog Logger
+}
+
+func (sim *sim) RunUntil(ctx context.Context, until time.Time, model Model, actorlog Logger) (*Branch, error) {
+	end := sim.end.Gen()
+	if until.After(end) {
+		return nil, fmt.Errorf("can't branch at %v, after the simulation ends at %v", until, end)
+	}
+	var cp *Checkpoint
+	prefix := *sim
+	prefix.end = gen.StaticTime(until)
+	prefix.checkpoints = append(sim.checkpoints[:len(sim.checkpoints):len(sim.checkpoints)], checkpointRequest{
+		at:   until,
+		save: func(taken *Checkpoint) error { cp = taken; return nil },
+	})
+	actors, resources := model()
+	res, err := prefix.RunContext(ctx, actors, resources, actorlog)
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		return nil, fmt.Errorf("the simulation ended before %v", until)
+	}
+	branch := &Branch{Result: res, Checkpoint: cp, sim: *sim, model: model, actorlog: actorlog}
+	// the forks all end at the same time
+	branch.sim.end = gen.StaticTime(end)
+	return branch, nil
+}
+
+// Fork goes on from the time of the branch with new actors and resources
+// of the model, changed by the interventions, until the simulation ends.
+// Its history is what happens after the time of the branch. It takes none of the checkpoints
+// of the simulation, isn't paced, and keeps its history in memory instead
+// of handing it to the sink of the simulation.
+//
+// Forks of a branch are independent, they can run at the same time.
+func (branch *Branch) Fork(ctx context.Context, interventions ...Intervention) (*Result, error) {
+	fork := branch.sim
+	fork.r = rand.New(rand.NewSource(branch.Checkpoint.Seed))
+	fork.sink, fork.pacer, fork.checkpoints = nil, nil, nil
+	fork.restore, fork.interventions = branch.Checkpoint, interventions
+	actors, resources := branch.model()
+	return fork.RunContext(ctx, actors, resources, branch.actorlog)
+}
+
+// Forks runs a fork for each list of interventions, all at the same time,
+// and returns their results in the same order. It stops them all once one
+// of them fails.
+func (branch *Branch) Forks(ctx context.Context, forks ...[]Intervention) ([]*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		results = make([]*Result, len(forks))
+		errs    = make([]error, len(forks))
+	)
+	for i, interventions := range forks {
+		wg.Add(1)
+		go func(i int, interventions []Intervention) {
+			defer wg.Done()
+			results[i], errs[i] = branch.Fork(ctx, interventions...)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, interventions)
+	}
+	wg.Wait()
+	// the first to fail cancelled the others
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, fmt.Errorf("fork %d: %w", i, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// An Intervention changes a fork at the time of its branch, while every
+// actor waits on the scheduler. Those of this package can be combined in
+// one of its own.
+type Intervention func(fork *Fork) error
+
+// SetCapacity changes the number of slots of a resource. The reservations
+// holding it keep their slots, those waiting in line get the new ones.
+func SetCapacity(resource string, capacity int) Intervention {
+	return func(fork *Fork) error {
+		res, ok := fork.schd.resources[resource].(slotResource)
+		if !ok {
+			return fmt.Errorf("no resource %q with slots", resource)
+		}
+		if capacity < 1 {
+			return fmt.Errorf("%w: resource %q can't have %d slots", ErrInvalidAmount, resource, capacity)
+		}
+		res.resize(capacity, fork.at)
+		// fewer slots may deadlock the actors waiting for them
+		fork.schd.waitsChanged = true
+		res.serve(fork.at, fork.schd.wakeNextInLine)
+		fork.schd.retryAcquireAll()
+		return nil
+	}
+}
+
+// InjectMessage sends a message to an actor, that it receives after the
+// delay. The message comes from no actor.
+func InjectMessage(to string, payload interface{}, delay time.Duration) Intervention {
+	return func(fork *Fork) error {
+		msg := &Message{
+			To:      to,
+			SentAt:  fork.at,
+			Payload: payload,
+		}
+		req := &Request{Actor: to}
+		ev := fork.schd.newEvent(req, fork.at.Add(delay), "delivered injected message")
+		ev.Message = msg
+		ev.effect, ev.req = deliverEffect, req
+		fork.schd.events.Push(ev)
+		return nil
+	}
+}
+
+// SpawnActor starts a new actor. The name of the actor must be unique.
+func SpawnActor(actor *Actor) Intervention {
+	return func(fork *Fork) error {
+		if fork.schd.actorNames[actor.name] {
+			return fmt.Errorf("actor %q was already started", actor.name)
+		}
+		fork.schd.actorNames[actor.name] = true
+		fork.schd.actorsRunning++
+		fork.spawn(fork.r.Int63(), actor)
+		return nil
+	}
+}
+
+// ChangeActor hands the state of an actor to change, to change what the
+// actor does from then on, like its parameters. The actor must have a
+// Snapshotter, made by the model of the fork.
+func ChangeActor(name string, change func(state Snapshotter) error) Intervention {
+	return func(fork *Fork) error {
+		state, ok := fork.checkpoints.state(name)
+		if !ok {
+			return fmt.Errorf("no actor %q with a Snapshotter", name)
+		}
+		if err := change(state); err != nil {
+			return fmt.Errorf("changing actor %q: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// A Fork is what interventions change: the scheduler and the actors of a
+// simulation, once every event until the time of its branch happened.
+type Fork struct {
+	at            time.Time
+	interventions []Intervention
+	schd          *localScheduler
+	checkpoints   *checkpointer
+	// r gives the seeds of the actors that the interventions spawn
+	r     *rand.Rand
+	spawn func(seed int64, actor *Actor)
+}
+
+// Time of the branch, when the interventions apply.
+func (fork *Fork) Time() time.Time { return fork.at }
+
+// spawnSeed is the seed of the seeds of the actors a fork spawns. It's
+// apart from seed, which the actors of the simulation drew theirs from,
+// and from the spawnSeed of a branch at another event.
+func spawnSeed(seed int64, eventID int) int64 {
+	return seed ^ (int64(eventID)+1)*0x5851f42d4c957f2d
+}
+
+// intervene applies the interventions, from the time of the branch.
+func (fork *Fork) intervene() error {
+	fork.schd.currentTime = fork.at
+	for _, intervention := range fork.interventions {
+		if err := intervention(fork); err != nil {
+			return fmt.Errorf("intervening at %v: %w", fork.at, err)
+		}
+	}
+	return nil
+}
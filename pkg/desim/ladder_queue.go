@@ -0,0 +1,167 @@
+package desim
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// ladderThreshold is how many events a bucket holds before it's split
+	// in a rung of its own, instead of being sorted
+	ladderThreshold = 50
+	maxLadderRungs  = 8
+)
+
+// NewLadderQueue makes a ladder queue of events (W. T. Tang, R. S. M. Goh
+// and I. L.-J. Thng, 2005). Events far in the future wait unsorted at the
+// top of the ladder. When they come close, they go down rungs of buckets
+// of finer and finer width, and are only sorted in small batches at the
+// bottom. It has O(1) amortized operations, and unlike a calendar queue
+// it doesn't depend on how the events are spread in time.
+func NewLadderQueue() EventList {
+	return &ladderQueue{topStart: math.MinInt64}
+}
+
+type ladderQueue struct {
+	lazyList
+	// top holds the events from topStart on, unsorted
+	top            []queued
+	topStart       int64
+	topMin, topMax int64
+	// rungs hold the events before topStart, the events of each rung are
+	// before the current bucket of the rung above
+	rungs []*rung
+	// bottom holds the earliest events, sorted
+	bottom []queued
+}
+
+// A rung of the ladder is a row of buckets of the same width. The buckets
+// before cur are empty.
+type rung struct {
+	start   int64
+	width   int64
+	cur     int
+	buckets [][]queued
+}
+
+// curStart is the time of the start of the current bucket.
+func (r *rung) curStart() int64 { return r.start + int64(r.cur)*r.width }
+
+func (q *ladderQueue) Push(ev *Event) {
+	entry := q.enqueue(ev)
+	k := q.key(ev)
+	if k >= q.topStart {
+		if len(q.top) == 0 || k < q.topMin {
+			q.topMin = k
+		}
+		if len(q.top) == 0 || k > q.topMax {
+			q.topMax = k
+		}
+		q.top = append(q.top, entry)
+		return
+	}
+	for _, r := range q.rungs {
+		if k >= r.curStart() {
+			b := int((k - r.start) / r.width)
+			r.buckets[b] = append(r.buckets[b], entry)
+			return
+		}
+	}
+	q.bottom = insertSorted(q.bottom, entry)
+}
+
+func (q *ladderQueue) Peek() *Event {
+	if !q.fill() {
+		return nil
+	}
+	return q.bottom[0].ev
+}
+
+func (q *ladderQueue) Pop() *Event {
+	if !q.fill() {
+		return nil
+	}
+	ev := q.bottom[0].ev
+	q.bottom = q.bottom[1:]
+	q.dequeue(ev)
+	return ev
+}
+
+// fill brings events down the ladder until the earliest one is at the
+// front of the bottom, returning false if the queue is empty.
+func (q *ladderQueue) fill() bool {
+	for {
+		for len(q.bottom) > 0 && !q.bottom[0].live() {
+			q.bottom = q.bottom[1:]
+		}
+		if len(q.bottom) > 0 {
+			return true
+		}
+		if q.n == 0 {
+			return false
+		}
+		if len(q.rungs) == 0 {
+			// a new epoch, everything at the top comes down
+			entries, lo, hi := q.top, q.topMin, q.topMax
+			q.top = nil
+			q.topStart = hi + 1
+			if r := q.spawn(entries, lo, hi-lo+1); r != nil {
+				q.topStart = r.start + int64(len(r.buckets))*r.width
+			}
+			continue
+		}
+		r := q.rungs[len(q.rungs)-1]
+		for r.cur < len(r.buckets) && len(r.buckets[r.cur]) == 0 {
+			r.cur++
+		}
+		if r.cur == len(r.buckets) {
+			q.rungs = q.rungs[:len(q.rungs)-1]
+			continue
+		}
+		entries, start := r.buckets[r.cur], r.curStart()
+		r.buckets[r.cur] = nil
+		r.cur++
+		q.spawn(entries, start, r.width)
+	}
+}
+
+// spawn puts the live entries of a range of time in a new rung, or sorts
+// them at the bottom if they are few, or all at the same time, or if the
+// ladder has all its rungs. It returns the new rung, if any.
+func (q *ladderQueue) spawn(entries []queued, start, span int64) *rung {
+	live := entries[:0]
+	lo, hi := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, entry := range entries {
+		if !entry.live() {
+			continue
+		}
+		live = append(live, entry)
+		k := q.key(entry.ev)
+		if k < lo {
+			lo = k
+		}
+		if k > hi {
+			hi = k
+		}
+	}
+	if len(live) <= ladderThreshold || lo == hi || len(q.rungs) == maxLadderRungs {
+		sort.Slice(live, func(i, j int) bool { return live[i].ev.Before(live[j].ev) })
+		q.bottom = append(q.bottom, live...)
+		return nil
+	}
+	width := (span + int64(len(live)) - 1) / int64(len(live))
+	if width < 1 {
+		width = 1
+	}
+	r := &rung{
+		start:   start,
+		width:   width,
+		buckets: make([][]queued, (span+width-1)/width),
+	}
+	for _, entry := range live {
+		b := int((q.key(entry.ev) - start) / width)
+		r.buckets[b] = append(r.buckets[b], entry)
+	}
+	q.rungs = append(q.rungs, r)
+	return r
+}
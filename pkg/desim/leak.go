@@ -0,0 +1,122 @@
+package desim
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A Leak is a reservation that an actor never released: it was still
+// holding the resource when it was done, or when the simulation ended.
+type Leak struct {
+	Actor    string
+	Resource string
+	// Since is when the actor acquired the resource.
+	Since time.Time
+	// Time is when the leak was found.
+	Time time.Time
+	// ActorDone is true if the actor was done while holding the
+	// reservation, false if it was still running when the simulation
+	// ended.
+	ActorDone bool
+}
+
+func (leak *Leak) String() string {
+	if leak.ActorDone {
+		return fmt.Sprintf("actor %q was done at %v still holding %q, acquired at %v", leak.Actor, leak.Time, leak.Resource, leak.Since)
+	}
+	return fmt.Sprintf("actor %q still held %q when the simulation ended at %v, acquired at %v", leak.Actor, leak.Resource, leak.Time, leak.Since)
+}
+
+// leakReporter is implemented by the schedulers that track the
+// reservations held by actors.
+type leakReporter interface {
+	leaks() []*Leak
+}
+
+var _ leakReporter = (*localScheduler)(nil)
+
+func (schd *localScheduler) leaks() []*Leak { return schd.foundLeaks }
+
+type heldKey struct {
+	resource string
+	key      reservationKey
+}
+
+// heldReservation is a reservation an actor holds.
+type heldReservation struct {
+	actor string
+	since time.Time
+	// releasing is true once the actor asked to release the reservation
+	// later on
+	releasing bool
+}
+
+// hold tracks a reservation granted to an actor.
+func (schd *localScheduler) hold(actor, resource string, key reservationKey) {
+	schd.held[heldKey{resource: resource, key: key}] = &heldReservation{actor: actor, since: schd.currentTime}
+	schd.heldBy[actor]++
+}
+
+// unhold stops tracking a reservation that was released or taken away.
+func (schd *localScheduler) unhold(resource string, key reservationKey) {
+	k := heldKey{resource: resource, key: key}
+	held, ok := schd.held[k]
+	if !ok {
+		return
+	}
+	delete(schd.held, k)
+	schd.heldBy[held.actor]--
+	if schd.heldBy[held.actor] == 0 {
+		delete(schd.heldBy, held.actor)
+	}
+}
+
+// checkRelease returns an error if the actor can't release the
+// reservation: it was released already, or someone else holds it.
+func (schd *localScheduler) checkRelease(byActor, resource string, key reservationKey) error {
+	held, ok := schd.held[heldKey{resource: resource, key: key}]
+	if !ok {
+		return nil
+	}
+	if held.actor != byActor {
+		return fmt.Errorf("%w: actor %q released %q held by %q since %v", ErrForeignRelease, byActor, resource, held.actor, held.since)
+	}
+	return nil
+}
+
+// findLeaks reports the reservations still held by an actor that is
+// done, or by every actor when the simulation ends. The reservations
+// being released later on aren't leaked.
+func (schd *localScheduler) findLeaks(actor string, now time.Time, actorDone bool) {
+	if actor != "" && schd.heldBy[actor] == 0 {
+		return
+	}
+	var leaks []*Leak
+	for k, held := range schd.held {
+		if held.releasing || (actor != "" && held.actor != actor) {
+			continue
+		}
+		leaks = append(leaks, &Leak{
+			Actor:     held.actor,
+			Resource:  k.resource,
+			Since:     held.since,
+			Time:      now,
+			ActorDone: actorDone,
+		})
+		if actorDone {
+			// it's reported once
+			schd.unhold(k.resource, k.key)
+		}
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		if leaks[i].Actor != leaks[j].Actor {
+			return leaks[i].Actor < leaks[j].Actor
+		}
+		if !leaks[i].Since.Equal(leaks[j].Since) {
+			return leaks[i].Since.Before(leaks[j].Since)
+		}
+		return leaks[i].Resource < leaks[j].Resource
+	})
+	schd.foundLeaks = append(schd.foundLeaks, leaks...)
+}
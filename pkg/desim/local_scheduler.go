@@ -1,8 +1,12 @@
 package desim
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,11 +20,23 @@ var (
 
 type waitingRequest struct {
 	envelope *chanReq
-	timeout  *Event
-	async    bool
+	// timeout is the event that answers the actor if nothing else
+	// does first
+	timeout      *timer
+	async        bool
+	reservation  *reservation
+	claims       []claim
+	since        time.Time
+	containerReq *containerRequest
+	storeReq     *storeRequest
 }
 
 func NewLocalScheduler(actorCount int, resources []Resource) (Scheduler, SchedulerClient) {
+	schd := newLocalScheduler(actorCount, resources)
+	return schd, schd
+}
+
+func newLocalScheduler(actorCount int, resources []Resource) *localScheduler {
 	res := make(map[string]Resource)
 	for _, r := range resources {
 		res[r.id()] = r
@@ -29,25 +45,89 @@ func NewLocalScheduler(actorCount int, resources []Resource) (Scheduler, Schedul
 		actorCount:              actorCount,
 		resources:               res,
 		queue:                   make(chan *chanReq, actorCount),
-		eventHeap:               newEventHeap(),
+		done:                    make(chan struct{}),
+		events:                  newEventHeap(),
 		pendingResponse:         make(map[int]*chanReq),
 		actorsWaitingForService: make(map[string]*waitingRequest),
+		mailboxes:               make(map[string][]*Message),
+		actorsDone:              make(map[string]bool),
+		actorNames:              make(map[string]bool),
+		held:                    make(map[heldKey]*heldReservation),
+		heldBy:                  make(map[string]int),
+		clockTimers:             make(map[clockTimer]*timer),
 	}
-	return schd, schd
+	return schd
 }
 
 type localScheduler struct {
-	actorCount int
-	resources  map[string]Resource
-	queue      chan *chanReq
-	abortMu    sync.Mutex
-	abortRes   *Response
+	actorCount    int
+	actorsRunning int
+	resources     map[string]Resource
+	queue         chan *chanReq
+	done          chan struct{}
+	abortMu       sync.Mutex
+	abortRes      *Response
+	err           error
+
+	ctx       context.Context
+	end       time.Time
+	sink      EventSink
+	stoppedAt time.Time
+	// aborted is true once the simulation is over, the actors waiting
+	// for service get the abortedRes response
+	aborted    bool
+	abortedRes *Response
 
+	// pacer holds back the time advance, if the simulation is paced
+	pacer                   *Pacer
 	currentTime             time.Time
 	eventID                 int
-	eventHeap               *eventHeap
+	events                  EventList
 	pendingResponse         map[int]*chanReq
 	actorsWaitingForService map[string]*waitingRequest
+	// waitingForAll are the actors waiting to acquire several resources
+	// at once, in the order they started waiting
+	waitingForAll []*waitingRequest
+	mailboxes     map[string][]*Message
+	actorsDone    map[string]bool
+	// actorNames are the actors that made requests or were spawned, the
+	// names spawned actors can't take
+	actorNames map[string]bool
+
+	// held are the reservations granted to actors, heldBy counts them
+	// by actor
+	held       map[heldKey]*heldReservation
+	heldBy     map[string]int
+	foundLeaks []*Leak
+	// clockTimers are the pending timers of the clocks of the actors
+	clockTimers map[clockTimer]*timer
+
+	deadlockPolicy DeadlockPolicy
+	foundDeadlocks []*Deadlock
+	// lastDeadlock identifies the deadlock found at the last check,
+	// deadlocked are its actors
+	lastDeadlock string
+	deadlocked   map[string]bool
+	// waitsChanged is set when a deadlock may have started or ended: an
+	// actor started waiting on another or on slots, an actor holding
+	// slots is done, or an actor of the last deadlock was woken up
+	waitsChanged bool
+
+	// admit, if set, fails the simulation with the requests that the
+	// scheduler can't serve
+	admit func(req *Request) error
+	// forward, if set, hands the delivery of a message to whoever serves
+	// its recipient, it returns false if it's this scheduler
+	forward func(to string, ev *Event) bool
+
+	// checkpoints are still to be taken, earliest first
+	checkpoints []pendingCheckpoint
+	// restored is the state the scheduler goes on from, if it goes on
+	// from a checkpoint. The actors waiting on it then are resuming until
+	// they make their request again, resumed is called once none is.
+	restored *schedulerState
+	resuming map[string]*resumption
+	resumed  func() error
 }
 
 func (schd *localScheduler) Schedule(req *Request) *Response {
@@ -59,153 +139,290 @@ func (schd *localScheduler) Schedule(req *Request) *Response {
 	}
 	envelope := &chanReq{
 		req: req,
-		res: make(chan *chanRes),
+		res: make(chan *chanRes, 1),
+	}
+	select {
+	case schd.queue <- envelope:
+	case <-schd.done:
+		return schd.abortRes
+	}
+	select {
+	case res := <-envelope.res:
+		return res.res
+	case <-schd.done:
+		return schd.abortRes
 	}
-	schd.queue <- envelope
-	res := <-envelope.res
-	return res.res
 }
 
-func (schd *localScheduler) Run(r *rand.Rand, start, end time.Time) []*Event {
-	schd.currentTime = start
-
-	var (
-		// requests that are waiting for some condition to occur
-		// before being scheduled in the future
-		actorsRunning = schd.actorCount
-	)
-	defer func() {
-		for _, pending := range schd.pendingResponse {
-			select {
-			case pending.res <- &chanRes{res: &Response{
-				Now:  schd.currentTime,
-				Done: true,
-			}}:
-			default:
-			}
-		}
-	}()
-
-	recvRequest := func(envelope *chanReq) {
-		req := envelope.req
-		reqType := req.Type
-		switch {
-		case reqType.Abort != nil:
-			schd.handleRequestTypeAbort(envelope)
-		case reqType.Done != nil:
-			schd.handleRequestTypeDone(envelope)
-		case reqType.Delay != nil:
-			schd.handleRequestTypeDelay(envelope)
-		case reqType.AcquireResource != nil:
-			schd.handleRequestTypeAcquireResource(envelope)
-		case reqType.ReleaseResource != nil:
-			schd.handleRequestTypeReleaseResource(envelope)
-		}
-	}
-
-	var history []*Event
-	moreEvents := true
-	aborted := false
-	var abortedRes *Response
-	abortNow := func(nextEvent *Event) {
-		aborted = true
-		abortedRes = &Response{
-			Now:         nextEvent.Time,
-			Interrupted: true,
-			Done:        true,
-		}
-		schd.abortMu.Lock()
-		schd.abortRes = abortedRes
-		schd.abortMu.Unlock()
-	}
-	defer func() {
-		if aborted {
-		drainloop:
-			for {
-				select {
-				case env := <-schd.queue:
-					env.res <- &chanRes{res: abortedRes}
-				default:
-					break drainloop
-				}
-			}
-			close(schd.queue)
-		}
-	}()
+func (schd *localScheduler) Run(ctx context.Context, r *rand.Rand, start, end time.Time, sink EventSink) error {
+	schd.begin(ctx, start, end, sink)
+	defer schd.finish()
 
 	for {
-
-		if moreEvents && len(schd.pendingResponse) != actorsRunning {
+		if len(schd.pendingResponse) != schd.actorsRunning {
 			// wait til all actors have made an action
 			var polledCount int
-			for moreEvents && len(schd.pendingResponse) != actorsRunning {
-				env, ok := <-schd.queue
-				if !ok {
-					moreEvents = false
-				} else {
-					recvRequest(env)
+			for schd.err == nil && len(schd.pendingResponse) != schd.actorsRunning {
+				select {
+				case env := <-schd.queue:
+					schd.recvRequest(env)
 					polledCount++
+				case <-ctx.Done():
+					schd.fail(ctx.Err())
 				}
 			}
 			if D {
 				log.Printf("scheduler: received events: %d", polledCount)
 			}
 		}
+		if !schd.step() {
+			return schd.err
+		}
+	}
+}
+
+// begin prepares a simulation. Every actor is running.
+func (schd *localScheduler) begin(ctx context.Context, start, end time.Time, sink EventSink) {
+	schd.ctx, schd.end, schd.sink = ctx, end, sink
+	schd.currentTime = start
+	schd.actorsRunning = schd.actorCount
+	if schd.pacer != nil {
+		schd.pacer.start(start)
+	}
+	for _, res := range schd.resources {
+		res.begin(start)
+	}
+	if schd.restored == nil {
+		return
+	}
+	if err := schd.restore(schd.restored); err != nil {
+		schd.fail(err)
+		return
+	}
+	if len(schd.resuming) == 0 {
+		schd.resumeDone()
+	}
+}
+
+// finish stops observing the simulation and releases every actor still
+// waiting on the scheduler.
+func (schd *localScheduler) finish() {
+	if schd.stoppedAt.IsZero() {
+		schd.stoppedAt = schd.currentTime
+	}
+	for _, res := range schd.resources {
+		res.end(schd.stoppedAt)
+	}
+	schd.findLeaks("", schd.stoppedAt, false)
 
-		if !moreEvents {
-			return history
+	schd.abortMu.Lock()
+	if schd.abortRes == nil {
+		schd.abortRes = &Response{
+			Now:  schd.currentTime,
+			Done: true,
 		}
+	}
+	schd.abortMu.Unlock()
+	close(schd.done)
+}
 
-		if schd.eventHeap.Len() == 0 {
-			return history
+func (schd *localScheduler) recvRequest(envelope *chanReq) {
+	req := envelope.req
+	reqType := req.Type
+	schd.actorNames[req.Actor] = true
+	if schd.admit != nil {
+		if err := schd.admit(req); err != nil {
+			schd.fail(err)
+			return
 		}
+	}
+	if r, ok := schd.resuming[req.Actor]; ok && reqType.Panic == nil {
+		schd.resume(envelope, r)
+		return
+	}
+	switch {
+	case reqType.Abort != nil:
+		schd.handleRequestTypeAbort(envelope)
+	case reqType.Done != nil:
+		schd.handleRequestTypeDone(envelope)
+	case reqType.Delay != nil:
+		schd.handleRequestTypeDelay(envelope)
+	case reqType.AcquireResource != nil:
+		schd.handleRequestTypeAcquireResource(envelope)
+	case reqType.ReleaseResource != nil:
+		schd.handleRequestTypeReleaseResource(envelope)
+	case reqType.AcquireResources != nil:
+		schd.handleRequestTypeAcquireResources(envelope)
+	case reqType.ReleaseResources != nil:
+		schd.handleRequestTypeReleaseResources(envelope)
+	case reqType.SendMessage != nil:
+		schd.handleRequestTypeSendMessage(envelope)
+	case reqType.ReceiveMessage != nil:
+		schd.handleRequestTypeReceiveMessage(envelope)
+	case reqType.Interrupt != nil:
+		schd.handleRequestTypeInterrupt(envelope)
+	case reqType.Spawn != nil:
+		schd.handleRequestTypeSpawn(envelope)
+	case reqType.Join != nil:
+		schd.handleRequestTypeJoin(envelope)
+	case reqType.Panic != nil:
+		schd.handleRequestTypePanic(envelope)
+	case reqType.PutContainer != nil, reqType.GetContainer != nil:
+		schd.handleRequestTypeContainer(envelope)
+	case reqType.PutStore != nil, reqType.GetStore != nil:
+		schd.handleRequestTypeStore(envelope)
+	case reqType.SetTimer != nil:
+		schd.handleRequestTypeSetTimer(envelope)
+	case reqType.StopTimer != nil:
+		schd.handleRequestTypeStopTimer(envelope)
+	case reqType.WaitTimer != nil:
+		schd.handleRequestTypeWaitTimer(envelope)
+	}
+}
+
+func (schd *localScheduler) abortNow(nextEvent *Event) {
+	schd.aborted = true
+	schd.abortedRes = &Response{
+		Now:         nextEvent.Time,
+		Interrupted: true,
+		Done:        true,
+	}
+	schd.abortMu.Lock()
+	schd.abortRes = schd.abortedRes
+	schd.abortMu.Unlock()
+}
 
-		nextEvent := schd.eventHeap.Pop()
+// step performs the next event, once every running actor is waiting on
+// the scheduler. It returns false when the simulation is over.
+func (schd *localScheduler) step() bool {
+	select {
+	case <-schd.ctx.Done():
+		schd.fail(schd.ctx.Err())
+	default:
+	}
 
-		if !end.IsZero() && nextEvent.Time.After(end) {
-			abortNow(nextEvent)
-			return history
-		}
+	if schd.err != nil {
+		return false
+	}
 
-		if D {
-			log.Printf("scheduler: performing next event: %v", nextEvent.Labels)
+	if schd.deadlockPolicy != IgnoreDeadlocks && schd.waitsChanged {
+		schd.waitsChanged = false
+		schd.checkDeadlocks()
+		if schd.err != nil {
+			return false
 		}
+	}
+
+	if err := schd.takeCheckpoints(); err != nil {
+		schd.fail(err)
+		return false
+	}
+	if len(schd.pendingResponse) != schd.actorsRunning {
+		// the interventions on a fork started actors, wait for them
+		return true
+	}
+
+	if schd.events.Len() == 0 {
+		return false
+	}
+
+	nextEvent := schd.events.Pop()
 
-		schd.currentTime = nextEvent.Time // advance time
+	if !schd.end.IsZero() && nextEvent.Time.After(schd.end) {
+		schd.abortNow(nextEvent)
+		schd.stoppedAt = schd.end
+		return false
+	}
 
-		if nextEvent.onHandle != nil {
-			nextEvent.onHandle()
+	if D {
+		log.Printf("scheduler: performing next event: %v", nextEvent.Labels)
+	}
+
+	if schd.pacer != nil {
+		if err := schd.pacer.wait(schd.ctx, nextEvent.Time); err != nil {
+			schd.fail(err)
+			return false
 		}
+	}
+
+	schd.currentTime = nextEvent.Time // advance time
 
-		if nextEvent.Signals.Has(SignalActorDone) {
-			delete(schd.actorsWaitingForService, nextEvent.Actor)
-			actorsRunning--
+	if waiting, ok := schd.actorsWaitingForService[nextEvent.Actor]; ok && waiting.timeout.ev == nextEvent {
+		// the actor stopped waiting, it timed out
+		schd.stopWaiting(nextEvent.Actor, waiting, true)
+	}
+
+	if nextEvent.onHandle != nil {
+		nextEvent.onHandle()
+		// don't retain the closure once the event happened
+		nextEvent.onHandle = nil
+	}
+	if nextEvent.effect != noEffect {
+		schd.perform(nextEvent)
+		nextEvent.effect, nextEvent.req, nextEvent.evicted = noEffect, nil, nil
+	}
+	if schd.err != nil {
+		return false
+	}
+
+	if schd.deadlocked[nextEvent.Actor] {
+		schd.waitsChanged = true
+	}
+	actorDone := nextEvent.Signals.Has(SignalActorDone)
+	if actorDone {
+		delete(schd.actorsWaitingForService, nextEvent.Actor)
+		schd.actorsRunning--
+		schd.actorsDone[nextEvent.Actor] = true
+		if schd.heldBy[nextEvent.Actor] > 0 {
+			// the slots it leaks may be what others wait for
+			schd.waitsChanged = true
 		}
+		schd.findLeaks(nextEvent.Actor, nextEvent.Time, true)
+		schd.wakeJoiners(nextEvent.Actor)
+	}
 
-		if nextEvent.Signals.Has(SignalAbort) {
-			abortNow(nextEvent)
+	if nextEvent.Signals.Has(SignalAbort) {
+		schd.abortNow(nextEvent)
+	}
+	var res *Response
+	if schd.aborted {
+		res = schd.abortedRes
+		delete(schd.actorsWaitingForService, nextEvent.Actor)
+		if !actorDone {
+			schd.actorsRunning--
 		}
-		var res *Response
-		if aborted {
-			res = abortedRes
-			delete(schd.actorsWaitingForService, nextEvent.Actor)
-			actorsRunning--
-		} else {
-			res = &Response{
-				Now:            nextEvent.Time,
-				Interrupted:    nextEvent.Interrupted,
-				Timedout:       nextEvent.Timedout,
-				ReservationKey: nextEvent.ReservationKey,
-			}
+	} else {
+		res = &Response{
+			Now:             nextEvent.Time,
+			Interrupted:     nextEvent.Interrupted,
+			Timedout:        nextEvent.Timedout,
+			ReservationKey:  nextEvent.ReservationKey,
+			ReservationKeys: nextEvent.ReservationKeys,
+			Message:         nextEvent.Message,
+			Item:            nextEvent.Item,
 		}
-		if pending, ok := schd.pendingResponse[nextEvent.ID]; ok {
-			pending.res <- &chanRes{res: res}
+		if nextEvent.Interrupted {
+			res.Interruption = nextEvent.Interruption
 		}
+	}
+	if pending, ok := schd.pendingResponse[nextEvent.ID]; ok {
+		pending.res <- &chanRes{res: res}
+	}
+
+	// cleanup
+	delete(schd.pendingResponse, nextEvent.ID)
 
-		// cleanup
-		delete(schd.pendingResponse, nextEvent.ID)
+	if err := schd.sink.Handle(nextEvent); err != nil {
+		schd.fail(err)
+	}
+	return true
+}
 
-		history = append(history, nextEvent)
+// fail stops the simulation with the given error. Only the first error
+// is kept.
+func (schd *localScheduler) fail(err error) {
+	if schd.err == nil {
+		schd.err = err
 	}
 }
 
@@ -229,7 +446,7 @@ func (schd *localScheduler) handleRequestTypeAbort(envelope *chanReq) {
 	// schedule an immediate "abort" event
 	ev := schd.newEvent(req, schd.currentTime, "actor is aborting simulation")
 	ev.Signals = ev.Signals.Set(SignalAbort)
-	schd.eventHeap.Push(ev)
+	schd.events.Push(ev)
 	schd.pendingResponse[ev.ID] = envelope
 }
 
@@ -238,7 +455,7 @@ func (schd *localScheduler) handleRequestTypeDone(envelope *chanReq) {
 	// schedule an immediate "done" event
 	ev := schd.newEvent(req, schd.currentTime, "actor is done")
 	ev.Signals = ev.Signals.Set(SignalActorDone)
-	schd.eventHeap.Push(ev)
+	schd.events.Push(ev)
 	schd.pendingResponse[ev.ID] = envelope
 }
 
@@ -247,8 +464,15 @@ func (schd *localScheduler) handleRequestTypeDelay(envelope *chanReq) {
 	reqType := req.Type.Delay
 	// simply schedule an event to wake up
 	ev := schd.newEvent(req, schd.currentTime.Add(reqType.Delay), "waited a delay")
-	schd.eventHeap.Push(ev)
+	wakeUp := schd.startTimer(ev)
 	schd.pendingResponse[ev.ID] = envelope
+
+	// the actor can be interrupted while it waits
+	schd.actorsWaitingForService[req.Actor] = &waitingRequest{
+		envelope: envelope,
+		timeout:  wakeUp,
+		async:    false,
+	}
 }
 
 func (schd *localScheduler) handleRequestTypeAcquireResource(envelope *chanReq) {
@@ -256,15 +480,40 @@ func (schd *localScheduler) handleRequestTypeAcquireResource(envelope *chanReq)
 	acquire := req.Type.AcquireResource
 	actor := req.Actor
 	// lookup the resource
-	resource, ok := schd.resources[acquire.ResourceID]
+	rsc, ok := schd.resources[acquire.ResourceID]
+	if !ok {
+		schd.fail(fmt.Errorf("%w: actor %q can't acquire %q", ErrUnknownResource, actor, acquire.ResourceID))
+		return
+	}
+	resource, ok := rsc.(slotResource)
 	if !ok {
-		panic("asking to acquire a resource that doesn't exist: " + acquire.ResourceID)
+		schd.fail(fmt.Errorf("%w: actor %q can't acquire %q", ErrWrongResourceKind, actor, acquire.ResourceID))
+		return
+	}
+	units := acquire.Units
+	if units == 0 {
+		units = 1
 	}
-	reservation := resource.acquireOrEnqueue(actor)
-	if reservation != nil {
+	if units < 0 || units > resource.slots() {
+		schd.fail(fmt.Errorf("%w: actor %q can't acquire %d slots of %q with %d slots", ErrInvalidAmount, actor, units, acquire.ResourceID, resource.slots()))
+		return
+	}
+	reservation, acquired, evicted := resource.acquireOrEnqueue(actor, req.Priority, units, schd.currentTime)
+	if acquired {
+		schd.hold(actor, resource.id(), reservation.key())
+		for _, res := range evicted {
+			schd.unhold(resource.id(), res.key())
+		}
 		// schedule an immediate event
 		ev := schd.newEvent(req, schd.currentTime, "acquired resource immediately")
-		schd.eventHeap.Push(ev)
+		if evicted != nil {
+			// the evicted holders learn about it when the event occurs
+			ev.effect, ev.req = preemptEffect, req
+			for _, res := range evicted {
+				ev.evicted = append(ev.evicted, res.actor)
+			}
+		}
+		schd.events.Push(ev)
 		ev.ReservationKey = string(reservation.key())
 		schd.pendingResponse[ev.ID] = envelope
 		return
@@ -272,43 +521,87 @@ func (schd *localScheduler) handleRequestTypeAcquireResource(envelope *chanReq)
 	// schedule a timeout
 	timeoutEvent := schd.newEvent(req, schd.currentTime.Add(acquire.Timeout), "timed out waiting for resource")
 	timeoutEvent.Timedout = true
-	schd.eventHeap.Push(timeoutEvent)
+	deadline := schd.startTimer(timeoutEvent)
 	schd.pendingResponse[timeoutEvent.ID] = envelope
 
 	// keep the actor waiting, somewhere we can grab it back
 	// when its turns come
 	schd.actorsWaitingForService[actor] = &waitingRequest{
-		envelope: envelope,
-		timeout:  timeoutEvent,
-		async:    false, // we are actively waiting for the response
+		envelope:    envelope,
+		timeout:     deadline,
+		async:       false, // we are actively waiting for the response
+		reservation: reservation,
 	}
+	schd.waitsChanged = true
 	return
 }
 
-func (schd *localScheduler) releaseResource(resource Resource, resKey reservationKey) {
-	resource.release(resKey, func(nextReservationInLine *reservation) (stillWaiting bool) {
-		waitingRequest, ok := schd.actorsWaitingForService[nextReservationInLine.actor]
-		if !ok {
-			// actor timed out/is gone
-			return false
-		}
-		// remove actor from the waiting list
-		delete(schd.actorsWaitingForService, nextReservationInLine.actor)
-		// remove the actor's pending timeout
-		timeoutEvent := waitingRequest.timeout
-		schd.eventHeap.Remove(timeoutEvent)
-		delete(schd.pendingResponse, timeoutEvent.ID)
+// stopWaiting removes an actor from the waiting list, giving up on
+// whatever it was waiting for.
+func (schd *localScheduler) stopWaiting(actor string, waiting *waitingRequest, timedout bool) {
+	delete(schd.actorsWaitingForService, actor)
+	if acquire := waiting.envelope.req.Type.AcquireResource; acquire != nil && waiting.reservation != nil {
+		resource := schd.resources[acquire.ResourceID].(slotResource)
+		resource.cancel(waiting.reservation, schd.currentTime, timedout)
+		// the reservation may have been holding up others
+		resource.serve(schd.currentTime, schd.wakeNextInLine)
+		schd.retryAcquireAll()
+	}
+	if waiting.containerReq != nil {
+		c := schd.resources[containerID(waiting.envelope.req.Type)].(Container)
+		c.cancel(waiting.containerReq, schd.currentTime, timedout)
+		// the request may have been holding up others
+		c.serve(schd.currentTime, schd.wakeContainerWaiter)
+	}
+	if waiting.storeReq != nil {
+		st := schd.resources[storeID(waiting.envelope.req.Type)].(Store)
+		st.cancel(waiting.storeReq, schd.currentTime, timedout)
+		// the request may have been holding up others
+		st.serve(schd.currentTime, schd.wakeStoreWaiter)
+	}
+}
 
-		// schedule an immediate event to wake up the actor
-		// it has acquired the resource
-		ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, "acquired resource after waiting")
-		ev.ReservationKey = string(nextReservationInLine.key())
-		schd.eventHeap.Push(ev)
-		if !waitingRequest.async {
-			schd.pendingResponse[ev.ID] = waitingRequest.envelope
-		}
-		return true
-	})
+func (schd *localScheduler) releaseResource(resource slotResource, resKey reservationKey, byActor string) {
+	if err := schd.checkRelease(byActor, resource.id(), resKey); err != nil {
+		schd.fail(err)
+		return
+	}
+	err := resource.release(resKey, schd.currentTime, schd.wakeNextInLine)
+	if errors.Is(err, ErrDoubleRelease) {
+		err = fmt.Errorf("%w: actor %q released %q, which it no longer held", err, byActor, resource.id())
+	}
+	if err != nil {
+		schd.fail(err)
+		return
+	}
+	schd.unhold(resource.id(), resKey)
+	// the slots may be what others are waiting for
+	schd.retryAcquireAll()
+}
+
+// wakeNextInLine wakes up an actor whose reservation made it to the front
+// of the line of a resource.
+func (schd *localScheduler) wakeNextInLine(nextReservationInLine *reservation) (stillWaiting bool) {
+	waitingRequest, ok := schd.actorsWaitingForService[nextReservationInLine.actor]
+	if !ok || waitingRequest.envelope.req.Type.AcquireResource == nil {
+		// actor timed out/is gone
+		return false
+	}
+	// remove actor from the waiting list
+	delete(schd.actorsWaitingForService, nextReservationInLine.actor)
+	schd.cancelTimeout(waitingRequest)
+
+	// schedule an immediate event to wake up the actor
+	// it has acquired the resource
+	schd.hold(nextReservationInLine.actor, waitingRequest.envelope.req.Type.AcquireResource.ResourceID, nextReservationInLine.key())
+
+	ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, "acquired resource after waiting")
+	ev.ReservationKey = string(nextReservationInLine.key())
+	schd.events.Push(ev)
+	if !waitingRequest.async {
+		schd.pendingResponse[ev.ID] = waitingRequest.envelope
+	}
+	return true
 }
 
 func (schd *localScheduler) handleRequestTypeReleaseResource(envelope *chanReq) {
@@ -316,19 +609,27 @@ func (schd *localScheduler) handleRequestTypeReleaseResource(envelope *chanReq)
 	release := req.Type.ReleaseResource
 
 	// lookup the resource
-	resource, ok := schd.resources[release.ResourceID]
+	rsc, ok := schd.resources[release.ResourceID]
 	if !ok {
-		panic("asking to release a resource that doesn't exist")
+		schd.fail(fmt.Errorf("%w: actor %q can't release %q", ErrUnknownResource, req.Actor, release.ResourceID))
+		return
+	}
+	resource, ok := rsc.(slotResource)
+	if !ok {
+		schd.fail(fmt.Errorf("%w: actor %q can't release %q", ErrWrongResourceKind, req.Actor, release.ResourceID))
+		return
 	}
 
 	if req.Async {
+		if held, ok := schd.held[heldKey{resource: resource.id(), key: reservationKey(release.ReservationKey)}]; ok {
+			// the actor may be done before it's released
+			held.releasing = true
+		}
 		// schedule an event in the future to release the resource
 		ev := schd.newEvent(req, schd.currentTime.Add(req.AsyncDelay), "released resource async")
 		// trigger the release when the event occurs
-		ev.onHandle = func() {
-			schd.releaseResource(resource, reservationKey(release.ReservationKey))
-		}
-		schd.eventHeap.Push(ev)
+		ev.effect, ev.req = releaseEffect, req
+		schd.events.Push(ev)
 		// return control immediately
 		envelope.res <- &chanRes{
 			res: &Response{Now: schd.currentTime},
@@ -339,15 +640,655 @@ func (schd *localScheduler) handleRequestTypeReleaseResource(envelope *chanReq)
 
 	// schedule an immediate event to release the resource
 	ev := schd.newEvent(req, schd.currentTime, "released resource")
-	ev.onHandle = func() {
-		schd.releaseResource(resource, reservationKey(release.ReservationKey))
-	}
-	schd.eventHeap.Push(ev)
+	ev.effect, ev.req = releaseEffect, req
+	schd.events.Push(ev)
 	schd.pendingResponse[ev.ID] = envelope
 
 	return
 }
 
+// A claim is a number of slots of a resource.
+type claim struct {
+	resource slotResource
+	units    int
+}
+
+func (schd *localScheduler) handleRequestTypeAcquireResources(envelope *chanReq) {
+	req := envelope.req
+	acquire := req.Type.AcquireResources
+	actor := req.Actor
+	// lookup the resources, asking for a resource twice claims two slots
+	var claims []claim
+	index := make(map[string]int, len(acquire.ResourceIDs))
+	for _, id := range acquire.ResourceIDs {
+		rsc, ok := schd.resources[id]
+		if !ok {
+			schd.fail(fmt.Errorf("%w: actor %q can't acquire %q", ErrUnknownResource, actor, id))
+			return
+		}
+		resource, ok := rsc.(slotResource)
+		if !ok {
+			schd.fail(fmt.Errorf("%w: actor %q can't acquire %q", ErrWrongResourceKind, actor, id))
+			return
+		}
+		i, ok := index[id]
+		if !ok {
+			i = len(claims)
+			index[id] = i
+			claims = append(claims, claim{resource: resource})
+		}
+		claims[i].units++
+		if claims[i].units > resource.slots() {
+			schd.fail(fmt.Errorf("%w: actor %q can't acquire %d slots of %q with %d slots", ErrInvalidAmount, actor, claims[i].units, id, resource.slots()))
+			return
+		}
+	}
+	if keys, ok := schd.acquireAll(actor, req.Priority, claims, schd.currentTime); ok {
+		// schedule an immediate event
+		ev := schd.newEvent(req, schd.currentTime, "acquired resources immediately")
+		ev.ReservationKeys = keys
+		schd.events.Push(ev)
+		schd.pendingResponse[ev.ID] = envelope
+		return
+	}
+	// schedule a timeout
+	timeoutEvent := schd.newEvent(req, schd.currentTime.Add(acquire.Timeout), "timed out waiting for resources")
+	timeoutEvent.Timedout = true
+	deadline := schd.startTimer(timeoutEvent)
+	schd.pendingResponse[timeoutEvent.ID] = envelope
+
+	// the actor doesn't wait in the line of any resource, it gets them
+	// all when they are all free
+	waiting := &waitingRequest{
+		envelope: envelope,
+		timeout:  deadline,
+		claims:   claims,
+		since:    schd.currentTime,
+	}
+	schd.actorsWaitingForService[actor] = waiting
+	schd.waitingForAll = append(schd.waitingForAll, waiting)
+	schd.waitsChanged = true
+}
+
+// acquireAll grants every claim, or none of them if one of the resources
+// doesn't have the slots available.
+func (schd *localScheduler) acquireAll(actor string, priority int32, claims []claim, requestedAt time.Time) ([]string, bool) {
+	for _, c := range claims {
+		if !c.resource.available(c.units) {
+			return nil, false
+		}
+	}
+	keys := make([]string, 0, len(claims))
+	for _, c := range claims {
+		res := c.resource.grant(actor, priority, c.units, requestedAt, schd.currentTime)
+		schd.hold(actor, c.resource.id(), res.key())
+		keys = append(keys, string(res.key()))
+	}
+	return keys, true
+}
+
+// retryAcquireAll wakes up the actors waiting for several resources that
+// are now all available, in the order they started waiting.
+func (schd *localScheduler) retryAcquireAll() {
+	stillWaiting := schd.waitingForAll[:0]
+	for _, waiting := range schd.waitingForAll {
+		req := waiting.envelope.req
+		if schd.actorsWaitingForService[req.Actor] != waiting {
+			// actor timed out/is gone
+			continue
+		}
+		keys, ok := schd.acquireAll(req.Actor, req.Priority, waiting.claims, waiting.since)
+		if !ok {
+			stillWaiting = append(stillWaiting, waiting)
+			continue
+		}
+		delete(schd.actorsWaitingForService, req.Actor)
+		schd.cancelTimeout(waiting)
+
+		ev := schd.newEvent(req, schd.currentTime, "acquired resources after waiting")
+		ev.ReservationKeys = keys
+		schd.events.Push(ev)
+		schd.pendingResponse[ev.ID] = waiting.envelope
+	}
+	for i := len(stillWaiting); i < len(schd.waitingForAll); i++ {
+		schd.waitingForAll[i] = nil
+	}
+	schd.waitingForAll = stillWaiting
+}
+
+func (schd *localScheduler) handleRequestTypeReleaseResources(envelope *chanReq) {
+	req := envelope.req
+	release := req.Type.ReleaseResources
+	if len(release.ResourceIDs) != len(release.ReservationKeys) {
+		schd.fail(fmt.Errorf("actor %q released %d resources with %d reservations", req.Actor, len(release.ResourceIDs), len(release.ReservationKeys)))
+		return
+	}
+	for _, id := range release.ResourceIDs {
+		rsc, ok := schd.resources[id]
+		if !ok {
+			schd.fail(fmt.Errorf("%w: actor %q can't release %q", ErrUnknownResource, req.Actor, id))
+			return
+		}
+		if _, ok := rsc.(slotResource); !ok {
+			schd.fail(fmt.Errorf("%w: actor %q can't release %q", ErrWrongResourceKind, req.Actor, id))
+			return
+		}
+	}
+
+	// schedule an immediate event to release the resources
+	ev := schd.newEvent(req, schd.currentTime, "released resources")
+	ev.effect, ev.req = releaseEffect, req
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+func containerID(reqType *RequestType) string {
+	if put := reqType.PutContainer; put != nil {
+		return put.ContainerID
+	}
+	return reqType.GetContainer.ContainerID
+}
+
+func (schd *localScheduler) handleRequestTypeContainer(envelope *chanReq) {
+	req := envelope.req
+	var (
+		put         = req.Type.PutContainer != nil
+		containerID string
+		amount      float64
+		verb        string
+		action      string
+	)
+	if put {
+		containerID, amount = req.Type.PutContainer.ContainerID, req.Type.PutContainer.Amount
+		verb, action = "put in container", "put %g in"
+	} else {
+		containerID, amount = req.Type.GetContainer.ContainerID, req.Type.GetContainer.Amount
+		verb, action = "got from container", "get %g from"
+	}
+	// lookup the container
+	rsc, ok := schd.resources[containerID]
+	if !ok {
+		schd.fail(fmt.Errorf("%w: actor %q can't use %q", ErrUnknownResource, req.Actor, containerID))
+		return
+	}
+	c, ok := rsc.(Container)
+	if !ok {
+		schd.fail(fmt.Errorf("%w: actor %q can't use %q as a container", ErrWrongResourceKind, req.Actor, containerID))
+		return
+	}
+	if amount < 0 || amount > c.Capacity() {
+		schd.fail(fmt.Errorf("%w: actor %q can't "+action+" %q of capacity %g", ErrInvalidAmount, req.Actor, amount, containerID, c.Capacity()))
+		return
+	}
+
+	// schedule an immediate event, the level only changes when it occurs
+	ev := schd.newEvent(req, schd.currentTime, verb+" immediately")
+	ev.effect, ev.req = containerEffect, req
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+// requestContainer puts in or gets from a container when the event of
+// the request occurs, or has the actor wait in line.
+func (schd *localScheduler) requestContainer(ev *Event) {
+	var (
+		req     = ev.req
+		put     = req.Type.PutContainer != nil
+		c       = schd.resources[containerID(req.Type)].(Container)
+		amount  float64
+		timeout time.Duration
+	)
+	if put {
+		amount, timeout = req.Type.PutContainer.Amount, req.Type.PutContainer.Timeout
+	} else {
+		amount, timeout = req.Type.GetContainer.Amount, req.Type.GetContainer.Timeout
+	}
+	containerReq := c.request(put, req.Actor, amount, schd.currentTime, schd.wakeContainerWaiter)
+	if containerReq.served {
+		return
+	}
+	if put {
+		ev.Kind = "waiting for room in container"
+	} else {
+		ev.Kind = "waiting for level in container"
+	}
+	// wait in line instead, with a timeout
+	envelope := schd.pendingResponse[ev.ID]
+	delete(schd.pendingResponse, ev.ID)
+	timeoutEvent := schd.newEvent(req, schd.currentTime.Add(timeout), "timed out waiting for container")
+	timeoutEvent.Timedout = true
+	deadline := schd.startTimer(timeoutEvent)
+	schd.pendingResponse[timeoutEvent.ID] = envelope
+	schd.actorsWaitingForService[req.Actor] = &waitingRequest{
+		envelope:     envelope,
+		timeout:      deadline,
+		containerReq: containerReq,
+	}
+}
+
+// wakeContainerWaiter wakes up an actor whose request to a container was
+// served after waiting in line.
+func (schd *localScheduler) wakeContainerWaiter(containerReq *containerRequest) {
+	waitingRequest, ok := schd.actorsWaitingForService[containerReq.actor]
+	if !ok || waitingRequest.containerReq != containerReq {
+		// the request is served as soon as it is made
+		return
+	}
+	delete(schd.actorsWaitingForService, containerReq.actor)
+	schd.cancelTimeout(waitingRequest)
+
+	kind := "got from container after waiting"
+	if containerReq.put {
+		kind = "put in container after waiting"
+	}
+	ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, kind)
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = waitingRequest.envelope
+}
+
+func storeID(reqType *RequestType) string {
+	if put := reqType.PutStore; put != nil {
+		return put.StoreID
+	}
+	return reqType.GetStore.StoreID
+}
+
+func (schd *localScheduler) handleRequestTypeStore(envelope *chanReq) {
+	req := envelope.req
+	verb := "got from store"
+	if req.Type.PutStore != nil {
+		verb = "put in store"
+	}
+	// lookup the store
+	id := storeID(req.Type)
+	rsc, ok := schd.resources[id]
+	if !ok {
+		schd.fail(fmt.Errorf("%w: actor %q can't use %q", ErrUnknownResource, req.Actor, id))
+		return
+	}
+	st, ok := rsc.(Store)
+	if !ok {
+		schd.fail(fmt.Errorf("%w: actor %q can't use %q as a store", ErrWrongResourceKind, req.Actor, id))
+		return
+	}
+	if get := req.Type.GetStore; get != nil && get.Filter != nil && !st.filters() {
+		schd.fail(fmt.Errorf("%w: actor %q can't filter the items of %q", ErrWrongResourceKind, req.Actor, id))
+		return
+	}
+
+	// schedule an immediate event, the items only change when it occurs
+	ev := schd.newEvent(req, schd.currentTime, verb+" immediately")
+	ev.effect, ev.req = storeEffect, req
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+// requestStore puts in or gets from a store when the event of the request
+// occurs, or has the actor wait in line.
+func (schd *localScheduler) requestStore(ev *Event) {
+	var (
+		req      = ev.req
+		put      = req.Type.PutStore != nil
+		st       = schd.resources[storeID(req.Type)].(Store)
+		storeReq = &storeRequest{put: put, actor: req.Actor}
+	)
+	if put {
+		storeReq.item = req.Type.PutStore.Item
+	} else {
+		storeReq.match = req.Type.GetStore.Filter
+	}
+	st.request(storeReq, schd.currentTime, schd.wakeStoreWaiter)
+	if storeReq.served {
+		ev.Item = storeReq.item
+		return
+	}
+	// wait in line instead
+	envelope := schd.pendingResponse[ev.ID]
+	delete(schd.pendingResponse, ev.ID)
+	waiting := &waitingRequest{envelope: envelope, storeReq: storeReq}
+	if put {
+		ev.Kind = "waiting for room in store"
+		// there's no timeout, keep the response pending on an event
+		// that never occurs
+		waiting.timeout = schd.newTimer(schd.newEvent(req, schd.currentTime, "waited for room in store"))
+	} else {
+		ev.Kind = "waiting for item in store"
+		timeoutEvent := schd.newEvent(req, schd.currentTime.Add(req.Type.GetStore.Timeout), "timed out waiting for store")
+		timeoutEvent.Timedout = true
+		waiting.timeout = schd.startTimer(timeoutEvent)
+	}
+	schd.pendingResponse[waiting.timeout.ev.ID] = envelope
+	schd.actorsWaitingForService[req.Actor] = waiting
+}
+
+// wakeStoreWaiter wakes up an actor whose request to a store was served
+// after waiting in line.
+func (schd *localScheduler) wakeStoreWaiter(storeReq *storeRequest) {
+	waitingRequest, ok := schd.actorsWaitingForService[storeReq.actor]
+	if !ok || waitingRequest.storeReq != storeReq {
+		// the request is served as soon as it is made
+		return
+	}
+	delete(schd.actorsWaitingForService, storeReq.actor)
+	schd.cancelTimeout(waitingRequest)
+
+	kind := "got from store after waiting"
+	if storeReq.put {
+		kind = "put in store after waiting"
+	}
+	ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, kind)
+	if !storeReq.put {
+		ev.Item = storeReq.item
+	}
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = waitingRequest.envelope
+}
+
+func (schd *localScheduler) handleRequestTypeSendMessage(envelope *chanReq) {
+	req := envelope.req
+	send := req.Type.SendMessage
+	msg := &Message{
+		From:    req.Actor,
+		To:      send.To,
+		SentAt:  schd.currentTime,
+		Payload: send.Payload,
+	}
+	// schedule an event in the future to deliver the message
+	ev := schd.newEvent(req, schd.currentTime.Add(req.AsyncDelay), "delivered message")
+	ev.Message = msg
+	if schd.forward == nil || !schd.forward(send.To, ev) {
+		// put the message in the mailbox when the event occurs
+		ev.effect, ev.req = deliverEffect, req
+		schd.events.Push(ev)
+	}
+	// return control immediately
+	envelope.res <- &chanRes{
+		res: &Response{Now: schd.currentTime},
+	}
+}
+
+func (schd *localScheduler) deliverMessage(msg *Message) {
+	waitingRequest, ok := schd.actorsWaitingForService[msg.To]
+	if !ok || waitingRequest.envelope.req.Type.ReceiveMessage == nil {
+		// nobody is waiting, leave it in the mailbox
+		schd.mailboxes[msg.To] = append(schd.mailboxes[msg.To], msg)
+		return
+	}
+	// remove actor from the waiting list
+	delete(schd.actorsWaitingForService, msg.To)
+	schd.cancelTimeout(waitingRequest)
+
+	// schedule an immediate event to wake up the actor
+	// with its message
+	ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, "received message after waiting")
+	ev.Message = msg
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = waitingRequest.envelope
+}
+
+func (schd *localScheduler) handleRequestTypeReceiveMessage(envelope *chanReq) {
+	req := envelope.req
+	receive := req.Type.ReceiveMessage
+	actor := req.Actor
+
+	if mailbox := schd.mailboxes[actor]; len(mailbox) > 0 {
+		msg := mailbox[0]
+		mailbox[0] = nil
+		schd.mailboxes[actor] = mailbox[1:]
+		// schedule an immediate event
+		ev := schd.newEvent(req, schd.currentTime, "received message immediately")
+		ev.Message = msg
+		schd.events.Push(ev)
+		schd.pendingResponse[ev.ID] = envelope
+		return
+	}
+	// schedule a timeout
+	timeoutEvent := schd.newEvent(req, schd.currentTime.Add(receive.Timeout), "timed out waiting for message")
+	timeoutEvent.Timedout = true
+	deadline := schd.startTimer(timeoutEvent)
+	schd.pendingResponse[timeoutEvent.ID] = envelope
+
+	// keep the actor waiting until a message is delivered
+	schd.actorsWaitingForService[actor] = &waitingRequest{
+		envelope: envelope,
+		timeout:  deadline,
+		async:    false,
+	}
+}
+
+func (schd *localScheduler) handleRequestTypeInterrupt(envelope *chanReq) {
+	req := envelope.req
+	interrupt := req.Type.Interrupt
+	// schedule an immediate event to interrupt the other actor
+	ev := schd.newEvent(req, schd.currentTime, "interrupting actor")
+	ev.Interruption = &Interruption{By: req.Actor, Cause: interrupt.Cause}
+	// the other actor is only interrupted when the event occurs
+	ev.effect, ev.req = interruptEffect, req
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+func (schd *localScheduler) interruptActor(actor string, interruption *Interruption) {
+	waitingRequest, ok := schd.actorsWaitingForService[actor]
+	if !ok {
+		// actor isn't waiting on anything, nothing to interrupt
+		return
+	}
+	schd.stopWaiting(actor, waitingRequest, false)
+	schd.cancelTimeout(waitingRequest)
+
+	// schedule an immediate event to wake up the actor
+	ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, "interrupted")
+	ev.Interrupted = true
+	ev.Interruption = interruption
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = waitingRequest.envelope
+}
+
+// preemptActor interrupts the sleep of an actor whose reservation was
+// evicted, telling it how much longer it had to sleep.
+func (schd *localScheduler) preemptActor(actor, by, resourceID string) {
+	waitingRequest, ok := schd.actorsWaitingForService[actor]
+	if !ok || waitingRequest.envelope.req.Type.Delay == nil {
+		// only a sleeping actor is using the resource, others will
+		// find out when they release it
+		return
+	}
+	schd.interruptActor(actor, &Interruption{
+		By:        by,
+		Cause:     CausePreempted,
+		Resource:  resourceID,
+		Remaining: waitingRequest.timeout.When().Sub(schd.currentTime),
+	})
+}
+
+func (schd *localScheduler) handleRequestTypeSpawn(envelope *chanReq) {
+	req := envelope.req
+	// schedule an immediate event to start the actor
+	ev := schd.newEvent(req, schd.currentTime, "spawned actor")
+	ev.effect, ev.req = spawnEffect, req
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+func (schd *localScheduler) handleRequestTypeJoin(envelope *chanReq) {
+	req := envelope.req
+	join := req.Type.Join
+	if schd.actorsDone[join.Actor] {
+		// schedule an immediate event
+		ev := schd.newEvent(req, schd.currentTime, "joined actor immediately")
+		schd.events.Push(ev)
+		schd.pendingResponse[ev.ID] = envelope
+		return
+	}
+	// schedule a timeout
+	timeoutEvent := schd.newEvent(req, schd.currentTime.Add(join.Timeout), "timed out waiting for actor")
+	timeoutEvent.Timedout = true
+	deadline := schd.startTimer(timeoutEvent)
+	schd.pendingResponse[timeoutEvent.ID] = envelope
+
+	// keep the actor waiting until the other actor is done
+	schd.actorsWaitingForService[req.Actor] = &waitingRequest{
+		envelope: envelope,
+		timeout:  deadline,
+		async:    false,
+	}
+	schd.waitsChanged = true
+}
+
+func (schd *localScheduler) wakeJoiners(doneActor string) {
+	var joiners []string
+	for actor, waitingRequest := range schd.actorsWaitingForService {
+		if join := waitingRequest.envelope.req.Type.Join; join != nil && join.Actor == doneActor {
+			joiners = append(joiners, actor)
+		}
+	}
+	// wake them up in a predictable order
+	sort.Strings(joiners)
+	for _, actor := range joiners {
+		waitingRequest := schd.actorsWaitingForService[actor]
+		schd.stopWaiting(actor, waitingRequest, false)
+		schd.cancelTimeout(waitingRequest)
+
+		// schedule an immediate event to wake up the actor
+		ev := schd.newEvent(waitingRequest.envelope.req, schd.currentTime, "joined actor after waiting")
+		schd.events.Push(ev)
+		schd.pendingResponse[ev.ID] = waitingRequest.envelope
+	}
+}
+
+func (schd *localScheduler) handleRequestTypePanic(envelope *chanReq) {
+	req := envelope.req
+	panicked := req.Type.Panic
+	schd.fail(&ActorPanicError{
+		Actor: req.Actor,
+		Time:  panicked.Time,
+		Value: panicked.Value,
+		Stack: panicked.Stack,
+	})
+}
+
+// clockTimer identifies a timer of the clock of an actor.
+type clockTimer struct {
+	actor string
+	id    int
+}
+
+func (schd *localScheduler) handleRequestTypeSetTimer(envelope *chanReq) {
+	req := envelope.req
+	set := req.Type.SetTimer
+	key := clockTimer{actor: req.Actor, id: set.Timer}
+	if t, ok := schd.clockTimers[key]; ok {
+		t.Reset(set.At)
+	} else {
+		ev := schd.newEvent(req, set.At, "timer fired")
+		ev.effect, ev.req = timerEffect, req
+		schd.clockTimers[key] = schd.startTimer(ev)
+	}
+
+	// schedule an immediate event
+	ev := schd.newEvent(req, schd.currentTime, "set a timer")
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+func (schd *localScheduler) handleRequestTypeStopTimer(envelope *chanReq) {
+	req := envelope.req
+	key := clockTimer{actor: req.Actor, id: req.Type.StopTimer.Timer}
+	if t, ok := schd.clockTimers[key]; ok {
+		t.Stop()
+		delete(schd.clockTimers, key)
+	}
+
+	// schedule an immediate event
+	ev := schd.newEvent(req, schd.currentTime, "stopped a timer")
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+func (schd *localScheduler) handleRequestTypeWaitTimer(envelope *chanReq) {
+	req := envelope.req
+	key := clockTimer{actor: req.Actor, id: req.Type.WaitTimer.Timer}
+	if t, ok := schd.clockTimers[key]; ok {
+		// the timer answers the actor when it fires
+		schd.pendingResponse[t.ev.ID] = envelope
+		return
+	}
+	// schedule an immediate event
+	ev := schd.newEvent(req, schd.currentTime, "timer already fired")
+	schd.events.Push(ev)
+	schd.pendingResponse[ev.ID] = envelope
+}
+
+// An effect is what an event does to a localScheduler when it happens.
+// Unlike a closure, it can be saved in a checkpoint.
+type effect uint8
+
+const (
+	noEffect effect = iota
+	// preemptEffect tells the actors evicted by a reservation
+	preemptEffect
+	// releaseEffect releases one or several reservations
+	releaseEffect
+	// containerEffect and storeEffect put in or get from a container or
+	// a store
+	containerEffect
+	storeEffect
+	// deliverEffect puts a message in a mailbox
+	deliverEffect
+	// interruptEffect interrupts another actor
+	interruptEffect
+	// spawnEffect starts waiting on a new actor
+	spawnEffect
+	// timerEffect fires a timer of the clock of an actor
+	timerEffect
+)
+
+// perform the effect of an event.
+func (schd *localScheduler) perform(ev *Event) {
+	req := ev.req
+	switch ev.effect {
+	case preemptEffect:
+		for _, actor := range ev.evicted {
+			schd.preemptActor(actor, req.Actor, req.Type.AcquireResource.ResourceID)
+		}
+	case releaseEffect:
+		if release := req.Type.ReleaseResource; release != nil {
+			resource := schd.resources[release.ResourceID].(slotResource)
+			schd.releaseResource(resource, reservationKey(release.ReservationKey), req.Actor)
+			return
+		}
+		release := req.Type.ReleaseResources
+		for i, id := range release.ResourceIDs {
+			resource := schd.resources[id].(slotResource)
+			schd.releaseResource(resource, reservationKey(release.ReservationKeys[i]), req.Actor)
+		}
+	case containerEffect:
+		schd.requestContainer(ev)
+	case storeEffect:
+		schd.requestStore(ev)
+	case deliverEffect:
+		schd.deliverMessage(ev.Message)
+	case interruptEffect:
+		schd.interruptActor(req.Type.Interrupt.Actor, ev.Interruption)
+	case spawnEffect:
+		// every running actor made a request by now
+		name := req.Type.Spawn.Actor
+		if schd.actorNames[name] {
+			schd.fail(fmt.Errorf("%w: actor %q spawned %q", ErrDuplicateActor, req.Actor, name))
+			return
+		}
+		schd.actorNames[name] = true
+		// from now on, wait for the new actor to make its actions too
+		schd.actorsRunning++
+	case timerEffect:
+		key := clockTimer{actor: req.Actor, id: req.Type.SetTimer.Timer}
+		if t, ok := schd.clockTimers[key]; ok && t.ev == ev {
+			delete(schd.clockTimers, key)
+		}
+	}
+}
+
 type chanReq struct {
 	req *Request
 	res chan *chanRes
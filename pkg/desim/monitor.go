@@ -0,0 +1,243 @@
+package desim
+
+import (
+	"sort"
+	"time"
+)
+
+// ResourceStats are gathered on a resource while a simulation runs.
+type ResourceStats struct {
+	Name string
+	// Capacity is the number of slots at the end of the simulation.
+	Capacity int
+
+	// Utilization is the time-weighted average of the fraction of the
+	// capacity that was in use.
+	Utilization float64
+	// AvgQueueLength is the time-weighted average of the number of
+	// reservations waiting in line.
+	AvgQueueLength float64
+	MaxQueueLength int
+	// Wait sums up how long acquisitions waited for the resource.
+	Wait WaitStats
+	// QueueLength records the number of reservations waiting in line
+	// each time it changed, if the simulation keeps samples.
+	QueueLength []Sample
+	// Waits records how long each acquisition waited for the resource,
+	// if the simulation keeps samples.
+	Waits []time.Duration
+
+	Acquisitions int
+	Releases     int
+	Timeouts     int
+	// Preemptions counts the reservations that were evicted by a
+	// reservation of higher priority.
+	Preemptions int
+	// Throughput is the number of releases per second of simulated time.
+	Throughput float64
+}
+
+// A Sample is the value of a quantity at some point in time.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// WaitStats sum up durations as they are recorded, in constant memory.
+type WaitStats struct {
+	Count int
+	Total time.Duration
+	Min   time.Duration
+	Max   time.Duration
+}
+
+// Mean is the average duration.
+func (stats WaitStats) Mean() time.Duration {
+	if stats.Count == 0 {
+		return 0
+	}
+	return stats.Total / time.Duration(stats.Count)
+}
+
+func (stats *WaitStats) add(wait time.Duration) {
+	if stats.Count == 0 || wait < stats.Min {
+		stats.Min = wait
+	}
+	if wait > stats.Max {
+		stats.Max = wait
+	}
+	stats.Count++
+	stats.Total += wait
+}
+
+// WithSamples keeps every sample of the statistics of the resources,
+// containers and stores, like each wait and each change of the length of
+// their lines, on top of the sums kept in constant memory. They grow with
+// the number of events.
+func WithSamples() Option {
+	return func(sim *sim) { sim.samples = true }
+}
+
+// MeanWait is the average time acquisitions waited for the resource.
+func (stats *ResourceStats) MeanWait() time.Duration { return stats.Wait.Mean() }
+
+// WaitQuantile returns the q-th quantile of the time acquisitions waited
+// for the resource, with 0 <= q <= 1. It needs the samples, it's 0 if the
+// simulation doesn't keep them.
+func (stats *ResourceStats) WaitQuantile(q float64) time.Duration {
+	if len(stats.Waits) == 0 {
+		return 0
+	}
+	waits := append([]time.Duration(nil), stats.Waits...)
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	i := int(q * float64(len(waits)-1))
+	return waits[i]
+}
+
+// resourceMonitor keeps time-weighted statistics about the use of
+// a resource.
+type resourceMonitor struct {
+	stats ResourceStats
+
+	start, last time.Time
+	inUse       int
+	queued      int
+	busyArea    float64
+	queueArea   float64
+	// resizedArea is the capacity over time until it last changed, at
+	// resizedAt
+	resizedArea float64
+	resizedAt   time.Time
+	// samples is true if the samples of the statistics are kept
+	samples bool
+}
+
+func (mon *resourceMonitor) begin(name string, capacity int, now time.Time) {
+	*mon = resourceMonitor{
+		stats:     ResourceStats{Name: name, Capacity: capacity},
+		start:     now,
+		last:      now,
+		resizedAt: now,
+		samples:   mon.samples,
+	}
+}
+
+// advance accumulates the areas under the usage curves up to now.
+func (mon *resourceMonitor) advance(now time.Time) {
+	if mon.last.IsZero() {
+		mon.start, mon.last = now, now
+	}
+	elapsed := now.Sub(mon.last).Seconds()
+	if elapsed > 0 {
+		mon.busyArea += float64(mon.inUse) * elapsed
+		mon.queueArea += float64(mon.queued) * elapsed
+		mon.last = now
+	}
+}
+
+func (mon *resourceMonitor) setQueued(now time.Time, queued int) {
+	mon.queued = queued
+	if queued > mon.stats.MaxQueueLength {
+		mon.stats.MaxQueueLength = queued
+	}
+	if mon.samples {
+		mon.stats.QueueLength = append(mon.stats.QueueLength, Sample{Time: now, Value: float64(queued)})
+	}
+}
+
+func (mon *resourceMonitor) acquired(now, requestedAt time.Time, units int) {
+	mon.advance(now)
+	mon.inUse += units
+	mon.stats.Acquisitions++
+	mon.stats.Wait.add(now.Sub(requestedAt))
+	if mon.samples {
+		mon.stats.Waits = append(mon.stats.Waits, now.Sub(requestedAt))
+	}
+}
+
+func (mon *resourceMonitor) enqueued(now time.Time) {
+	mon.advance(now)
+	mon.setQueued(now, mon.queued+1)
+}
+
+func (mon *resourceMonitor) dequeued(now time.Time) {
+	mon.advance(now)
+	mon.setQueued(now, mon.queued-1)
+}
+
+func (mon *resourceMonitor) timedout() {
+	mon.stats.Timeouts++
+}
+
+func (mon *resourceMonitor) released(now time.Time, units int) {
+	mon.advance(now)
+	mon.inUse -= units
+	mon.stats.Releases++
+}
+
+func (mon *resourceMonitor) preempted(now time.Time, units int) {
+	mon.advance(now)
+	mon.inUse -= units
+	mon.stats.Preemptions++
+}
+
+func (mon *resourceMonitor) resized(now time.Time, capacity int) {
+	mon.advance(now)
+	mon.resizedArea += float64(mon.stats.Capacity) * now.Sub(mon.resizedAt).Seconds()
+	mon.resizedAt = now
+	mon.stats.Capacity = capacity
+}
+
+// end stops the observation and computes the averages.
+func (mon *resourceMonitor) end(now time.Time) {
+	mon.advance(now)
+	elapsed := mon.last.Sub(mon.start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	if mon.resizedArea > 0 {
+		capacityArea := mon.resizedArea + float64(mon.stats.Capacity)*mon.last.Sub(mon.resizedAt).Seconds()
+		mon.stats.Utilization = mon.busyArea / capacityArea
+	} else if mon.stats.Capacity > 0 {
+		mon.stats.Utilization = mon.busyArea / (float64(mon.stats.Capacity) * elapsed)
+	}
+	mon.stats.AvgQueueLength = mon.queueArea / elapsed
+	mon.stats.Throughput = float64(mon.stats.Releases) / elapsed
+}
+
+// savedResourceMonitor is a resourceMonitor in a checkpoint.
+type savedResourceMonitor struct {
+	Stats                            ResourceStats
+	Start, Last, ResizedAt           time.Time
+	InUse, Queued                    int
+	BusyArea, QueueArea, ResizedArea float64
+}
+
+func (mon *resourceMonitor) save() savedResourceMonitor {
+	return savedResourceMonitor{
+		Stats:       mon.stats,
+		Start:       mon.start,
+		Last:        mon.last,
+		ResizedAt:   mon.resizedAt,
+		InUse:       mon.inUse,
+		Queued:      mon.queued,
+		BusyArea:    mon.busyArea,
+		QueueArea:   mon.queueArea,
+		ResizedArea: mon.resizedArea,
+	}
+}
+
+func (mon *resourceMonitor) restore(saved savedResourceMonitor) {
+	*mon = resourceMonitor{
+		stats:       saved.Stats,
+		start:       saved.Start,
+		last:        saved.Last,
+		resizedAt:   saved.ResizedAt,
+		inUse:       saved.InUse,
+		queued:      saved.Queued,
+		busyArea:    saved.BusyArea,
+		queueArea:   saved.QueueArea,
+		resizedArea: saved.ResizedArea,
+		samples:     mon.samples,
+	}
+}
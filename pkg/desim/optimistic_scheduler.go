@@ -0,0 +1,984 @@
+package desim
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewOptimisticScheduler makes a parallel scheduler, after Jefferson's Time
+// Warp. Each logical process of the partition performs its events on a
+// goroutine of its own, without waiting for the messages that other
+// processes may still send it. When one of them comes before events the
+// process already performed, the process rolls back: it cancels the
+// messages it sent since with anti-messages, and goes on again from the
+// latest state it saved before the message. It doesn't record the events
+// it performs again, nor send their messages twice. Events are committed
+// to the history once they come before the global virtual time, before
+// which no process can roll back anymore. The history is the same as with
+// NewLocalScheduler.
+//
+// A process saves its state in memory, like a checkpoint, every hundred
+// events or more, the more actors and events it has. Its actors are saved
+// as they were when the calls to their action they were in started, and
+// go on from there when the process rolls back. A process forgets the
+// saves before the latest one before the global virtual time, and the
+// messages it received that were delivered before it.
+//
+// Processes only perform the events less than window ahead of the global
+// virtual time, or as far ahead as they can if it's 0. The further they
+// run, the more they may have to perform again: they never roll back if
+// no message between processes takes less than the window.
+//
+// Actors must do the same every time they run, given the same responses:
+// their state is restored by their Snapshotter, or they keep none between
+// the calls to their action. What they do outside of the Env, like
+// logging, happens again. Actors of different processes can only
+// exchange messages, which must take some time to arrive, but they need
+// no lookahead. The payloads of the messages are kept in memory, they
+// aren't encoded.
+//
+// Options that change how events are performed, like pacing, deadlock
+// detection or other event lists, aren't supported. An actor that aborts
+// ends the simulation right after its abort event, the processes that ran
+// ahead of it may have used their resources further.
+func NewOptimisticScheduler(partition Partition, window time.Duration) SchedulerFn {
+	return func(actorCount int, resources []Resource) (Scheduler, SchedulerClient) {
+		if partition.Processes < 1 {
+			partition.Processes = 1
+		}
+		schd := &optimisticScheduler{
+			partition: partition,
+			window:    window,
+			resources: resources,
+			processOf: make(map[string]int),
+			over:      make(chan struct{}),
+			stopped:   make(chan struct{}),
+			aborted:   make(chan struct{}),
+			merge:     make(chan struct{}, 1),
+		}
+		return schd, schd
+	}
+}
+
+var (
+	_ Scheduler           = (*optimisticScheduler)(nil)
+	_ SchedulerClient     = (*optimisticScheduler)(nil)
+	_ leakReporter        = (*optimisticScheduler)(nil)
+	_ restartingScheduler = (*optimisticScheduler)(nil)
+	_ actorGroup          = (*incarnation)(nil)
+)
+
+type optimisticScheduler struct {
+	partition Partition
+	window    time.Duration
+	resources []Resource
+
+	// actors are the names of the actors, startActor starts one of them
+	actors     []string
+	startActor func(actor int, client SchedulerClient) error
+	// saveActors adds the actors of a process to a save, resumeActors
+	// resumes them from it
+	saveActors   func(cp *Checkpoint) error
+	resumeActors func(cp *Checkpoint, client SchedulerClient) error
+
+	mu sync.RWMutex
+	// processOf is the process of each actor
+	processOf map[string]int
+	// resourceOf is the process of each resource
+	resourceOf map[string]int
+	processes  []*optimisticProcess
+
+	ctx        context.Context
+	start, end time.Time
+
+	// gvtMu is held to find the global virtual time, messages aren't sent
+	// nor received meanwhile
+	gvtMu sync.RWMutex
+	// gvt is the global virtual time, in nanoseconds: no process will
+	// perform events or roll back before it
+	gvt int64
+	// over is closed once the global virtual time is past the end
+	over chan struct{}
+
+	errMu sync.Mutex
+	err   error
+	// stopped is closed when the simulation fails
+	stopped chan struct{}
+	// aborted is closed when an abort event at abortedAt is committed
+	abortOnce sync.Once
+	aborted   chan struct{}
+	abortedAt time.Time
+
+	// merge wakes up the goroutine that finds the global virtual time and
+	// commits the events before it
+	merge chan struct{}
+}
+
+func (schd *optimisticScheduler) startActorsWith(actors []string, start func(actor int, client SchedulerClient) error) {
+	schd.actors, schd.startActor = actors, start
+}
+
+func (schd *optimisticScheduler) resumeActorsWith(save func(cp *Checkpoint) error, resume func(cp *Checkpoint, client SchedulerClient) error) {
+	schd.saveActors, schd.resumeActors = save, resume
+}
+
+// Schedule serves the actors that the scheduler didn't start, it can't
+// start them again.
+func (schd *optimisticScheduler) Schedule(req *Request) *Response {
+	schd.fail(fmt.Errorf("actor %q wasn't started by the scheduler, it can't run again", req.Actor))
+	return &Response{Done: true}
+}
+
+// lookup finds the process of an actor, which may not have been spawned
+// yet.
+func (schd *optimisticScheduler) lookup(actor string) int {
+	schd.mu.RLock()
+	process, ok := schd.processOf[actor]
+	schd.mu.RUnlock()
+	if ok {
+		return process
+	}
+	return schd.partition.actor(actor)
+}
+
+func (schd *optimisticScheduler) Run(ctx context.Context, r *rand.Rand, start, end time.Time, sink EventSink) error {
+	schd.ctx, schd.start, schd.end = ctx, start, end
+	schd.gvt = start.UnixNano()
+	if err := schd.setup(); err != nil {
+		return err
+	}
+
+	merged := make(chan struct{})
+	processesDone := make(chan struct{})
+	go func() {
+		defer close(merged)
+		schd.mergeHistories(sink, processesDone)
+	}()
+
+	var wg sync.WaitGroup
+	for _, lp := range schd.processes {
+		wg.Add(1)
+		go func(lp *optimisticProcess) {
+			defer wg.Done()
+			lp.run()
+		}(lp)
+	}
+	wg.Wait()
+
+	locals := schd.locals()
+	select {
+	case <-schd.aborted:
+		// nothing happens after the abort
+		for _, local := range locals {
+			local.stoppedAt = schd.abortedAt
+			local.finish()
+		}
+	default:
+		finishTogether(end, locals)
+	}
+	close(processesDone)
+	<-merged
+
+	return schd.failed()
+}
+
+// setup makes the processes, with the actors and resources of each.
+func (schd *optimisticScheduler) setup() error {
+	schd.mu.Lock()
+	defer schd.mu.Unlock()
+	n := schd.partition.Processes
+	schd.processes = make([]*optimisticProcess, n)
+	for i := range schd.processes {
+		schd.processes[i] = &optimisticProcess{
+			index:    i,
+			parent:   schd,
+			clock:    schd.start.UnixNano(),
+			wake:     make(chan struct{}, 1),
+			received: make(map[int]*Event),
+			sentBy:   make(map[string]int),
+		}
+	}
+	schd.resourceOf = make(map[string]int, len(schd.resources))
+	for _, res := range schd.resources {
+		process := schd.partition.resource(res.id())
+		if process < 0 || process >= n {
+			return fmt.Errorf("resource %q is in process %d of a partition of %d processes", res.id(), process, n)
+		}
+		lp := schd.processes[process]
+		lp.ownResources = append(lp.ownResources, res)
+		schd.resourceOf[res.id()] = process
+	}
+	for i, actor := range schd.actors {
+		process := schd.partition.actor(actor)
+		if process < 0 || process >= n {
+			return fmt.Errorf("actor %q is in process %d of a partition of %d processes", actor, process, n)
+		}
+		lp := schd.processes[process]
+		lp.actors = append(lp.actors, i)
+		schd.processOf[actor] = process
+	}
+	return nil
+}
+
+func (schd *optimisticScheduler) locals() []*localScheduler {
+	locals := make([]*localScheduler, 0, len(schd.processes))
+	for _, lp := range schd.processes {
+		locals = append(locals, lp.localScheduler)
+	}
+	return locals
+}
+
+func (schd *optimisticScheduler) leaks() []*Leak { return mergeLeaks(schd.locals()) }
+
+// fail stops every process, only the first error is kept.
+func (schd *optimisticScheduler) fail(err error) {
+	schd.errMu.Lock()
+	defer schd.errMu.Unlock()
+	if schd.err == nil {
+		schd.err = err
+		close(schd.stopped)
+	}
+}
+
+func (schd *optimisticScheduler) failed() error {
+	schd.errMu.Lock()
+	defer schd.errMu.Unlock()
+	return schd.err
+}
+
+// abort stops every process, an actor aborted the simulation.
+func (schd *optimisticScheduler) abort(at time.Time) {
+	schd.abortOnce.Do(func() {
+		schd.abortedAt = at
+		close(schd.aborted)
+	})
+}
+
+func (schd *optimisticScheduler) wakeMerger() {
+	select {
+	case schd.merge <- struct{}{}:
+	default:
+	}
+}
+
+// globalVirtualTime is the earliest time at which a process may still
+// perform an event or roll back: the earliest of the clocks of the
+// processes and of the messages in their inboxes.
+func (schd *optimisticScheduler) globalVirtualTime() int64 {
+	schd.gvtMu.Lock()
+	defer schd.gvtMu.Unlock()
+	gvt := int64(never)
+	for _, lp := range schd.processes {
+		if clock := atomic.LoadInt64(&lp.clock); clock < gvt {
+			gvt = clock
+		}
+		lp.inboxMu.Lock()
+		for _, msg := range lp.inbox {
+			if at := msg.ev.Time.UnixNano(); at < gvt {
+				gvt = at
+			}
+		}
+		lp.inboxMu.Unlock()
+	}
+	return gvt
+}
+
+// mergeHistories finds the global virtual time whenever a process moves
+// on, and hands the events before it to the sink, in the order
+// NewLocalScheduler would have performed them: the next event of the
+// history is the first of the next events of the processes. Once the
+// global virtual time is past the end, the simulation is over.
+func (schd *optimisticScheduler) mergeHistories(sink EventSink, processesDone chan struct{}) {
+	var (
+		sinkErr error
+		isOver  bool
+		// ended is true once the abort event was committed
+		ended bool
+	)
+	for {
+		done := false
+		gvt := int64(never)
+		select {
+		case <-schd.merge:
+			gvt = schd.globalVirtualTime()
+			if gvt > atomic.LoadInt64(&schd.gvt) {
+				atomic.StoreInt64(&schd.gvt, gvt)
+				for _, lp := range schd.processes {
+					lp.signal()
+				}
+			}
+			if !isOver && (gvt == never || !schd.end.IsZero() && gvt > schd.end.UnixNano()) {
+				isOver = true
+				close(schd.over)
+			}
+		case <-processesDone:
+			done = true
+		}
+		for {
+			var (
+				next   *Event
+				nextOf *optimisticProcess
+			)
+			for _, lp := range schd.processes {
+				lp.historyMu.Lock()
+				if len(lp.history) > 0 && (next == nil || lp.history[0].Before(next)) {
+					next, nextOf = lp.history[0], lp
+				}
+				lp.historyMu.Unlock()
+			}
+			if next == nil || next.Time.UnixNano() >= gvt {
+				break
+			}
+			nextOf.historyMu.Lock()
+			nextOf.history[0] = nil
+			nextOf.history = nextOf.history[1:]
+			nextOf.committed++
+			nextOf.historyMu.Unlock()
+			if ended {
+				continue
+			}
+			if next.Signals.Has(SignalAbort) {
+				ended = true
+				schd.abort(next.Time)
+			}
+			if sinkErr == nil {
+				if sinkErr = sink.Handle(next); sinkErr != nil {
+					schd.fail(sinkErr)
+				}
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// An optimisticProcess performs the events of some actors and resources,
+// as if no message could come from the other processes in its past, and
+// rolls back when one does.
+type optimisticProcess struct {
+	*incarnation
+	index  int
+	parent *optimisticScheduler
+	// actors are the indexes of the actors that start in the process,
+	// ownResources are the resources only they use
+	actors       []int
+	ownResources []Resource
+	// clock is a time, in nanoseconds, before any event the process will
+	// perform or roll back to, but for the messages in its inbox
+	clock int64
+	// wake is signaled when the process may be able to go on
+	wake chan struct{}
+
+	inboxMu sync.Mutex
+	// inbox are the messages sent by the other processes, and their
+	// cancellations
+	inbox []processMessage
+
+	// received are the deliveries of the messages sent by the other
+	// processes that weren't cancelled, by ID, and queued are their
+	// copies in the event list of the incarnation
+	received map[int]*Event
+	queued   map[int]*Event
+
+	historyMu sync.Mutex
+	// history are the events performed, until they are committed
+	history   []*Event
+	committed int
+	// known counts the events committed and in the history, performed
+	// counts the events the incarnation performed: it performs again
+	// those it didn't get to, without recording them
+	known, performed int
+	// latest is the last event of the history in the order of
+	// Event.Before, the events performed aren't always in that order
+	latest *Event
+	// floor is a time, in nanoseconds, before any event the incarnation
+	// will perform that isn't known yet
+	floor int64
+
+	// saves are the states of the process it may roll back to, the first
+	// one performed no more events than were committed
+	saves []*processSave
+
+	// sent are the messages sent to other processes that may still be
+	// cancelled. sentBy counts the messages each actor sent and that
+	// weren't cancelled, resentBy those it sent until the events the
+	// incarnation performed, from the start or from its save: the actors
+	// of a process make their requests in any order, but each one makes
+	// them in the same order.
+	sent     []sentMessage
+	sentBy   map[string]int
+	resentBy map[string]int
+}
+
+// An incarnation is the scheduler of a process since it last started.
+type incarnation struct {
+	*localScheduler
+	// goroutines are those of the actors making requests to it
+	goroutines sync.WaitGroup
+}
+
+func (inc *incarnation) actorStarted() { inc.goroutines.Add(1) }
+func (inc *incarnation) actorExited()  { inc.goroutines.Done() }
+
+// discard releases the actors of an incarnation that won't go on, and
+// waits for them to exit.
+func (inc *incarnation) discard() {
+	inc.abortMu.Lock()
+	if inc.abortRes == nil {
+		inc.abortRes = &Response{Now: inc.currentTime, Done: true}
+	}
+	inc.abortMu.Unlock()
+	close(inc.done)
+	inc.goroutines.Wait()
+}
+
+// saveEvery is the fewest events a process performs between two saves.
+// It performs more if it has more actors and events to save, so that
+// saving takes about as long as performing them.
+const saveEvery = 100
+
+// A processSave is the state of a process before it performed an event,
+// kept in memory.
+type processSave struct {
+	performed int
+	state     *schedulerState
+	actors    *Checkpoint
+	// queued are the messages sent by the other processes that were still
+	// to be delivered, delivered those that were delivered already
+	queued, delivered map[int]bool
+	// sentBy counts the messages each actor sent to other processes until
+	// the save
+	sentBy map[string]int
+}
+
+// A processMessage is the delivery of a message sent by another process,
+// or its cancellation.
+type processMessage struct {
+	ev   *Event
+	anti bool
+}
+
+// A sentMessage is a message sent to another process, after the process
+// performed some of its events.
+type sentMessage struct {
+	to    *optimisticProcess
+	ev    *Event
+	after int
+}
+
+// optimisticSink records the history of a process. The events performed
+// again after a rollback were recorded the first time.
+type optimisticSink optimisticProcess
+
+func (sink *optimisticSink) Handle(ev *Event) error {
+	lp := (*optimisticProcess)(sink)
+	i := lp.performed
+	lp.performed++
+	lp.historyMu.Lock()
+	defer lp.historyMu.Unlock()
+	if i < lp.known {
+		if i >= lp.committed {
+			if was := lp.history[i-lp.committed]; was.Actor != ev.Actor || was.Kind != ev.Kind || !was.Time.Equal(ev.Time) {
+				return fmt.Errorf("%w: actor %q performed %q at %v, instead of %q of %q at %v", ErrNotDeterministic, ev.Actor, ev.Kind, ev.Time, was.Kind, was.Actor, was.Time)
+			}
+		}
+		return nil
+	}
+	lp.history = append(lp.history, ev)
+	lp.known++
+	if lp.latest == nil || lp.latest.Before(ev) {
+		lp.latest = ev
+	}
+	return nil
+}
+
+func (lp *optimisticProcess) signal() {
+	select {
+	case lp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run performs the events of the process, once every one of its actors
+// waits on it.
+func (lp *optimisticProcess) run() {
+	parent := lp.parent
+	lp.restart(nil)
+	for {
+		for lp.err == nil && len(lp.pendingResponse) != lp.actorsRunning {
+			select {
+			case env := <-lp.queue:
+				lp.recvRequest(env)
+			case <-parent.stopped:
+				return
+			case <-parent.aborted:
+				return
+			case <-parent.ctx.Done():
+				parent.fail(parent.ctx.Err())
+				return
+			}
+		}
+		if !lp.advance() {
+			return
+		}
+	}
+}
+
+// advance performs the next event of the process, unless it's too far
+// ahead of the others. It returns false when the simulation is over.
+//
+// The incarnation may have failed, but a message may still come before
+// the failure and roll it back. The failure is only final once the global
+// virtual time gets to it.
+func (lp *optimisticProcess) advance() bool {
+	parent := lp.parent
+	for {
+		select {
+		case <-parent.aborted:
+			return false
+		default:
+		}
+		if lp.receive() {
+			// the actors start again
+			return true
+		}
+		lp.forget()
+
+		var next *Event
+		clock := int64(never)
+		if lp.err != nil {
+			clock = lp.currentTime.UnixNano()
+		} else if lp.events.Len() > 0 {
+			next = lp.events.Peek()
+			clock = next.Time.UnixNano()
+		}
+		replaying := lp.performed < lp.known
+		if replaying && clock < lp.floor {
+			clock = lp.floor
+		}
+		lp.publish(clock)
+
+		gvt := atomic.LoadInt64(&parent.gvt)
+		switch {
+		case lp.err != nil:
+			if gvt >= clock {
+				parent.fail(lp.err)
+				return false
+			}
+		case next == nil:
+		case !lp.end.IsZero() && next.Time.After(lp.end):
+		case !replaying && parent.window > 0 && next.Time.UnixNano() >= addTime(gvt, parent.window):
+		default:
+			lp.saveState()
+			lp.step()
+			return true
+		}
+
+		// wait for a message, or for the others to catch up
+		select {
+		case <-lp.wake:
+		case <-parent.over:
+			if next != nil && !lp.end.IsZero() && next.Time.After(lp.end) {
+				lp.abortNow(next)
+				lp.stoppedAt = lp.end
+			}
+			return false
+		case <-parent.stopped:
+			return false
+		case <-parent.aborted:
+			return false
+		case <-parent.ctx.Done():
+			parent.fail(parent.ctx.Err())
+			return false
+		}
+	}
+}
+
+// receive applies the messages sent by the other processes, and their
+// cancellations. It rolls back if they come before events the process
+// performed, and returns true if the process started again.
+func (lp *optimisticProcess) receive() bool {
+	// the messages are taken out of the inbox and into the clock at once
+	lp.parent.gvtMu.RLock()
+	lp.inboxMu.Lock()
+	inbox := lp.inbox
+	lp.inbox = nil
+	lp.inboxMu.Unlock()
+	earliest := int64(never)
+	for _, msg := range inbox {
+		if at := msg.ev.Time.UnixNano(); at < earliest {
+			earliest = at
+		}
+	}
+	if earliest < atomic.LoadInt64(&lp.clock) {
+		atomic.StoreInt64(&lp.clock, earliest)
+	}
+	lp.parent.gvtMu.RUnlock()
+	if len(inbox) == 0 {
+		return false
+	}
+	if lp.performed < lp.known && earliest < lp.floor {
+		// the messages may come before the events it performs again
+		lp.floor = earliest
+	}
+
+	var (
+		rollbackTo = -1
+		rollbackAt = int64(never)
+	)
+	for _, msg := range inbox {
+		if msg.anti {
+			delete(lp.received, msg.ev.ID)
+		} else {
+			lp.received[msg.ev.ID] = msg.ev
+		}
+		if i, ok := lp.straggles(msg); ok {
+			if rollbackTo < 0 || i < rollbackTo {
+				rollbackTo = i
+			}
+			if at := msg.ev.Time.UnixNano(); at < rollbackAt {
+				rollbackAt = at
+			}
+		}
+	}
+	if rollbackTo >= 0 && lp.rollback(rollbackTo, rollbackAt) {
+		return true
+	}
+	for _, msg := range inbox {
+		if msg.anti {
+			if delivery, ok := lp.queued[msg.ev.ID]; ok {
+				lp.events.Remove(delivery)
+				delete(lp.queued, msg.ev.ID)
+			}
+		} else if _, ok := lp.received[msg.ev.ID]; ok {
+			lp.push(msg.ev)
+		}
+	}
+	return false
+}
+
+// straggles finds where a message should have been among the events the
+// process performed, if it comes before some of them. A cancelled message
+// is where it was performed.
+func (lp *optimisticProcess) straggles(msg processMessage) (int, bool) {
+	lp.historyMu.Lock()
+	defer lp.historyMu.Unlock()
+	if msg.anti {
+		for i, ev := range lp.history {
+			if ev.ID == msg.ev.ID {
+				return lp.committed + i, true
+			}
+		}
+		return 0, false
+	}
+	if lp.latest == nil || !msg.ev.Before(lp.latest) {
+		return 0, false
+	}
+	for i, ev := range lp.history {
+		if msg.ev.Before(ev) {
+			return lp.committed + i, true
+		}
+	}
+	return 0, false
+}
+
+// rollback forgets the events of the history from the i-th one, which
+// happen no earlier than at, and cancels the messages sent after them.
+// The process starts again if the incarnation performed them, and
+// rollback returns true.
+func (lp *optimisticProcess) rollback(i int, at int64) bool {
+	if lp.performed < lp.known {
+		// it's still performing known events again
+		if at < lp.floor {
+			lp.floor = at
+		}
+	} else {
+		lp.floor = at
+	}
+
+	// no event from the i-th one was committed: they come after messages
+	// that are still on their way
+	lp.historyMu.Lock()
+	keep := i - lp.committed
+	for j := keep; j < len(lp.history); j++ {
+		lp.history[j] = nil
+	}
+	lp.history = lp.history[:keep]
+	lp.latest = nil
+	for _, ev := range lp.history {
+		if lp.latest == nil || lp.latest.Before(ev) {
+			lp.latest = ev
+		}
+	}
+	lp.historyMu.Unlock()
+	lp.known = i
+
+	cut := len(lp.sent)
+	for cut > 0 && lp.sent[cut-1].after > i {
+		cut--
+	}
+	cancelled := lp.sent[cut:]
+	lp.parent.gvtMu.RLock()
+	for _, sent := range cancelled {
+		sent.to.deliver(processMessage{ev: sent.ev, anti: true})
+	}
+	lp.parent.gvtMu.RUnlock()
+	for j, sent := range cancelled {
+		sent.to.signal()
+		lp.sentBy[sent.ev.Actor]--
+		cancelled[j] = sentMessage{}
+	}
+	lp.sent = lp.sent[:cut]
+
+	if lp.performed <= i {
+		return false
+	}
+	// it goes on from the latest save before the i-th event
+	n := len(lp.saves)
+	for n > 0 && lp.saves[n-1].performed > i {
+		n--
+		lp.saves[n] = nil
+	}
+	lp.saves = lp.saves[:n]
+	if n == 0 {
+		lp.restart(nil)
+	} else {
+		lp.restart(lp.saves[n-1])
+	}
+	return true
+}
+
+// restart discards the incarnation of the process, if it has one, and
+// starts its actors again with a new one: from the start, or from a save.
+func (lp *optimisticProcess) restart(from *processSave) {
+	parent := lp.parent
+	inc := &incarnation{localScheduler: newLocalScheduler(len(lp.actors), lp.ownResources)}
+	// the events of each process have IDs of their own
+	eventID := lp.index * (math.MaxInt / len(parent.processes))
+	if lp.incarnation != nil {
+		lp.discard()
+		// the IDs of the events it performs again aren't the same, the
+		// actors may make their first requests in another order, but
+		// they're never those of earlier events
+		eventID = lp.eventID
+	}
+	inc.admit = lp.admitRequest
+	inc.forward = lp.forwardMessage
+	if from != nil {
+		inc.goOnFrom(from.state, nil)
+	}
+	inc.begin(parent.ctx, parent.start, parent.end, (*optimisticSink)(lp))
+	inc.eventID = eventID
+	lp.incarnation = inc
+	if lp.err != nil {
+		parent.fail(lp.err)
+		return
+	}
+
+	if from == nil {
+		lp.performed = 0
+		lp.resentBy = make(map[string]int)
+		lp.queued = make(map[int]*Event, len(lp.received))
+		for _, ev := range lp.received {
+			lp.push(ev)
+		}
+		for _, actor := range lp.actors {
+			if err := parent.startActor(actor, inc); err != nil {
+				parent.fail(err)
+				return
+			}
+		}
+		return
+	}
+
+	lp.performed = from.performed
+	lp.resentBy = make(map[string]int, len(from.sentBy))
+	for actor, n := range from.sentBy {
+		lp.resentBy[actor] = n
+	}
+	// the messages of the save that were cancelled since are dropped, those
+	// received since are delivered
+	lp.queued = make(map[int]*Event, len(from.queued))
+	events := make([]*Event, 0, lp.events.Len())
+	for lp.events.Len() > 0 {
+		events = append(events, lp.events.Pop())
+	}
+	for _, ev := range events {
+		if from.queued[ev.ID] {
+			if _, ok := lp.received[ev.ID]; !ok {
+				continue
+			}
+			lp.queued[ev.ID] = ev
+		}
+		lp.events.Push(ev)
+	}
+	for id, ev := range lp.received {
+		if !from.queued[id] && !from.delivered[id] {
+			lp.push(ev)
+		}
+	}
+	if err := parent.resumeActors(from.actors, inc); err != nil {
+		parent.fail(err)
+	}
+}
+
+// saveState saves the state of the process once it performed enough
+// events since the last save, while every actor waits on it.
+func (lp *optimisticProcess) saveState() {
+	every := saveEvery
+	if size := lp.actorsRunning + lp.events.Len(); size > every {
+		every = size
+	}
+	if n := len(lp.saves); n > 0 && lp.performed < lp.saves[n-1].performed+every {
+		return
+	}
+	state := lp.save()
+	actors := &Checkpoint{Actors: state.checkpointActors()}
+	if err := lp.parent.saveActors(actors); err != nil {
+		lp.parent.fail(err)
+		return
+	}
+	save := &processSave{
+		performed: lp.performed,
+		state:     state,
+		actors:    actors,
+		queued:    make(map[int]bool),
+		delivered: make(map[int]bool),
+		sentBy:    make(map[string]int, len(lp.resentBy)),
+	}
+	for _, ev := range state.Events {
+		if _, ok := lp.received[ev.Event.ID]; ok {
+			save.queued[ev.Event.ID] = true
+		}
+	}
+	for id := range lp.received {
+		if !save.queued[id] {
+			save.delivered[id] = true
+		}
+	}
+	// sentBy may count messages sent after the events performed again
+	for actor, n := range lp.resentBy {
+		save.sentBy[actor] = n
+	}
+	lp.saves = append(lp.saves, save)
+}
+
+// push adds a copy of the delivery of a message to the event list of the
+// incarnation.
+func (lp *optimisticProcess) push(ev *Event) {
+	delivery := *ev
+	delivery.effect = deliverEffect
+	lp.queued[ev.ID] = &delivery
+	lp.events.Push(&delivery)
+}
+
+// forget the messages sent before the committed events, they can't be
+// cancelled anymore, and what the process can't roll back to anymore: the
+// saves before the latest one before the committed events, and the
+// messages it received that were delivered before it.
+func (lp *optimisticProcess) forget() {
+	lp.historyMu.Lock()
+	committed := lp.committed
+	lp.historyMu.Unlock()
+	n := 0
+	for n < len(lp.sent) && lp.sent[n].after <= committed {
+		lp.sent[n] = sentMessage{}
+		n++
+	}
+	lp.sent = lp.sent[n:]
+
+	n = 0
+	for n+1 < len(lp.saves) && lp.saves[n+1].performed <= committed {
+		lp.saves[n] = nil
+		n++
+	}
+	lp.saves = lp.saves[n:]
+	if len(lp.saves) == 0 || lp.saves[0].performed > committed {
+		return
+	}
+	first := lp.saves[0]
+	for id := range first.delivered {
+		delete(lp.received, id)
+		for _, save := range lp.saves[1:] {
+			delete(save.delivered, id)
+		}
+	}
+	first.delivered = nil
+}
+
+// publish sets the clock of the process, waking up the merger when it
+// moves on.
+func (lp *optimisticProcess) publish(clock int64) {
+	old := atomic.LoadInt64(&lp.clock)
+	if clock == old {
+		return
+	}
+	atomic.StoreInt64(&lp.clock, clock)
+	if clock > old {
+		lp.parent.wakeMerger()
+	}
+}
+
+// deliver puts a message in the inbox, the global virtual time lock must
+// be held.
+func (lp *optimisticProcess) deliver(msg processMessage) {
+	lp.inboxMu.Lock()
+	lp.inbox = append(lp.inbox, msg)
+	lp.inboxMu.Unlock()
+}
+
+// admitRequest fails the requests that reach across processes, except
+// messages that take some time.
+func (lp *optimisticProcess) admitRequest(req *Request) error {
+	reqType := req.Type
+	switch {
+	case reqType.SendMessage != nil:
+		to := lp.parent.lookup(reqType.SendMessage.To)
+		if to == lp.index {
+			return nil
+		}
+		if to < 0 || to >= len(lp.parent.processes) {
+			return fmt.Errorf("actor %q is in process %d of a partition of %d processes", reqType.SendMessage.To, to, len(lp.parent.processes))
+		}
+		if req.AsyncDelay <= 0 {
+			return fmt.Errorf("%w: actor %q of process %d sent a message to %q of process %d without delay", ErrCrossPartition, req.Actor, lp.index, reqType.SendMessage.To, to)
+		}
+		return nil
+	case reqType.Spawn != nil:
+		// the new actor stays in this process
+		lp.parent.mu.Lock()
+		lp.parent.processOf[reqType.Spawn.Actor] = lp.index
+		lp.parent.mu.Unlock()
+		return nil
+	}
+	return crossesPartition(req, lp.index, lp.parent.resourceOf, lp.parent.lookup)
+}
+
+// forwardMessage hands the delivery of a message to the process of its
+// recipient, unless it was sent before the process started again.
+func (lp *optimisticProcess) forwardMessage(to string, ev *Event) bool {
+	process := lp.parent.lookup(to)
+	if process == lp.index {
+		return false
+	}
+	dest := lp.parent.processes[process]
+	sent := lp.resentBy[ev.Actor]
+	lp.resentBy[ev.Actor]++
+	if sent < lp.sentBy[ev.Actor] {
+		// it was sent the first time around
+		return true
+	}
+	lp.sent = append(lp.sent, sentMessage{to: dest, ev: ev, after: lp.performed})
+	lp.sentBy[ev.Actor]++
+	lp.parent.gvtMu.RLock()
+	dest.deliver(processMessage{ev: ev})
+	lp.parent.gvtMu.RUnlock()
+	dest.signal()
+	return true
+}
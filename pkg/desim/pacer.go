@@ -0,0 +1,206 @@
+package desim
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Pacer holds a simulation back so that simulated time goes by at a
+// given speed compared to the wall clock: at 1, a simulated second takes
+// a second, at 60 it takes a sixtieth of a second, at 0.5 it takes two
+// seconds. Events still happen in the same order. A pacer can be paused
+// and resumed while the simulation runs.
+type Pacer struct {
+	mu    sync.Mutex
+	speed float64
+	// the simulated time simAnchor happens at the wall time wallAnchor
+	simAnchor  time.Time
+	wallAnchor time.Time
+	paused     bool
+	pausedAt   time.Time
+	// changed is closed when the pace changes, so that a waiting
+	// scheduler figures out again how long to wait
+	changed chan struct{}
+
+	lag, maxLag  time.Duration
+	lagThreshold time.Duration
+	reportLag    func(simTime time.Time, lag time.Duration)
+}
+
+// A PacerOption changes how a Pacer paces a simulation.
+type PacerOption func(*Pacer)
+
+// ReportLag calls report every time an event happens later on the wall
+// clock than its pace demands, by more than threshold, because the model
+// can't keep up. The simulation waits on report.
+func ReportLag(threshold time.Duration, report func(simTime time.Time, lag time.Duration)) PacerOption {
+	return func(p *Pacer) {
+		p.lagThreshold = threshold
+		p.reportLag = report
+	}
+}
+
+// NewPacer makes a pacer at the given speed, the number of simulated
+// seconds per second of the wall clock. It panics if speed isn't
+// positive.
+func NewPacer(speed float64, opts ...PacerOption) *Pacer {
+	if speed <= 0 {
+		panic("desim: the speed of a pacer must be positive")
+	}
+	p := &Pacer{speed: speed, changed: make(chan struct{})}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// WithPacing runs the simulation at the pace of the pacer, instead of as
+// fast as possible.
+func WithPacing(p *Pacer) Option {
+	return func(sim *sim) { sim.pacer = p }
+}
+
+// pacedScheduler is implemented by the schedulers that can be paced.
+type pacedScheduler interface {
+	paceWith(p *Pacer)
+}
+
+var _ pacedScheduler = (*localScheduler)(nil)
+
+func (schd *localScheduler) paceWith(p *Pacer) { schd.pacer = p }
+
+// Speed is the number of simulated seconds per second of the wall clock.
+func (p *Pacer) Speed() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.speed
+}
+
+// SetSpeed changes the pace of the simulation from now on. It panics if
+// speed isn't positive.
+func (p *Pacer) SetSpeed(speed float64) {
+	if speed <= 0 {
+		panic("desim: the speed of a pacer must be positive")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.paused {
+		now = p.pausedAt
+	}
+	p.simAnchor, p.wallAnchor = p.simTimeAt(now), now
+	p.speed = speed
+	p.notify()
+}
+
+// Pause stops the simulation before its next event, until Resume is
+// called. The time spent paused doesn't count as lag.
+func (p *Pacer) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return
+	}
+	p.paused, p.pausedAt = true, time.Now()
+	p.notify()
+}
+
+// Resume lets a paused simulation go on.
+func (p *Pacer) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	p.wallAnchor = p.wallAnchor.Add(time.Since(p.pausedAt))
+	p.notify()
+}
+
+// Paused is true while the pacer is paused.
+func (p *Pacer) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Lag is how much later than its pace demanded the last event happened,
+// on the wall clock.
+func (p *Pacer) Lag() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lag
+}
+
+// MaxLag is the longest lag of an event so far.
+func (p *Pacer) MaxLag() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxLag
+}
+
+// start anchors the simulated time start to the wall clock, now.
+func (p *Pacer) start(start time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.simAnchor, p.wallAnchor = start, now
+	if p.paused {
+		p.pausedAt = now
+	}
+	p.lag, p.maxLag = 0, 0
+}
+
+// wait until the wall clock reaches the simulated time at, or the context
+// is done.
+func (p *Pacer) wait(ctx context.Context, at time.Time) error {
+	for {
+		p.mu.Lock()
+		changed := p.changed
+		if p.paused {
+			p.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		due := p.wallAnchor.Add(time.Duration(float64(at.Sub(p.simAnchor)) / p.speed))
+		now := time.Now()
+		if !now.Before(due) {
+			p.lag = now.Sub(due)
+			if p.lag > p.maxLag {
+				p.maxLag = p.lag
+			}
+			lag, report := p.lag, p.reportLag != nil && p.lag > p.lagThreshold
+			p.mu.Unlock()
+			if report {
+				p.reportLag(at, lag)
+			}
+			return nil
+		}
+		p.mu.Unlock()
+
+		timer := time.NewTimer(due.Sub(now))
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// simTimeAt is the simulated time the pace demands at a wall time.
+func (p *Pacer) simTimeAt(wall time.Time) time.Time {
+	return p.simAnchor.Add(time.Duration(float64(wall.Sub(p.wallAnchor)) * p.speed))
+}
+
+func (p *Pacer) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
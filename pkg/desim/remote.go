@@ -0,0 +1,726 @@
+package desim
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Codec encodes the requests and responses that go over the network
+// between actors and a remote scheduler.
+//
+// Payloads, store items and panic values are interfaces: GobCodec needs
+// their concrete types to be registered with gob.Register on both ends,
+// and JSONCodec decodes them as generic JSON values. Panic values are
+// sent as strings.
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// An Encoder writes values to a stream.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// A Decoder reads values from a stream.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+var (
+	// GobCodec encodes with encoding/gob, it's the default.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+func (gobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+
+// A RemoteOption changes how actors and a remote scheduler talk.
+type RemoteOption func(*remoteOptions)
+
+type remoteOptions struct {
+	codec       Codec
+	redialEvery time.Duration
+	redials     int
+}
+
+func makeRemoteOptions(opts []RemoteOption) remoteOptions {
+	o := remoteOptions{codec: GobCodec, redialEvery: 100 * time.Millisecond, redials: 50}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithCodec encodes the requests and responses with a codec. Both ends
+// must use the same.
+func WithCodec(codec Codec) RemoteOption {
+	return func(o *remoteOptions) { o.codec = codec }
+}
+
+// WithRedial makes a client try to connect this many times, waiting in
+// between, when it connects and when it lost its connection. Once it
+// gives up, the actors using it are told the simulation is over.
+func WithRedial(every time.Duration, attempts int) RemoteOption {
+	return func(o *remoteOptions) {
+		o.redialEvery = every
+		if attempts > 0 {
+			o.redials = attempts
+		}
+	}
+}
+
+// errSimulationOver is how a client learns that the scheduler it talks to
+// doesn't serve anymore.
+var errSimulationOver = errors.New("the remote scheduler is done")
+
+// clientFrame is what clients send. The first frame of a connection only
+// has the session, zero for a new one, the next ones are requests.
+type clientFrame struct {
+	Session uint64
+	ID      uint64
+	Request *Request
+	// Abort and Done stand for the requests of the same name, gob can't
+	// encode their empty structs.
+	Abort, Done bool
+	// Received are the responses the client got since its last frame, the
+	// server can forget them.
+	Received []uint64
+}
+
+// serverFrame is what servers send. The first frame of a connection only
+// has the session, the next ones are responses.
+type serverFrame struct {
+	Session  uint64
+	ID       uint64
+	Response *Response
+	// Over is true when the server stops serving.
+	Over bool
+}
+
+// encodeRequest makes the frame of a request, panicking if it can't go
+// over the network.
+func encodeRequest(req *Request) *clientFrame {
+	frame := &clientFrame{}
+	if req.Type == nil {
+		frame.Request = req
+		return frame
+	}
+	wire := *req
+	reqType := *req.Type
+	wire.Type = &reqType
+	frame.Request = &wire
+	switch {
+	case reqType.Abort != nil:
+		frame.Abort, reqType.Abort = true, nil
+	case reqType.Done != nil:
+		frame.Done, reqType.Done = true, nil
+	case reqType.GetStore != nil && reqType.GetStore.Filter != nil:
+		panic(fmt.Sprintf("actor %q: filtering a store with a remote scheduler: functions can't go over the network", req.Actor))
+	case reqType.Panic != nil:
+		p := *reqType.Panic
+		p.Value = fmt.Sprint(p.Value)
+		reqType.Panic = &p
+	}
+	return frame
+}
+
+// decodeRequest gives back the request of a frame.
+func decodeRequest(frame *clientFrame) *Request {
+	req := frame.Request
+	if req.Type == nil {
+		req.Type = &RequestType{}
+	}
+	switch {
+	case frame.Abort:
+		req.Type.Abort = &RequestAbort{}
+	case frame.Done:
+		req.Type.Done = &RequestDone{}
+	}
+	return req
+}
+
+// ServeScheduler serves the requests of remote actors to a scheduler,
+// over the connections accepted on l, until ctx is done. The clients made
+// by DialScheduler and RemoteScheduler talk to it.
+//
+// When ctx is done, it stops accepting connections, answers the requests
+// it's serving, then tells the clients it's over and closes the listener.
+// Cancel it once the scheduler ran, its requests are answered then.
+//
+// A client that lost its connection sends its requests again when it
+// reconnects, each request is scheduled once.
+func ServeScheduler(ctx context.Context, l net.Listener, client SchedulerClient, opts ...RemoteOption) error {
+	srv := &remoteServer{
+		client:   client,
+		opts:     makeRemoteOptions(opts),
+		sessions: make(map[uint64]*remoteSession),
+		conns:    make(map[*remoteConn]struct{}),
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+		case <-stopped:
+		}
+	}()
+
+	var (
+		serving sync.WaitGroup
+		err     error
+	)
+	for {
+		conn, acceptErr := l.Accept()
+		if acceptErr != nil {
+			if ctx.Err() == nil {
+				err = acceptErr
+				_ = l.Close()
+			}
+			break
+		}
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			srv.serve(conn)
+		}()
+	}
+	srv.shutdown()
+	serving.Wait()
+	return err
+}
+
+// remoteServer tracks the sessions of the clients of a scheduler.
+type remoteServer struct {
+	client SchedulerClient
+	opts   remoteOptions
+
+	mu          sync.Mutex
+	sessions    map[uint64]*remoteSession
+	lastSession uint64
+	conns       map[*remoteConn]struct{}
+	closing     bool
+	// calls are the requests being scheduled
+	calls sync.WaitGroup
+}
+
+// remoteSession is a client, across its connections.
+type remoteSession struct {
+	mu sync.Mutex
+	// conn is where the responses go, nil while the client reconnects
+	conn     *remoteConn
+	running  map[uint64]bool
+	answered map[uint64]*Response
+}
+
+// connWriter buffers what a codec writes to a connection, to write each
+// frame at once.
+type connWriter struct {
+	conn net.Conn
+	buf  bytes.Buffer
+}
+
+func (w *connWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+// flush writes the frame. A codec only writes whole messages, so what it
+// wrote goes even if it failed to encode the frame.
+func (w *connWriter) flush() error {
+	_, err := w.conn.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// remoteConn is a connection, its writes go one at a time.
+type remoteConn struct {
+	mu  sync.Mutex
+	w   *connWriter
+	enc Encoder
+}
+
+func (rc *remoteConn) send(frame *serverFrame) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	err := rc.enc.Encode(frame)
+	if flushErr := rc.w.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		// the client will reconnect and ask again
+		_ = rc.w.conn.Close()
+	}
+}
+
+func (srv *remoteServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var (
+		dec   = srv.opts.codec.NewDecoder(conn)
+		w     = &connWriter{conn: conn}
+		rc    = &remoteConn{w: w, enc: srv.opts.codec.NewEncoder(w)}
+		hello clientFrame
+	)
+	if err := dec.Decode(&hello); err != nil {
+		return
+	}
+
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		rc.send(&serverFrame{Over: true})
+		return
+	}
+	srv.conns[rc] = struct{}{}
+	id := hello.Session
+	if id == 0 {
+		srv.lastSession++
+		id = srv.lastSession
+	}
+	sess, ok := srv.sessions[id]
+	if !ok {
+		// a new client, or one that a previous server knew
+		sess = &remoteSession{running: make(map[uint64]bool), answered: make(map[uint64]*Response)}
+		srv.sessions[id] = sess
+	}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, rc)
+		srv.mu.Unlock()
+	}()
+
+	rc.send(&serverFrame{Session: id})
+	sess.mu.Lock()
+	sess.conn = rc
+	sess.mu.Unlock()
+	defer func() {
+		sess.mu.Lock()
+		if sess.conn == rc {
+			sess.conn = nil
+		}
+		sess.mu.Unlock()
+	}()
+
+	for {
+		frame := new(clientFrame)
+		if err := dec.Decode(frame); err != nil {
+			return
+		}
+		srv.call(sess, frame)
+	}
+}
+
+// call schedules a request, unless it was already.
+func (srv *remoteServer) call(sess *remoteSession, frame *clientFrame) {
+	sess.mu.Lock()
+	for _, id := range frame.Received {
+		delete(sess.answered, id)
+	}
+	if frame.Request == nil || sess.running[frame.ID] {
+		sess.mu.Unlock()
+		return
+	}
+	if res, ok := sess.answered[frame.ID]; ok {
+		// the client missed it
+		conn := sess.conn
+		sess.mu.Unlock()
+		if conn != nil {
+			conn.send(&serverFrame{ID: frame.ID, Response: res})
+		}
+		return
+	}
+
+	srv.mu.Lock()
+	if srv.closing {
+		// the client will hear that it's over
+		srv.mu.Unlock()
+		sess.mu.Unlock()
+		return
+	}
+	srv.calls.Add(1)
+	srv.mu.Unlock()
+	sess.running[frame.ID] = true
+	sess.mu.Unlock()
+
+	go func() {
+		defer srv.calls.Done()
+		res := srv.client.Schedule(decodeRequest(frame))
+
+		sess.mu.Lock()
+		delete(sess.running, frame.ID)
+		sess.answered[frame.ID] = res
+		conn := sess.conn
+		sess.mu.Unlock()
+		if conn != nil {
+			conn.send(&serverFrame{ID: frame.ID, Response: res})
+		}
+	}()
+}
+
+// shutdown answers the requests being scheduled, then lets every client
+// know that it's over.
+func (srv *remoteServer) shutdown() {
+	srv.mu.Lock()
+	srv.closing = true
+	srv.mu.Unlock()
+	srv.calls.Wait()
+
+	srv.mu.Lock()
+	conns := make([]*remoteConn, 0, len(srv.conns))
+	for rc := range srv.conns {
+		conns = append(conns, rc)
+	}
+	srv.mu.Unlock()
+	for _, rc := range conns {
+		rc.send(&serverFrame{Over: true})
+		_ = rc.w.conn.Close()
+	}
+}
+
+// A RemoteClient is a SchedulerClient for a scheduler in another process,
+// served by ServeScheduler.
+type RemoteClient interface {
+	SchedulerClient
+	// Close disconnects the client. The actors waiting on it are told the
+	// simulation is over.
+	Close() error
+}
+
+// DialScheduler connects to a scheduler served by ServeScheduler. Its
+// requests and responses can be sent by many actors at once, over one
+// connection. When the connection is lost, it reconnects and sends the
+// requests that weren't answered again, as set by WithRedial.
+func DialScheduler(network, addr string, opts ...RemoteOption) (RemoteClient, error) {
+	client := newRemoteClient(network, addr, opts)
+	if err := client.connect(); err != nil {
+		client.shut(err)
+		return nil, err
+	}
+	return client, nil
+}
+
+var _ RemoteClient = (*remoteClient)(nil)
+
+type remoteClient struct {
+	network, addr string
+	opts          remoteOptions
+
+	mu      sync.Mutex
+	session uint64
+	lastID  uint64
+	pending map[uint64]*remoteCall
+	// received are the responses to acknowledge in the next frame
+	received []uint64
+	// now is the time of the last response
+	now  time.Time
+	conn net.Conn
+	w    *connWriter
+	enc  Encoder
+	// over is closed once the client is closed, err says why
+	over   chan struct{}
+	closed bool
+	err    error
+}
+
+// remoteCall is a request waiting for its response. The response is
+// nil if the request couldn't be encoded, err says why.
+type remoteCall struct {
+	frame *clientFrame
+	res   chan *Response
+	err   error
+}
+
+func newRemoteClient(network, addr string, opts []RemoteOption) *remoteClient {
+	return &remoteClient{
+		network: network,
+		addr:    addr,
+		opts:    makeRemoteOptions(opts),
+		pending: make(map[uint64]*remoteCall),
+		over:    make(chan struct{}),
+	}
+}
+
+func (client *remoteClient) Schedule(req *Request) *Response {
+	frame := encodeRequest(req)
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return &Response{Now: client.now, Done: true}
+	}
+	client.lastID++
+	frame.ID = client.lastID
+	call := &remoteCall{frame: frame, res: make(chan *Response, 1)}
+	client.pending[frame.ID] = call
+	if client.enc != nil {
+		client.send(call)
+	}
+	client.mu.Unlock()
+	res := <-call.res
+	if res == nil {
+		panic(call.err)
+	}
+	return res
+}
+
+func (client *remoteClient) Close() error {
+	client.shut(nil)
+	return nil
+}
+
+// send writes the frame of a call. If the connection fails, it's closed
+// and the client reconnects. If the codec fails, so does the call. It
+// must be called with the lock held.
+func (client *remoteClient) send(call *remoteCall) {
+	frame := call.frame
+	frame.Received, client.received = client.received, nil
+	err := client.enc.Encode(frame)
+	switch {
+	case client.w.flush() != nil:
+		_ = client.conn.Close()
+	case err != nil:
+		delete(client.pending, frame.ID)
+		call.err = fmt.Errorf("actor %q: encoding a request for a remote scheduler: %w", frame.Request.Actor, err)
+		call.res <- nil
+	}
+}
+
+// connect dials until it gets a connection, then sends the requests that
+// wait for a response.
+func (client *remoteClient) connect() error {
+	var err error
+	for attempt := 0; attempt < client.opts.redials; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(client.opts.redialEvery):
+			case <-client.over:
+				return client.err
+			}
+		}
+		var (
+			w   *connWriter
+			dec Decoder
+			enc Encoder
+		)
+		w, enc, dec, err = client.handshake()
+		if errors.Is(err, errSimulationOver) {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+
+		client.mu.Lock()
+		if client.closed {
+			client.mu.Unlock()
+			_ = w.conn.Close()
+			return client.err
+		}
+		client.conn, client.w, client.enc = w.conn, w, enc
+		ids := make([]uint64, 0, len(client.pending))
+		for id := range client.pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			client.send(client.pending[id])
+		}
+		client.mu.Unlock()
+		go client.read(w.conn, dec)
+		return nil
+	}
+	return fmt.Errorf("connecting to the scheduler at %s: %w", client.addr, err)
+}
+
+// handshake opens a connection and learns the session of the client.
+func (client *remoteClient) handshake() (*connWriter, Encoder, Decoder, error) {
+	conn, err := net.Dial(client.network, client.addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client.mu.Lock()
+	hello := &clientFrame{Session: client.session}
+	client.mu.Unlock()
+
+	w := &connWriter{conn: conn}
+	enc, dec := client.opts.codec.NewEncoder(w), client.opts.codec.NewDecoder(conn)
+	var welcome serverFrame
+	err = enc.Encode(hello)
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, err
+	}
+	if err := dec.Decode(&welcome); err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, err
+	}
+	if welcome.Over {
+		_ = conn.Close()
+		return nil, nil, nil, errSimulationOver
+	}
+	client.mu.Lock()
+	client.session = welcome.Session
+	client.mu.Unlock()
+	return w, enc, dec, nil
+}
+
+// read hands out the responses coming from a connection, and reconnects
+// when it's lost.
+func (client *remoteClient) read(conn net.Conn, dec Decoder) {
+	for {
+		frame := new(serverFrame)
+		if err := dec.Decode(frame); err != nil {
+			break
+		}
+		if frame.Over {
+			client.shut(nil)
+			return
+		}
+		client.mu.Lock()
+		call, ok := client.pending[frame.ID]
+		if ok {
+			delete(client.pending, frame.ID)
+			client.received = append(client.received, frame.ID)
+			client.now = frame.Response.Now
+		}
+		client.mu.Unlock()
+		if ok {
+			call.res <- frame.Response
+		}
+	}
+	_ = conn.Close()
+
+	client.mu.Lock()
+	lost := client.conn == conn && !client.closed
+	if lost {
+		client.conn, client.w, client.enc = nil, nil, nil
+	}
+	client.mu.Unlock()
+	if lost {
+		if err := client.connect(); err != nil {
+			client.shut(err)
+		}
+	}
+}
+
+// shut closes the client, the requests waiting for a response are told
+// the simulation is over.
+func (client *remoteClient) shut(err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed {
+		return
+	}
+	client.closed = true
+	client.err = err
+	close(client.over)
+	if client.conn != nil {
+		_ = client.conn.Close()
+		client.conn, client.w, client.enc = nil, nil, nil
+	}
+	for id, call := range client.pending {
+		call.res <- &Response{Now: client.now, Done: true}
+		delete(client.pending, id)
+	}
+}
+
+// ServeRemoteActors makes the SchedulerFn of a simulation that has actors
+// in other processes. The scheduler made by mkSchd waits for the actors of
+// the simulation and for remoteActors more, that connect to it on l with
+// RemoteScheduler. It serves them while it runs, then closes l.
+func ServeRemoteActors(l net.Listener, remoteActors int, mkSchd SchedulerFn, opts ...RemoteOption) SchedulerFn {
+	return func(actorCount int, resources []Resource) (Scheduler, SchedulerClient) {
+		schd, client := mkSchd(actorCount+remoteActors, resources)
+		return &servingScheduler{Scheduler: schd, l: l, client: client, opts: opts}, client
+	}
+}
+
+// servingScheduler serves a scheduler to remote actors while it runs.
+type servingScheduler struct {
+	Scheduler
+	l      net.Listener
+	client SchedulerClient
+	opts   []RemoteOption
+}
+
+func (schd *servingScheduler) unwrap() Scheduler { return schd.Scheduler }
+
+func (schd *servingScheduler) Run(ctx context.Context, r *rand.Rand, start, end time.Time, sink EventSink) error {
+	runCtx, stopRunning := context.WithCancel(ctx)
+	defer stopRunning()
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		err := ServeScheduler(serveCtx, schd.l, schd.client, schd.opts...)
+		if err != nil {
+			// the remote actors can't reach the scheduler anymore
+			stopRunning()
+		}
+		served <- err
+	}()
+
+	err := schd.Scheduler.Run(runCtx, r, start, end, sink)
+	stopServing()
+	if serveErr := <-served; serveErr != nil {
+		return fmt.Errorf("serving remote actors: %w", serveErr)
+	}
+	return err
+}
+
+// RemoteScheduler makes the SchedulerFn of a process whose actors take
+// part in a simulation run by another process, served on addr by
+// ServeRemoteActors or ServeScheduler. The simulation of this process
+// runs until the remote one is over, its result only has the statistics
+// of the resources of this process, which are all zero: the history and
+// the statistics are those of the remote simulation.
+//
+// The start and end times of the simulation don't matter, but its random
+// source and its actors must be the same as they would be in a single
+// process for the simulation to be the same.
+func RemoteScheduler(network, addr string, opts ...RemoteOption) SchedulerFn {
+	return func(actorCount int, resources []Resource) (Scheduler, SchedulerClient) {
+		client := newRemoteClient(network, addr, opts)
+		return &remoteScheduler{client: client}, client
+	}
+}
+
+// remoteScheduler connects its client, then waits for the remote
+// simulation to be over.
+type remoteScheduler struct {
+	client *remoteClient
+}
+
+func (schd *remoteScheduler) Run(ctx context.Context, r *rand.Rand, start, end time.Time, sink EventSink) error {
+	if err := schd.client.connect(); err != nil {
+		schd.client.shut(err)
+		return err
+	}
+	select {
+	case <-schd.client.over:
+	case <-ctx.Done():
+		schd.client.shut(ctx.Err())
+	}
+	schd.client.mu.Lock()
+	defer schd.client.mu.Unlock()
+	return schd.client.err
+}
@@ -0,0 +1,55 @@
+package desim
+
+import "container/heap"
+
+// reservationHeap serves reservations by decreasing priority, then in
+// the order they were made.
+type reservationHeap struct {
+	h reservationSlice
+}
+
+func newReservationHeap() *reservationHeap { return &reservationHeap{} }
+
+// Len returns the number of reservations in the heap.
+func (q *reservationHeap) Len() int { return len(q.h) }
+
+// Push adds a reservation to the heap.
+func (q *reservationHeap) Push(res *reservation) { heap.Push(&q.h, res) }
+
+// Peek returns the next reservation to serve. This call panics if the
+// heap is empty.
+func (q *reservationHeap) Peek() *reservation {
+	if q.Len() <= 0 {
+		panic("heap: empty heap")
+	}
+	return q.h[0]
+}
+
+// Pop removes the next reservation to serve. This call panics if the
+// heap is empty.
+func (q *reservationHeap) Pop() *reservation {
+	if q.Len() <= 0 {
+		panic("heap: empty heap")
+	}
+	return heap.Pop(&q.h).(*reservation)
+}
+
+type reservationSlice []*reservation
+
+func (s reservationSlice) Len() int { return len(s) }
+func (s reservationSlice) Less(i, j int) bool {
+	if s[i].priority != s[j].priority {
+		return s[i].priority > s[j].priority
+	}
+	return s[i].seq < s[j].seq
+}
+func (s reservationSlice) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *reservationSlice) Push(x interface{}) { *s = append(*s, x.(*reservation)) }
+func (s *reservationSlice) Pop() interface{} {
+	old := *s
+	n := len(old)
+	res := old[n-1]
+	old[n-1] = nil
+	*s = old[:n-1]
+	return res
+}
@@ -2,32 +2,77 @@ package desim
 
 import (
 	"fmt"
+	"sort"
+	"time"
 )
 
 type reservationKey string
 
 type reservation struct {
-	seq   int
-	actor string
+	seq         int
+	actor       string
+	priority    int32
+	units       int
+	requestedAt time.Time
+
+	cancelled bool
 }
 
 func (res reservation) key() reservationKey {
 	return reservationKey(fmt.Sprintf("%d-%s", res.seq, res.actor))
 }
 
-// A Resource can be acquired and released by reservations. It has a capacity of 1 or more
-// slots. The priority in which reservations get to acquire resources depends on the resource
+// A Resource is shared by the actors of a simulation. Resources made by
+// MakeFIFOResource and its siblings can be acquired and released by
+// reservations. They have a capacity of 1 or more slots. The priority in
+// which reservations get to acquire resources depends on the resource
 // implementation.
 type Resource interface {
 	id() string
-	acquireOrEnqueue(byActor string) *reservation
-	release(res reservationKey, notifyNextInLine func(*reservation) (stillWaiting bool))
+	// begin resets the resource for a new simulation
+	begin(now time.Time)
+	// end stops observing the resource
+	end(now time.Time)
+}
+
+// slotResource is a resource that is acquired and released by
+// reservations.
+type slotResource interface {
+	Resource
+	monitor() *resourceMonitor
+	// slots is the capacity of the resource
+	slots() int
+	// acquireOrEnqueue may evict reservations holding the resource to make
+	// room for the new one
+	acquireOrEnqueue(byActor string, priority int32, units int, now time.Time) (res *reservation, acquired bool, evicted []*reservation)
+	// available is true if the units can be acquired right away, without
+	// waiting in line or evicting anyone
+	available(units int) bool
+	// grant available units to an actor that waited outside of the line
+	grant(byActor string, priority int32, units int, requestedAt, now time.Time) *reservation
+	// cancel gives up on a reservation that is waiting in line. The
+	// reservations it was holding up must be served afterward.
+	cancel(res *reservation, now time.Time, timedout bool)
+	release(res reservationKey, now time.Time, notifyNextInLine func(*reservation) (stillWaiting bool)) error
+	// serve the reservations waiting in line that fit in the free slots
+	serve(now time.Time, notifyNextInLine func(*reservation) (stillWaiting bool))
+	// holding lists the reservations holding the resource, oldest first
+	holding() []*reservation
+	// resize changes the capacity of the resource, the reservations
+	// waiting in line must be served afterward
+	resize(capacity int, now time.Time)
+	// save describes the reservations and the statistics of the
+	// resource, restore sets them back
+	save() *savedResource
+	restore(saved *savedResource)
+	// waitingFor is the reservation of an actor waiting in line, or nil
+	waitingFor(actor string) *reservation
 }
 
 // MakeFIFOResource makes a resource that is acquired in first-in
 // first out order.
 func MakeFIFOResource(name string, capacity int) Resource {
-	return &fifoResource{
+	return &queuedResource{
 		name:         name,
 		capacity:     capacity,
 		reservations: make(map[reservationKey]*reservation),
@@ -35,43 +80,325 @@ func MakeFIFOResource(name string, capacity int) Resource {
 	}
 }
 
-type fifoResource struct {
+// MakePriorityResource makes a resource that is acquired by the waiting
+// reservation of highest priority first. Reservations of the same
+// priority are served in first-in first-out order.
+func MakePriorityResource(name string, capacity int) Resource {
+	return &queuedResource{
+		name:         name,
+		capacity:     capacity,
+		reservations: make(map[reservationKey]*reservation),
+		queue:        newReservationHeap(),
+	}
+}
+
+// MakePreemptiveResource makes a resource that is acquired like a
+// priority resource, except that when it is full, a reservation evicts
+// the holder of lowest priority if that priority is lower than its own.
+// An evicted holder that is sleeping is interrupted with the
+// CausePreempted cause, and releasing its reservation afterwards does
+// nothing.
+func MakePreemptiveResource(name string, capacity int) Resource {
+	return &queuedResource{
+		name:         name,
+		capacity:     capacity,
+		reservations: make(map[reservationKey]*reservation),
+		queue:        newReservationHeap(),
+		preemptive:   true,
+		evicted:      make(map[reservationKey]bool),
+	}
+}
+
+// waitQueue holds the reservations waiting for a resource, in the order
+// in which they will be served.
+type waitQueue interface {
+	Len() int
+	Push(*reservation)
+	Peek() *reservation
+	Pop() *reservation
+}
+
+type queuedResource struct {
 	seq      int
 	name     string
 	capacity int
 
 	reservations map[reservationKey]*reservation
+	// used is the number of slots held by the reservations
+	used int
 
-	queue *reservationQueue
+	queue   waitQueue
+	waiting int
+
+	preemptive bool
+	evicted    map[reservationKey]bool
+
+	mon resourceMonitor
 }
 
-func (fifo *fifoResource) id() string { return fifo.name }
+func (rsc *queuedResource) id() string                { return rsc.name }
+func (rsc *queuedResource) slots() int                { return rsc.capacity }
+func (rsc *queuedResource) monitor() *resourceMonitor { return &rsc.mon }
 
-func (fifo *fifoResource) acquireOrEnqueue(byActor string) *reservation {
-	fifo.seq++
-	res := &reservation{seq: fifo.seq, actor: byActor}
-	if len(fifo.reservations) >= fifo.capacity {
-		fifo.queue.Push(res)
-		return nil
+func (rsc *queuedResource) begin(now time.Time) {
+	// forget what a previous simulation left behind
+	rsc.reservations = make(map[reservationKey]*reservation)
+	rsc.used, rsc.waiting = 0, 0
+	for rsc.queue.Len() > 0 {
+		rsc.queue.Pop()
+	}
+	if rsc.preemptive {
+		rsc.evicted = make(map[reservationKey]bool)
+	}
+	rsc.mon.begin(rsc.name, rsc.capacity, now)
+}
+
+func (rsc *queuedResource) end(now time.Time) { rsc.mon.end(now) }
+
+func (rsc *queuedResource) available(units int) bool {
+	return rsc.waiting == 0 && rsc.used+units <= rsc.capacity
+}
+
+func (rsc *queuedResource) acquireOrEnqueue(byActor string, priority int32, units int, now time.Time) (*reservation, bool, []*reservation) {
+	if rsc.available(units) {
+		return rsc.grant(byActor, priority, units, now, now), true, nil
+	}
+	evicted := rsc.evictable(priority, units)
+	if evicted == nil {
+		rsc.seq++
+		res := &reservation{seq: rsc.seq, actor: byActor, priority: priority, units: units, requestedAt: now}
+		rsc.queue.Push(res)
+		rsc.waiting++
+		rsc.mon.enqueued(now)
+		return res, false, nil
 	}
-	fifo.reservations[res.key()] = res
+	for _, res := range evicted {
+		delete(rsc.reservations, res.key())
+		rsc.used -= res.units
+		rsc.evicted[res.key()] = true
+		rsc.mon.preempted(now, res.units)
+	}
+	return rsc.grant(byActor, priority, units, now, now), true, evicted
+}
+
+func (rsc *queuedResource) grant(byActor string, priority int32, units int, requestedAt, now time.Time) *reservation {
+	rsc.seq++
+	res := &reservation{seq: rsc.seq, actor: byActor, priority: priority, units: units, requestedAt: requestedAt}
+	rsc.reservations[res.key()] = res
+	rsc.used += units
+	rsc.mon.acquired(now, requestedAt, units)
 	return res
 }
 
-func (fifo *fifoResource) release(resKey reservationKey, notifyNextInLine func(*reservation) bool) {
-	_, ok := fifo.reservations[resKey]
+// evictable are the holders a preemptive resource evicts to make room for
+// the units: those of lowest priority first, the most recent ones among
+// those. They must all have a priority lower than the new reservation, and
+// the new reservation must outrank those waiting in line, who would
+// otherwise be served after it.
+func (rsc *queuedResource) evictable(priority int32, units int) []*reservation {
+	if !rsc.preemptive {
+		return nil
+	}
+	for rsc.queue.Len() > 0 && rsc.queue.Peek().cancelled {
+		rsc.queue.Pop()
+	}
+	if rsc.queue.Len() > 0 && rsc.queue.Peek().priority >= priority {
+		return nil
+	}
+	var lower []*reservation
+	for _, res := range rsc.reservations {
+		if res.priority < priority {
+			lower = append(lower, res)
+		}
+	}
+	sort.Slice(lower, func(i, j int) bool {
+		if lower[i].priority != lower[j].priority {
+			return lower[i].priority < lower[j].priority
+		}
+		return lower[i].seq > lower[j].seq
+	})
+	free := rsc.capacity - rsc.used
+	for i, res := range lower {
+		free += res.units
+		if free >= units {
+			return lower[:i+1]
+		}
+	}
+	// evicting them all wouldn't be enough
+	return nil
+}
+
+func (rsc *queuedResource) cancel(res *reservation, now time.Time, timedout bool) {
+	if res.cancelled {
+		return
+	}
+	// it will be skipped when its turn comes
+	res.cancelled = true
+	rsc.waiting--
+	rsc.mon.dequeued(now)
+	if timedout {
+		rsc.mon.timedout()
+	}
+}
+
+func (rsc *queuedResource) release(resKey reservationKey, now time.Time, notifyNextInLine func(*reservation) bool) error {
+	if rsc.evicted[resKey] {
+		// the reservation was already taken away
+		delete(rsc.evicted, resKey)
+		return nil
+	}
+	res, ok := rsc.reservations[resKey]
 	if !ok {
-		panic("can't release reservation that was never acquired")
-	}
-	delete(fifo.reservations, resKey)
-	if len(fifo.reservations) < fifo.capacity {
-		for fifo.queue.Len() > 0 {
-			nextInLine := fifo.queue.Pop()
-			accepted := notifyNextInLine(nextInLine)
-			if accepted {
-				fifo.reservations[nextInLine.key()] = nextInLine
-				return
-			}
+		return ErrDoubleRelease
+	}
+	delete(rsc.reservations, resKey)
+	rsc.used -= res.units
+	rsc.mon.released(now, res.units)
+	rsc.serve(now, notifyNextInLine)
+	return nil
+}
+
+func (rsc *queuedResource) serve(now time.Time, notifyNextInLine func(*reservation) bool) {
+	for rsc.queue.Len() > 0 {
+		nextInLine := rsc.queue.Peek()
+		if nextInLine.cancelled {
+			rsc.queue.Pop()
+			continue
+		}
+		if rsc.used+nextInLine.units > rsc.capacity {
+			// the next in line holds up the others until there's room
+			return
+		}
+		rsc.queue.Pop()
+		rsc.waiting--
+		rsc.mon.dequeued(now)
+		accepted := notifyNextInLine(nextInLine)
+		if accepted {
+			rsc.reservations[nextInLine.key()] = nextInLine
+			rsc.used += nextInLine.units
+			rsc.mon.acquired(now, nextInLine.requestedAt, nextInLine.units)
+		}
+	}
+}
+
+func (rsc *queuedResource) resize(capacity int, now time.Time) {
+	rsc.capacity = capacity
+	rsc.mon.resized(now, capacity)
+}
+
+func (rsc *queuedResource) holding() []*reservation {
+	holding := make([]*reservation, 0, len(rsc.reservations))
+	for _, res := range rsc.reservations {
+		holding = append(holding, res)
+	}
+	sort.Slice(holding, func(i, j int) bool { return holding[i].seq < holding[j].seq })
+	return holding
+}
+
+// savedResource is a resource with slots in a checkpoint.
+type savedResource struct {
+	Name           string
+	Seq, Capacity  int
+	Used, Waiting  int
+	Holding, Queue []savedReservation
+	Evicted        []string
+	Monitor        savedResourceMonitor
+}
+
+// savedReservation is a reservation in a checkpoint.
+type savedReservation struct {
+	Seq         int
+	Actor       string
+	Priority    int32
+	Units       int
+	RequestedAt time.Time
+	Cancelled   bool
+}
+
+func saveReservation(res *reservation) savedReservation {
+	return savedReservation{
+		Seq:         res.seq,
+		Actor:       res.actor,
+		Priority:    res.priority,
+		Units:       res.units,
+		RequestedAt: res.requestedAt,
+		Cancelled:   res.cancelled,
+	}
+}
+
+func (saved savedReservation) reservation() *reservation {
+	return &reservation{
+		seq:         saved.Seq,
+		actor:       saved.Actor,
+		priority:    saved.Priority,
+		units:       saved.Units,
+		requestedAt: saved.RequestedAt,
+		cancelled:   saved.Cancelled,
+	}
+}
+
+func (rsc *queuedResource) save() *savedResource {
+	saved := &savedResource{
+		Name:     rsc.name,
+		Seq:      rsc.seq,
+		Capacity: rsc.capacity,
+		Used:     rsc.used,
+		Waiting:  rsc.waiting,
+		Monitor:  rsc.mon.save(),
+	}
+	for _, res := range rsc.holding() {
+		saved.Holding = append(saved.Holding, saveReservation(res))
+	}
+	// the queue only gives its reservations back in order
+	queue := make([]*reservation, 0, rsc.queue.Len())
+	for rsc.queue.Len() > 0 {
+		queue = append(queue, rsc.queue.Pop())
+	}
+	for _, res := range queue {
+		rsc.queue.Push(res)
+		saved.Queue = append(saved.Queue, saveReservation(res))
+	}
+	for key := range rsc.evicted {
+		saved.Evicted = append(saved.Evicted, string(key))
+	}
+	sort.Strings(saved.Evicted)
+	return saved
+}
+
+func (rsc *queuedResource) restore(saved *savedResource) {
+	rsc.seq, rsc.capacity = saved.Seq, saved.Capacity
+	rsc.used, rsc.waiting = saved.Used, saved.Waiting
+	rsc.reservations = make(map[reservationKey]*reservation, len(saved.Holding))
+	for _, res := range saved.Holding {
+		rsc.reservations[res.reservation().key()] = res.reservation()
+	}
+	for rsc.queue.Len() > 0 {
+		rsc.queue.Pop()
+	}
+	for _, res := range saved.Queue {
+		rsc.queue.Push(res.reservation())
+	}
+	if rsc.preemptive {
+		rsc.evicted = make(map[reservationKey]bool, len(saved.Evicted))
+		for _, key := range saved.Evicted {
+			rsc.evicted[reservationKey(key)] = true
+		}
+	}
+	rsc.mon.restore(saved.Monitor)
+}
+
+func (rsc *queuedResource) waitingFor(actor string) *reservation {
+	var found *reservation
+	// the queue only gives its reservations back in order
+	queue := make([]*reservation, 0, rsc.queue.Len())
+	for rsc.queue.Len() > 0 {
+		queue = append(queue, rsc.queue.Pop())
+	}
+	for _, res := range queue {
+		rsc.queue.Push(res)
+		if res.actor == actor && !res.cancelled {
+			found = res
 		}
 	}
+	return found
 }
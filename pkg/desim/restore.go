@@ -0,0 +1,483 @@
+package desim
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// schedulerState is what a localScheduler needs to go on from a
+// checkpoint. It's encoded with gob, like the requests of remote actors.
+type schedulerState struct {
+	Now           time.Time
+	EventID       int
+	ActorsRunning int
+	// Events are the events still to come, earliest first.
+	Events []*savedEvent
+	// Pending are the actors waiting on the scheduler.
+	Pending []*savedPending
+	// Waiting are the actors waiting for service, WaitingForAll those of
+	// them waiting for several resources, in the order they started.
+	Waiting       []*savedWait
+	WaitingForAll []string
+	Mailboxes     map[string][]*Message
+	Done          []string
+	Names         []string
+	Held          []savedHeld
+	Leaks         []*Leak
+	Deadlocks     []*Deadlock
+	LastDeadlock  string
+	Resources     []*savedResource
+	Containers    []*savedContainer
+	Stores        []*savedStore
+}
+
+// savedEvent is an event in a checkpoint, with the request its effect
+// needs.
+type savedEvent struct {
+	Event   Event
+	Effect  effect
+	Request *savedRequest
+	Evicted []string
+}
+
+// savedPending is an actor waiting on the scheduler in a checkpoint, for
+// the event of an ID to answer its request.
+type savedPending struct {
+	Actor   string
+	Event   int
+	Request *savedRequest
+}
+
+// savedWait is an actor waiting for service in a checkpoint.
+type savedWait struct {
+	Actor   string
+	Request *savedRequest
+	// Timeout is the ID of the event that answers the actor if nothing
+	// else does first. Never is that event if it isn't to come.
+	Timeout int
+	Never   *Event
+	Async   bool
+	Since   time.Time
+	Claims  []savedClaim
+}
+
+type savedClaim struct {
+	Resource string
+	Units    int
+}
+
+type savedHeld struct {
+	Resource, Key, Actor string
+	Since                time.Time
+	Releasing            bool
+}
+
+// savedRequest is a request in a checkpoint. Like a clientFrame, it
+// stands for the requests gob can't encode, and loses the filter of store
+// requests.
+type savedRequest struct {
+	Request     *Request
+	Abort, Done bool
+}
+
+func saveRequest(req *Request) *savedRequest {
+	if req == nil {
+		return nil
+	}
+	saved := *req
+	reqType := *req.Type
+	saved.Type = &reqType
+	frame := &savedRequest{Request: &saved}
+	switch {
+	case reqType.Abort != nil:
+		frame.Abort, reqType.Abort = true, nil
+	case reqType.Done != nil:
+		frame.Done, reqType.Done = true, nil
+	}
+	return frame
+}
+
+// request is a copy of the saved request, the same state may be restored
+// more than once.
+func (saved *savedRequest) request() *Request {
+	if saved == nil {
+		return nil
+	}
+	req := *saved.Request
+	reqType := *req.Type
+	req.Type = &reqType
+	return decodeRequest(&clientFrame{Request: &req, Abort: saved.Abort, Done: saved.Done})
+}
+
+// requestKind names what a request asks the scheduler.
+func requestKind(reqType *RequestType) string {
+	switch {
+	case reqType.Abort != nil:
+		return "abort"
+	case reqType.Done != nil:
+		return "be done"
+	case reqType.Delay != nil:
+		return "sleep"
+	case reqType.AcquireResource != nil:
+		return fmt.Sprintf("acquire %q", reqType.AcquireResource.ResourceID)
+	case reqType.ReleaseResource != nil:
+		return fmt.Sprintf("release %q", reqType.ReleaseResource.ResourceID)
+	case reqType.AcquireResources != nil:
+		return fmt.Sprintf("acquire %q", reqType.AcquireResources.ResourceIDs)
+	case reqType.ReleaseResources != nil:
+		return fmt.Sprintf("release %q", reqType.ReleaseResources.ResourceIDs)
+	case reqType.SendMessage != nil:
+		return fmt.Sprintf("send to %q", reqType.SendMessage.To)
+	case reqType.ReceiveMessage != nil:
+		return "receive"
+	case reqType.Interrupt != nil:
+		return fmt.Sprintf("interrupt %q", reqType.Interrupt.Actor)
+	case reqType.Spawn != nil:
+		return fmt.Sprintf("spawn %q", reqType.Spawn.Actor)
+	case reqType.Join != nil:
+		return fmt.Sprintf("join %q", reqType.Join.Actor)
+	case reqType.Panic != nil:
+		return "panic"
+	case reqType.PutContainer != nil:
+		return fmt.Sprintf("put in %q", reqType.PutContainer.ContainerID)
+	case reqType.GetContainer != nil:
+		return fmt.Sprintf("get from %q", reqType.GetContainer.ContainerID)
+	case reqType.PutStore != nil:
+		return fmt.Sprintf("put in %q", reqType.PutStore.StoreID)
+	case reqType.GetStore != nil:
+		return fmt.Sprintf("get from %q", reqType.GetStore.StoreID)
+	case reqType.SetTimer != nil:
+		return "set a timer"
+	case reqType.StopTimer != nil:
+		return "stop a timer"
+	case reqType.WaitTimer != nil:
+		return "wait on a timer"
+	}
+	return "nothing"
+}
+
+// save describes the state of the scheduler, while every actor waits on
+// it.
+func (schd *localScheduler) save() *schedulerState {
+	state := &schedulerState{
+		Now:           schd.currentTime,
+		EventID:       schd.eventID,
+		ActorsRunning: schd.actorsRunning,
+		Mailboxes:     make(map[string][]*Message),
+		Leaks:         schd.foundLeaks,
+		Deadlocks:     schd.foundDeadlocks,
+		LastDeadlock:  schd.lastDeadlock,
+	}
+	// the event list only gives its events back in order
+	pending := make([]*Event, 0, schd.events.Len())
+	for schd.events.Len() > 0 {
+		pending = append(pending, schd.events.Pop())
+	}
+	for _, ev := range pending {
+		schd.events.Push(ev)
+		state.Events = append(state.Events, &savedEvent{
+			Event:   *ev,
+			Effect:  ev.effect,
+			Request: saveRequest(ev.req),
+			Evicted: ev.evicted,
+		})
+	}
+	for id, envelope := range schd.pendingResponse {
+		state.Pending = append(state.Pending, &savedPending{
+			Actor:   envelope.req.Actor,
+			Event:   id,
+			Request: saveRequest(envelope.req),
+		})
+	}
+	sort.Slice(state.Pending, func(i, j int) bool { return state.Pending[i].Actor < state.Pending[j].Actor })
+	for actor, waiting := range schd.actorsWaitingForService {
+		saved := &savedWait{
+			Actor:   actor,
+			Request: saveRequest(waiting.envelope.req),
+			Timeout: waiting.timeout.ev.ID,
+			Async:   waiting.async,
+			Since:   waiting.since,
+		}
+		if !waiting.timeout.Pending() {
+			never := *waiting.timeout.ev
+			saved.Never = &never
+		}
+		for _, c := range waiting.claims {
+			saved.Claims = append(saved.Claims, savedClaim{Resource: c.resource.id(), Units: c.units})
+		}
+		state.Waiting = append(state.Waiting, saved)
+	}
+	sort.Slice(state.Waiting, func(i, j int) bool { return state.Waiting[i].Actor < state.Waiting[j].Actor })
+	for _, waiting := range schd.waitingForAll {
+		if schd.actorsWaitingForService[waiting.envelope.req.Actor] == waiting {
+			state.WaitingForAll = append(state.WaitingForAll, waiting.envelope.req.Actor)
+		}
+	}
+	for actor, mailbox := range schd.mailboxes {
+		if len(mailbox) > 0 {
+			// the scheduler takes the messages out of the mailbox in place
+			state.Mailboxes[actor] = append([]*Message(nil), mailbox...)
+		}
+	}
+	for actor := range schd.actorsDone {
+		state.Done = append(state.Done, actor)
+	}
+	sort.Strings(state.Done)
+	for actor := range schd.actorNames {
+		state.Names = append(state.Names, actor)
+	}
+	sort.Strings(state.Names)
+	for k, held := range schd.held {
+		state.Held = append(state.Held, savedHeld{
+			Resource:  k.resource,
+			Key:       string(k.key),
+			Actor:     held.actor,
+			Since:     held.since,
+			Releasing: held.releasing,
+		})
+	}
+	sort.Slice(state.Held, func(i, j int) bool {
+		a, b := state.Held[i], state.Held[j]
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		return a.Key < b.Key
+	})
+	ids := make([]string, 0, len(schd.resources))
+	for id := range schd.resources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		switch resource := schd.resources[id].(type) {
+		case slotResource:
+			state.Resources = append(state.Resources, resource.save())
+		case Container:
+			state.Containers = append(state.Containers, resource.save())
+		case Store:
+			state.Stores = append(state.Stores, resource.save())
+		}
+	}
+	return state
+}
+
+// checkpointActors lists the actors of the state, for a checkpointer to
+// complete.
+func (state *schedulerState) checkpointActors() []CheckpointActor {
+	done := make(map[string]bool, len(state.Done))
+	for _, actor := range state.Done {
+		done[actor] = true
+	}
+	actors := make([]CheckpointActor, 0, len(state.Names))
+	for _, name := range state.Names {
+		actors = append(actors, CheckpointActor{Name: name, Done: done[name]})
+	}
+	return actors
+}
+
+func (state *schedulerState) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, fmt.Errorf("encoding the state of the scheduler: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSchedulerState(b []byte) (*schedulerState, error) {
+	state := new(schedulerState)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(state); err != nil {
+		return nil, fmt.Errorf("decoding the state of the scheduler: %w", err)
+	}
+	return state, nil
+}
+
+// resumption is where an actor that goes on from a checkpoint waits on
+// the scheduler, until it makes the request it was waiting on again.
+type resumption struct {
+	req     *Request
+	eventID int
+	// event answers the actor if it's still to come, waiting is what it
+	// waits for if it waits for service
+	event   *Event
+	waiting *waitingRequest
+}
+
+// goOnFrom has the scheduler start from the state of a checkpoint, once it
+// began, and call resumed once every actor waits on it again.
+func (schd *localScheduler) goOnFrom(state *schedulerState, resumed func() error) {
+	schd.restored, schd.resumed = state, resumed
+}
+
+// restore sets the scheduler back to the state of a checkpoint. Its
+// actors must then make the request they were waiting on again.
+func (schd *localScheduler) restore(state *schedulerState) error {
+	schd.currentTime = state.Now
+	schd.eventID = state.EventID
+	schd.actorsRunning = state.ActorsRunning
+	schd.foundLeaks = append([]*Leak(nil), state.Leaks...)
+	schd.foundDeadlocks = append([]*Deadlock(nil), state.Deadlocks...)
+	schd.lastDeadlock = state.LastDeadlock
+	// the first step finds the actors of the last deadlock again
+	schd.waitsChanged = true
+
+	restored := func(id string) (Resource, error) {
+		res, ok := schd.resources[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is in the checkpoint, but not in the simulation", ErrUnknownResource, id)
+		}
+		return res, nil
+	}
+	for _, saved := range state.Resources {
+		res, err := restored(saved.Name)
+		if err != nil {
+			return err
+		}
+		resource, ok := res.(slotResource)
+		if !ok {
+			return fmt.Errorf("%w: %q has slots in the checkpoint", ErrWrongResourceKind, saved.Name)
+		}
+		resource.restore(saved)
+	}
+	for _, saved := range state.Containers {
+		res, err := restored(saved.Name)
+		if err != nil {
+			return err
+		}
+		c, ok := res.(Container)
+		if !ok {
+			return fmt.Errorf("%w: %q is a container in the checkpoint", ErrWrongResourceKind, saved.Name)
+		}
+		c.restore(saved)
+	}
+	for _, saved := range state.Stores {
+		res, err := restored(saved.Name)
+		if err != nil {
+			return err
+		}
+		st, ok := res.(Store)
+		if !ok {
+			return fmt.Errorf("%w: %q is a store in the checkpoint", ErrWrongResourceKind, saved.Name)
+		}
+		st.restore(saved)
+	}
+
+	events := make(map[int]*Event, len(state.Events))
+	for _, saved := range state.Events {
+		ev := saved.Event
+		ev.effect, ev.req, ev.evicted = saved.Effect, saved.Request.request(), saved.Evicted
+		// a state kept in memory has the fields gob ignores
+		ev.onHandle, ev.index = nil, 0
+		schd.events.Push(&ev)
+		events[ev.ID] = &ev
+		if ev.effect == timerEffect {
+			schd.clockTimers[clockTimer{actor: ev.req.Actor, id: ev.req.Type.SetTimer.Timer}] = schd.newTimer(&ev)
+		}
+	}
+	schd.resuming = make(map[string]*resumption, len(state.Pending))
+	for _, saved := range state.Pending {
+		schd.resuming[saved.Actor] = &resumption{
+			req:     saved.Request.request(),
+			eventID: saved.Event,
+			event:   events[saved.Event],
+		}
+	}
+	for _, saved := range state.Waiting {
+		req := saved.Request.request()
+		waiting := &waitingRequest{
+			envelope: &chanReq{req: req},
+			async:    saved.Async,
+			since:    saved.Since,
+		}
+		if saved.Never != nil {
+			waiting.timeout = schd.newTimer(saved.Never)
+		} else if ev, ok := events[saved.Timeout]; ok {
+			waiting.timeout = schd.newTimer(ev)
+		} else {
+			return fmt.Errorf("actor %q waits on event %d, which isn't in the checkpoint", saved.Actor, saved.Timeout)
+		}
+		for _, c := range saved.Claims {
+			res, err := restored(c.Resource)
+			if err != nil {
+				return err
+			}
+			resource, ok := res.(slotResource)
+			if !ok {
+				return fmt.Errorf("%w: %q has slots in the checkpoint", ErrWrongResourceKind, c.Resource)
+			}
+			waiting.claims = append(waiting.claims, claim{resource: resource, units: c.Units})
+		}
+		switch {
+		case req.Type.AcquireResource != nil:
+			waiting.reservation = schd.resources[req.Type.AcquireResource.ResourceID].(slotResource).waitingFor(saved.Actor)
+		case req.Type.PutContainer != nil, req.Type.GetContainer != nil:
+			waiting.containerReq = schd.resources[containerID(req.Type)].(Container).waitingFor(saved.Actor, req.Type.PutContainer != nil)
+		case req.Type.PutStore != nil, req.Type.GetStore != nil:
+			waiting.storeReq = schd.resources[storeID(req.Type)].(Store).waitingFor(saved.Actor, req.Type.PutStore != nil)
+		}
+		schd.actorsWaitingForService[saved.Actor] = waiting
+		if r, ok := schd.resuming[saved.Actor]; ok {
+			r.waiting = waiting
+		}
+	}
+	for _, actor := range state.WaitingForAll {
+		schd.waitingForAll = append(schd.waitingForAll, schd.actorsWaitingForService[actor])
+	}
+	for actor, mailbox := range state.Mailboxes {
+		schd.mailboxes[actor] = append([]*Message(nil), mailbox...)
+	}
+	for _, actor := range state.Done {
+		schd.actorsDone[actor] = true
+	}
+	for _, actor := range state.Names {
+		schd.actorNames[actor] = true
+	}
+	for _, held := range state.Held {
+		schd.held[heldKey{resource: held.Resource, key: reservationKey(held.Key)}] = &heldReservation{
+			actor:     held.Actor,
+			since:     held.Since,
+			releasing: held.Releasing,
+		}
+		schd.heldBy[held.Actor]++
+	}
+	return nil
+}
+
+// resume an actor that goes on from a checkpoint, once it made the
+// request it was waiting on again.
+func (schd *localScheduler) resume(envelope *chanReq, r *resumption) {
+	req := envelope.req
+	delete(schd.resuming, req.Actor)
+	if got, want := requestKind(req.Type), requestKind(r.req.Type); got != want {
+		schd.fail(fmt.Errorf("%w: actor %q asked to %s, instead of to %s, when it went on from the checkpoint", ErrNotDeterministic, req.Actor, got, want))
+		return
+	}
+	schd.pendingResponse[r.eventID] = envelope
+	if waiting := r.waiting; waiting != nil {
+		waiting.envelope = envelope
+		if get := req.Type.GetStore; get != nil && waiting.storeReq != nil {
+			// the checkpoint doesn't keep filters
+			waiting.storeReq.match = get.Filter
+		}
+	}
+	if ev := r.event; ev != nil && ev.req != nil && ev.req.Actor == req.Actor && ev.effect != timerEffect {
+		ev.req = req
+	}
+	if len(schd.resuming) == 0 {
+		schd.resumeDone()
+	}
+}
+
+// resumeDone lets the simulation go on, once every actor of the
+// checkpoint waits on the scheduler.
+func (schd *localScheduler) resumeDone() {
+	schd.resuming = nil
+	if schd.resumed == nil {
+		return
+	}
+	if err := schd.resumed(); err != nil {
+		schd.fail(err)
+	}
+}
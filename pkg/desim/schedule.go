@@ -1,13 +1,14 @@
 package desim
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"time"
 )
 
 type Scheduler interface {
-	Run(r *rand.Rand, start, end time.Time) []*Event
+	Run(ctx context.Context, r *rand.Rand, start, end time.Time, sink EventSink) error
 }
 
 type SchedulerClient interface {
@@ -28,11 +29,26 @@ type Request struct {
 
 type RequestType struct {
 	// oneof
-	Abort           *RequestAbort
-	Done            *RequestDone
-	Delay           *RequestDelay
-	AcquireResource *RequestAcquireResource
-	ReleaseResource *RequestReleaseResource
+	Abort            *RequestAbort
+	Done             *RequestDone
+	Delay            *RequestDelay
+	AcquireResource  *RequestAcquireResource
+	ReleaseResource  *RequestReleaseResource
+	SendMessage      *RequestSendMessage
+	ReceiveMessage   *RequestReceiveMessage
+	Interrupt        *RequestInterrupt
+	Spawn            *RequestSpawn
+	Join             *RequestJoin
+	Panic            *RequestPanic
+	PutContainer     *RequestPutContainer
+	GetContainer     *RequestGetContainer
+	PutStore         *RequestPutStore
+	GetStore         *RequestGetStore
+	AcquireResources *RequestAcquireResources
+	ReleaseResources *RequestReleaseResources
+	SetTimer         *RequestSetTimer
+	StopTimer        *RequestStopTimer
+	WaitTimer        *RequestWaitTimer
 }
 
 type RequestAbort struct{}
@@ -45,7 +61,20 @@ type RequestDelay struct {
 
 type RequestAcquireResource struct {
 	ResourceID string
-	Timeout    time.Duration
+	// Units is the number of slots to acquire, 1 if unset
+	Units   int
+	Timeout time.Duration
+}
+
+// RequestAcquireResources gets a slot of every resource at once.
+type RequestAcquireResources struct {
+	ResourceIDs []string
+	Timeout     time.Duration
+}
+
+type RequestReleaseResources struct {
+	ResourceIDs     []string
+	ReservationKeys []string
 }
 
 type RequestReleaseResource struct {
@@ -53,15 +82,116 @@ type RequestReleaseResource struct {
 	ReservationKey string
 }
 
+type RequestSendMessage struct {
+	To      string
+	Payload interface{}
+}
+
+type RequestReceiveMessage struct {
+	Timeout time.Duration
+}
+
+type RequestInterrupt struct {
+	Actor string
+	Cause string
+}
+
+type RequestSpawn struct {
+	Actor string
+}
+
+type RequestJoin struct {
+	Actor   string
+	Timeout time.Duration
+}
+
+type RequestPutContainer struct {
+	ContainerID string
+	Amount      float64
+	Timeout     time.Duration
+}
+
+type RequestGetContainer struct {
+	ContainerID string
+	Amount      float64
+	Timeout     time.Duration
+}
+
+type RequestPutStore struct {
+	StoreID string
+	Item    interface{}
+}
+
+type RequestGetStore struct {
+	StoreID string
+	// Filter, if set, is the predicate the item must match. It can only
+	// be used on a filter store. It can't go over the network.
+	Filter  func(item interface{}) bool `json:"-"`
+	Timeout time.Duration
+}
+
+// RequestSetTimer has a timer of the actor's clock fire at a time, moving
+// it if it's pending. Timers are numbered by the actor, from 1.
+type RequestSetTimer struct {
+	Timer int
+	At    time.Time
+}
+
+type RequestStopTimer struct {
+	Timer int
+}
+
+// RequestWaitTimer waits until a pending timer of the actor fires.
+type RequestWaitTimer struct {
+	Timer int
+}
+
+type RequestPanic struct {
+	Time  time.Time
+	Value interface{}
+	Stack []byte
+}
+
 type Response struct {
 	Now         time.Time
 	Interrupted bool
 	Timedout    bool
 	Done        bool
 
-	ReservationKey string
+	ReservationKey  string
+	ReservationKeys []string
+	Message         *Message
+	Interruption    *Interruption
+	Item            interface{}
 }
 
+// An Interruption describes why an actor was woken up before the
+// end of a blocking call.
+type Interruption struct {
+	By    string
+	Cause string
+
+	// Resource that was taken away from the actor, if it was preempted.
+	Resource string
+	// Remaining time the actor had left to sleep when it was preempted.
+	Remaining time.Duration
+}
+
+// CausePreempted is the cause of the interruption of an actor whose
+// reservation was evicted from a preemptive resource.
+const CausePreempted = "preempted"
+
+// A Message is delivered from one actor to the mailbox of another actor.
+type Message struct {
+	From    string
+	To      string
+	SentAt  time.Time
+	Payload interface{}
+}
+
+// Kind describes the type of the payload carried by the message.
+func (msg *Message) Kind() string { return fmt.Sprintf("%T", msg.Payload) }
+
 type Event struct {
 	Actor       string
 	ID          int
@@ -75,9 +205,21 @@ type Event struct {
 	Interrupted bool
 	Timedout    bool
 	// TODO: these need to be some kind of return value
-	ReservationKey string
+	ReservationKey  string
+	ReservationKeys []string
+	Message         *Message
+	Interruption    *Interruption
+	Item            interface{}
 
 	onHandle func()
+	// effect is what the event does to a localScheduler when it happens,
+	// besides answering its actor, req is the request that made it and
+	// evicted are the actors whose reservations it took away
+	effect  effect
+	req     *Request
+	evicted []string
+	// index is where the event is in its event list, 0 when it isn't in one
+	index int
 }
 
 func (e *Event) compare(other *Event) int {
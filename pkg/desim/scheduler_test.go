@@ -0,0 +1,1383 @@
+package desim_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/desim/pkg/desim"
+	"github.com/aybabtme/desim/pkg/gen"
+	"github.com/stretchr/testify/require"
+)
+
+// A model is a simulation that is deterministic under the local
+// scheduler: no two actors make requests that depend on each other at
+// the same simulated time. Its actors keep the state they change between
+// calls in a Snapshotter.
+type model struct {
+	name string
+	end  time.Duration
+	make func() ([]*desim.Actor, []desim.Resource)
+	// split spreads the actors over 3 logical processes, keeping those
+	// that interact other than by messages together. The model stays in
+	// one process if it's nil.
+	split func(actor string) int
+}
+
+var conformanceModels = []model{
+	{name: "clocks", end: 10 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		clock := func(name string, iter int, dur time.Duration) *desim.Actor {
+			left := &tally{count: iter, restores: new(int64)}
+			return desim.MakeActor(name, func(env desim.Env) bool {
+				left.count--
+				if env.Sleep(gen.StaticDuration(dur)) {
+					return false
+				}
+				return left.count > 0
+			}, desim.WithSnapshotter(left))
+		}
+		return []*desim.Actor{
+			clock("slow", 6, 900*time.Millisecond),
+			clock("fast", 6, 400*time.Millisecond),
+		}, nil
+	}, split: func(actor string) int {
+		return map[string]int{"slow": 0, "fast": 2}[actor]
+	}},
+	{name: "crowd", end: 10 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		var actors []*desim.Actor
+		for i := 0; i < 200; i++ {
+			actors = append(actors, desim.MakeActor(fmt.Sprintf("actor%03d", i), func(env desim.Env) bool {
+				return !env.Sleep(gen.StaticDuration(time.Duration(1+env.Rand().Intn(1000)) * time.Millisecond))
+			}))
+		}
+		return actors, nil
+	}, split: func(actor string) int {
+		var i int
+		_, _ = fmt.Sscanf(actor, "actor%d", &i)
+		return i % 3
+	}},
+	{name: "resources", end: 30 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		lock := desim.MakeFIFOResource("lock", 1)
+		worker := func(offset, work time.Duration) desim.Action {
+			return func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(offset))
+				release, obtained := env.Acquire(lock, gen.StaticDuration(2*time.Second))
+				if !obtained {
+					return true
+				}
+				env.Sleep(gen.StaticDuration(work))
+				release()
+				return true
+			}
+		}
+		return []*desim.Actor{
+			desim.MakeActor("a", worker(101*time.Millisecond, 1009*time.Millisecond)),
+			desim.MakeActor("b", worker(353*time.Millisecond, 701*time.Millisecond)),
+			desim.MakeActor("c", worker(617*time.Millisecond, 1499*time.Millisecond)),
+			desim.MakeActor("d", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(911 * time.Millisecond))
+				env.UseAsync(lock, gen.StaticDuration(307*time.Millisecond), gen.StaticDuration(time.Second))
+				return true
+			}),
+		}, []desim.Resource{lock}
+	}},
+	{name: "messages", end: 20 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		return []*desim.Actor{
+			desim.MakeActor("pinger", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				env.Send("ponger", "ping", gen.StaticDuration(100*time.Millisecond))
+				_, received := env.Receive(gen.StaticDuration(time.Second))
+				return received
+			}),
+			desim.MakeActor("ponger", func(env desim.Env) bool {
+				msg, received := env.Receive(gen.StaticDuration(5 * time.Second))
+				if received {
+					env.Send(msg.From, "pong", gen.StaticDuration(250*time.Millisecond))
+				}
+				return received
+			}),
+			desim.MakeActor("sleeper", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				return true
+			}),
+			desim.MakeActor("waker", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(3300 * time.Millisecond))
+				env.Interrupt("sleeper", "wake up")
+				return true
+			}),
+		}, nil
+	}, split: func(actor string) int {
+		return map[string]int{"pinger": 0, "ponger": 1, "sleeper": 2, "waker": 2}[actor]
+	}},
+	{name: "spawn", end: 20 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		children := &tally{restores: new(int64)}
+		return []*desim.Actor{
+			desim.MakeActor("parent", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(2 * time.Second))
+				children.count++
+				child := fmt.Sprintf("child%d", children.count)
+				env.Spawn(child, func(env desim.Env) bool {
+					env.Sleep(gen.StaticDuration(3 * time.Second))
+					return false
+				})
+				return env.Join(child, gen.StaticDuration(10*time.Second))
+			}, desim.WithSnapshotter(children)),
+		}, nil
+	}},
+	{name: "containers and stores", end: 20 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		tank := desim.MakeContainer("tank", 10, 0)
+		shelf := desim.MakeStore("shelf", 2)
+		items := &tally{restores: new(int64)}
+		return []*desim.Actor{
+			desim.MakeActor("filler", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(700 * time.Millisecond))
+				return env.Put(tank, 3, gen.StaticDuration(time.Second))
+			}),
+			desim.MakeActor("drainer", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(1100 * time.Millisecond))
+				env.Get(tank, 5, gen.StaticDuration(2*time.Second))
+				return true
+			}),
+			desim.MakeActor("producer", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(400 * time.Millisecond))
+				items.count++
+				return env.StorePut(shelf, items.count)
+			}, desim.WithSnapshotter(items)),
+			desim.MakeActor("consumer", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(1300 * time.Millisecond))
+				env.StoreGet(shelf, gen.StaticDuration(time.Second))
+				return true
+			}),
+		}, []desim.Resource{tank, shelf}
+	}},
+	{name: "clock", end: 20 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		ready := false
+		return []*desim.Actor{
+			desim.MakeActor("service", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(1700 * time.Millisecond))
+				ready = true
+				return false
+			}),
+			desim.MakeActor("client", func(env desim.Env) bool {
+				_, err := waitReady(env.Clock(), func() bool { return ready }, 5*time.Second)
+				if err == nil {
+					_, _ = env.Receive(gen.StaticDuration(time.Second))
+				}
+				return false
+			}),
+			desim.MakeActor("heartbeat", func(env desim.Env) bool {
+				clock := env.Clock()
+				ticker := clock.NewTicker(time.Second)
+				defer ticker.Stop()
+				<-ticker.C()
+				<-ticker.C()
+				env.Send("client", "beat", gen.StaticDuration(0))
+				return true
+			}),
+		}, nil
+	}},
+	{name: "network", end: 30 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+		// tokens go around a ring of nodes, many things happen at once
+		const nodes = 12
+		node := func(i int) string { return fmt.Sprintf("node%02d", i) }
+		var actors []*desim.Actor
+		for i := 0; i < nodes; i++ {
+			i := i
+			actors = append(actors, desim.MakeActor(node(i), func(env desim.Env) bool {
+				step := func(n int) gen.Duration { return gen.StaticDuration(time.Duration(n) * 100 * time.Millisecond) }
+				msg, received := env.Receive(step(7))
+				if !received {
+					env.Send(node(env.Rand().Intn(nodes)), node(i), step(2))
+					return true
+				}
+				env.Sleep(step(env.Rand().Intn(4)))
+				env.Send(node((i+1)%nodes), msg.Payload, step(1+env.Rand().Intn(3)))
+				return true
+			}))
+		}
+		return actors, nil
+	}, split: func(actor string) int {
+		var i int
+		_, _ = fmt.Sscanf(actor, "node%d", &i)
+		return i % 3
+	}},
+}
+
+// runModel runs a model with a scheduler and describes its history, with
+// everything but the IDs of the events.
+func runModel(t testing.TB, mkSchd desim.SchedulerFn, m model, opts ...desim.Option) []string {
+	start := time.Unix(0, 0).UTC()
+	sim := desim.New(
+		mkSchd,
+		rand.New(rand.NewSource(42)),
+		gen.StaticTime(start),
+		gen.StaticTime(start.Add(m.end)),
+		opts...,
+	)
+	actors, resources := m.make()
+	res, err := sim.RunContext(context.Background(), actors, resources, desim.LogMute())
+	require.NoError(t, err)
+	return describeHistory(start, res.History)
+}
+
+// describeHistory describes each event of a history, to compare it with
+// another.
+func describeHistory(start time.Time, events []*desim.Event) []string {
+	history := make([]string, 0, len(events))
+	for _, ev := range events {
+		var payload interface{}
+		if ev.Message != nil {
+			payload = ev.Message.Payload
+		}
+		history = append(history, fmt.Sprintf("%v %s %q interrupted=%v timedout=%v reservation=%q%q message=%v item=%v",
+			ev.Time.Sub(start), ev.Actor, ev.Kind, ev.Interrupted, ev.Timedout, ev.ReservationKey, ev.ReservationKeys, payload, ev.Item,
+		))
+	}
+	return history
+}
+
+// TestLocalScheduler checks that the models give the same history every
+// time, the baseline that other schedulers are held to.
+func TestLocalScheduler(t *testing.T) {
+	for _, m := range conformanceModels {
+		t.Run(m.name, func(t *testing.T) {
+			want := runModel(t, desim.NewLocalScheduler, m)
+			got := runModel(t, desim.NewLocalScheduler, m)
+			require.NotEmpty(t, want)
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+var eventLists = []struct {
+	name   string
+	mkList func() desim.EventList
+}{
+	{"calendar queue", desim.NewCalendarQueue},
+	{"ladder queue", desim.NewLadderQueue},
+}
+
+func TestDuplicateActor(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	for _, name := range []string{"sibling", "parent", "child"} {
+		sim := desim.New(desim.NewLocalScheduler, rand.New(rand.NewSource(42)), gen.StaticTime(start), gen.StaticTime(start.Add(time.Minute)))
+		_, err := sim.RunContext(context.Background(), []*desim.Actor{
+			desim.MakeActor("parent", func(env desim.Env) bool {
+				env.Spawn("child", func(env desim.Env) bool {
+					env.Sleep(gen.StaticDuration(time.Second))
+					return false
+				})
+				env.Sleep(gen.StaticDuration(2 * time.Second))
+				// the child is done by now
+				env.Spawn(name, func(env desim.Env) bool { return false })
+				return false
+			}),
+			desim.MakeActor("sibling", func(env desim.Env) bool {
+				return !env.Sleep(gen.StaticDuration(time.Second))
+			}),
+		}, nil, desim.LogMute())
+		require.ErrorIs(t, err, desim.ErrDuplicateActor, name)
+	}
+}
+
+func TestPreemptiveResourceQueue(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	sim := desim.New(desim.NewLocalScheduler, rand.New(rand.NewSource(42)), gen.StaticTime(start), gen.StaticTime(start.Add(time.Minute)))
+	machine := desim.MakePreemptiveResource("machine", 2)
+	acquired := make(map[string]time.Duration)
+	var mu sync.Mutex
+	job := func(name string, after time.Duration, units int, priority int32, works time.Duration) *desim.Actor {
+		return desim.MakeActor(name, func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(after))
+			release, obtained := env.AcquireN(machine, units, gen.StaticDuration(time.Minute), desim.WithPriority(priority))
+			require.True(t, obtained)
+			mu.Lock()
+			acquired[name] = env.Now().Sub(start)
+			mu.Unlock()
+			if env.Sleep(gen.StaticDuration(works)) {
+				t.Errorf("%s was preempted", name)
+			}
+			release()
+			return false
+		})
+	}
+	_, err := sim.RunContext(context.Background(), []*desim.Actor{
+		job("low", 0, 1, 1, 10*time.Second),
+		job("high", 0, 1, 10, 5*time.Second),
+		// evicting low isn't enough, big waits in line
+		job("big", time.Second, 2, 5, time.Second),
+		// mid could evict low, but big was waiting first and outranks it
+		job("mid", 2*time.Second, 1, 3, time.Second),
+	}, []desim.Resource{machine}, desim.LogMute())
+	require.NoError(t, err)
+	require.Equal(t, map[string]time.Duration{
+		"low":  0,
+		"high": 0,
+		"big":  10 * time.Second,
+		"mid":  11 * time.Second,
+	}, acquired)
+}
+
+func TestDeadlockOnLeakedReservation(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	sim := desim.New(desim.NewLocalScheduler, rand.New(rand.NewSource(42)), gen.StaticTime(start), gen.StaticTime(start.Add(time.Hour)),
+		desim.WithDeadlockDetection(desim.ReportDeadlocks),
+	)
+	machine := desim.MakeFIFOResource("machine", 1)
+	res, err := sim.RunContext(context.Background(), []*desim.Actor{
+		desim.MakeActor("quitter", func(env desim.Env) bool {
+			// done without releasing it
+			_, obtained := env.Acquire(machine, gen.StaticDuration(time.Minute))
+			require.True(t, obtained)
+			return false
+		}),
+		desim.MakeActor("waiter", func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(time.Second))
+			_, obtained := env.Acquire(machine, gen.StaticDuration(time.Minute))
+			require.False(t, obtained)
+			return false
+		}),
+	}, []desim.Resource{machine}, desim.LogMute())
+	require.NoError(t, err)
+	require.Len(t, res.Leaks, 1)
+	require.Equal(t, []*desim.Deadlock{{
+		Time:   start.Add(time.Second),
+		Actors: []string{"waiter"},
+		Leaked: []desim.WaitFor{{Actor: "waiter", Resource: "machine", Holder: "quitter"}},
+	}}, res.Deadlocks)
+	require.Equal(t, `waiter deadlocked at 1970-01-01 00:00:01 +0000 UTC: waiter waits for machine held by quitter, which is done`, res.Deadlocks[0].String())
+}
+
+func TestReleaseAfterEnd(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	sim := desim.New(desim.NewLocalScheduler, rand.New(rand.NewSource(42)), gen.StaticTime(start), gen.StaticTime(start.Add(time.Hour)))
+	machine := desim.MakeFIFOResource("machine", 1)
+	handover := make(chan func(), 1)
+	_, err := sim.RunContext(context.Background(), []*desim.Actor{
+		desim.MakeActor("quitter", func(env desim.Env) bool {
+			release, obtained := env.Acquire(machine, gen.StaticDuration(time.Minute))
+			require.True(t, obtained)
+			// done without releasing it, someone else will
+			handover <- release
+			return false
+		}),
+		desim.MakeActor("releaser", func(env desim.Env) bool {
+			env.Sleep(gen.StaticDuration(time.Second))
+			release := <-handover
+			release()
+			return false
+		}),
+	}, []desim.Resource{machine}, desim.LogMute())
+	require.ErrorIs(t, err, desim.ErrReleaseAfterEnd)
+	require.Contains(t, err.Error(), `actor "quitter" released [machine]`)
+}
+
+func TestStatsSamples(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	for _, samples := range []bool{false, true} {
+		var opts []desim.Option
+		if samples {
+			opts = append(opts, desim.WithSamples())
+		}
+		sim := desim.New(desim.NewLocalScheduler, rand.New(rand.NewSource(42)), gen.StaticTime(start), gen.StaticTime(start.Add(time.Hour)), opts...)
+		teller := desim.MakeFIFOResource("teller", 1)
+		tips := desim.MakeContainer("tips", 10, 0)
+		customer := func(env desim.Env) bool {
+			release, obtained := env.Acquire(teller, gen.StaticDuration(time.Hour))
+			require.True(t, obtained)
+			env.Sleep(gen.StaticDuration(time.Second))
+			release()
+			require.True(t, env.Put(tips, 1, gen.StaticDuration(time.Hour)))
+			return false
+		}
+		res, err := sim.RunContext(context.Background(), []*desim.Actor{
+			desim.MakeActor("alice", customer),
+			desim.MakeActor("bob", customer),
+			desim.MakeActor("carol", customer),
+			desim.MakeActor("teller", func(env desim.Env) bool {
+				require.True(t, env.Get(tips, 3, gen.StaticDuration(time.Hour)))
+				return false
+			}),
+		}, []desim.Resource{teller, tips}, desim.LogMute())
+		require.NoError(t, err)
+
+		tipStats := res.Containers["tips"]
+		require.Equal(t, desim.WaitStats{Count: 1, Total: 3 * time.Second, Min: 3 * time.Second, Max: 3 * time.Second}, tipStats.GetWait)
+		require.Equal(t, 3, tipStats.PutWait.Count)
+		if samples {
+			require.Equal(t, []time.Duration{3 * time.Second}, tipStats.GetWaits)
+			require.Len(t, tipStats.Level, 5)
+		} else {
+			require.Empty(t, tipStats.GetWaits)
+			require.Empty(t, tipStats.PutWaits)
+			require.Empty(t, tipStats.Level)
+		}
+
+		stats := res.Resources["teller"]
+		require.Equal(t, desim.WaitStats{Count: 3, Total: 3 * time.Second, Min: 0, Max: 2 * time.Second}, stats.Wait)
+		require.Equal(t, time.Second, stats.MeanWait())
+		require.Equal(t, 2, stats.MaxQueueLength)
+		if samples {
+			require.Equal(t, []time.Duration{0, time.Second, 2 * time.Second}, stats.Waits)
+			require.Len(t, stats.QueueLength, 4)
+		} else {
+			require.Empty(t, stats.Waits)
+			require.Empty(t, stats.QueueLength)
+		}
+	}
+}
+
+func TestEventLists(t *testing.T) {
+	for _, list := range eventLists {
+		t.Run(list.name, func(t *testing.T) {
+			for _, m := range conformanceModels {
+				t.Run(m.name, func(t *testing.T) {
+					want := runModel(t, desim.NewLocalScheduler, m)
+					got := runModel(t, desim.NewLocalScheduler, m, desim.WithEventList(list.mkList))
+					require.Equal(t, want, got)
+				})
+			}
+		})
+	}
+}
+
+// TestEventListOrder pushes, pops and removes the same events from each
+// event list and from a heap, with many events at the same time.
+func TestEventListOrder(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	spreads := []time.Duration{time.Nanosecond, time.Millisecond, time.Hour}
+	for _, list := range eventLists {
+		for _, spread := range spreads {
+			t.Run(fmt.Sprintf("%s/%v", list.name, spread), func(t *testing.T) {
+				r := rand.New(rand.NewSource(42))
+				want, got := desim.NewEventHeap(), list.mkList()
+				var (
+					now    = start
+					queued []*desim.Event
+					id     int
+				)
+				for op := 0; op < 50000; op++ {
+					switch n := r.Intn(10); {
+					case n < 5 || want.Len() == 0:
+						id++
+						ev := &desim.Event{
+							Actor:    fmt.Sprintf("actor%d", r.Intn(5)),
+							ID:       id,
+							Time:     now.Add(time.Duration(r.Intn(1000)) * spread),
+							Priority: int32(r.Intn(2)),
+						}
+						twin := *ev
+						want.Push(ev)
+						got.Push(&twin)
+						queued = append(queued, ev, &twin)
+					case n < 8:
+						require.Equal(t, want.Peek().ID, got.Peek().ID)
+						wantEv, gotEv := want.Pop(), got.Pop()
+						require.Equal(t, wantEv.ID, gotEv.ID)
+						require.False(t, got.Contains(gotEv))
+						now = wantEv.Time
+					default:
+						i := 2 * r.Intn(len(queued)/2)
+						require.Equal(t, want.Remove(queued[i]), got.Remove(queued[i+1]))
+						require.False(t, got.Contains(queued[i+1]))
+					}
+					require.Equal(t, want.Len(), got.Len())
+				}
+				for want.Len() > 0 {
+					require.Equal(t, want.Pop().ID, got.Pop().ID)
+				}
+				require.Zero(t, got.Len())
+				require.Nil(t, got.Peek())
+			})
+		}
+	}
+}
+
+func TestPacer(t *testing.T) {
+	t.Run("same history", func(t *testing.T) {
+		m := conformanceModels[0]
+		want := runModel(t, desim.NewLocalScheduler, m)
+		got := runModel(t, desim.NewLocalScheduler, m, desim.WithPacing(desim.NewPacer(1000)))
+		require.Equal(t, want, got)
+	})
+	t.Run("lag", func(t *testing.T) {
+		var reported int
+		pacer := desim.NewPacer(1000, desim.ReportLag(0, func(simTime time.Time, lag time.Duration) {
+			reported++
+		}))
+		start := time.Unix(0, 0).UTC()
+		sim := desim.New(
+			desim.NewLocalScheduler,
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(start),
+			gen.StaticTime(start.Add(10*time.Millisecond)),
+			desim.WithPacing(pacer),
+		)
+		// a simulated millisecond takes a microsecond, but the actor takes
+		// longer than that to do anything
+		slow := desim.MakeActor("slow", func(env desim.Env) bool {
+			time.Sleep(time.Millisecond)
+			return !env.Sleep(gen.StaticDuration(time.Millisecond))
+		})
+		_, err := sim.RunContext(context.Background(), []*desim.Actor{slow}, nil, desim.LogMute())
+		require.NoError(t, err)
+		require.NotZero(t, reported)
+		require.True(t, pacer.MaxLag() >= pacer.Lag())
+		require.True(t, pacer.Lag() > 0)
+	})
+	t.Run("cancelled while paused", func(t *testing.T) {
+		pacer := desim.NewPacer(1)
+		pacer.Pause()
+		start := time.Unix(0, 0).UTC()
+		sim := desim.New(
+			desim.NewLocalScheduler,
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(start),
+			gen.StaticTime(start.Add(time.Hour)),
+			desim.WithPacing(pacer),
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := sim.RunContext(ctx, []*desim.Actor{desim.MakeActor("clock", clock(6, time.Second))}, nil, desim.LogMute())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.True(t, pacer.Paused())
+	})
+}
+
+func TestClock(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	run := func(t *testing.T, end time.Duration, actors ...*desim.Actor) []string {
+		sim := desim.New(
+			desim.NewLocalScheduler,
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(start),
+			gen.StaticTime(start.Add(end)),
+		)
+		res, err := sim.RunContext(context.Background(), actors, nil, desim.LogMute())
+		require.NoError(t, err)
+		var history []string
+		for _, ev := range res.History {
+			history = append(history, fmt.Sprintf("%v %s %s", ev.Time.Sub(start), ev.Actor, ev.Kind))
+		}
+		return history
+	}
+
+	t.Run("timers", func(t *testing.T) {
+		var (
+			funcAt, resetAt, firstAt, secondAt, tickAt time.Duration
+			stopped, stoppedTwice, reset               bool
+			stale                                      bool
+			first, second                              int
+		)
+		code := desim.MakeActor("code", func(env desim.Env) bool {
+			clock := env.Clock()
+
+			clock.AfterFunc(2*time.Second, func() { funcAt = clock.Now().Sub(start) })
+			clock.Sleep(2 * time.Second)
+
+			timer := clock.NewTimer(time.Second)
+			stopped, stoppedTwice = timer.Stop(), timer.Stop()
+			clock.Sleep(3 * time.Second)
+			select {
+			case <-timer.C():
+				stale = true
+			default:
+			}
+
+			timer = clock.NewTimer(time.Second)
+			reset = timer.Reset(4 * time.Second)
+			at := <-timer.C()
+			resetAt = at.Sub(start)
+
+			short, long := clock.NewTimer(500*time.Millisecond), clock.NewTimer(time.Second)
+			first, at = clock.Wait(long, short)
+			firstAt = at.Sub(start)
+			second, at = clock.Wait(short, long)
+			secondAt = at.Sub(start)
+
+			// the ticks the actor slept through are dropped
+			ticker := clock.NewTicker(time.Second)
+			env.Sleep(gen.StaticDuration(3500 * time.Millisecond))
+			<-ticker.C()
+			at = <-ticker.C()
+			tickAt = at.Sub(start)
+			return false
+		})
+		want := run(t, time.Minute, code)
+		require.Equal(t, 2*time.Second, funcAt)
+		require.True(t, stopped)
+		require.False(t, stoppedTwice)
+		require.False(t, stale)
+		require.True(t, reset)
+		require.Equal(t, 9*time.Second, resetAt)
+		require.Equal(t, 1, first)
+		require.Equal(t, 9500*time.Millisecond, firstAt)
+		require.Equal(t, 1, second)
+		require.Equal(t, 10*time.Second, secondAt)
+		require.Equal(t, 14*time.Second, tickAt)
+
+		for i := 0; i < 10; i++ {
+			require.Equal(t, want, run(t, time.Minute, code))
+		}
+	})
+
+	t.Run("receives without Wait", func(t *testing.T) {
+		var (
+			ticks   []time.Duration
+			afterAt time.Duration
+		)
+		code := desim.MakeActor("code", func(env desim.Env) bool {
+			clock := env.Clock()
+			ticker := clock.NewTicker(time.Second)
+			defer ticker.Stop()
+			stop := make(chan struct{})
+			for len(ticks) < 3 {
+				select {
+				case at := <-ticker.C():
+					ticks = append(ticks, at.Sub(start))
+				case <-stop:
+					return false
+				}
+			}
+			// the ticker fires on the way
+			select {
+			case at := <-clock.After(1500 * time.Millisecond):
+				afterAt = at.Sub(start)
+			case <-stop:
+			}
+			return false
+		})
+		want := run(t, time.Minute, code)
+		require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, ticks)
+		require.Equal(t, 4500*time.Millisecond, afterAt)
+		require.Contains(t, want, "4s code timer fired")
+
+		for i := 0; i < 10; i++ {
+			ticks = nil
+			require.Equal(t, want, run(t, time.Minute, code))
+		}
+	})
+
+	t.Run("simulation ends while waiting", func(t *testing.T) {
+		var ticks int
+		history := run(t, 10*time.Second,
+			desim.MakeActor("waiter", func(env desim.Env) bool {
+				clock := env.Clock()
+				<-clock.After(time.Hour)
+				return true
+			}),
+			desim.MakeActor("ticker", func(env desim.Env) bool {
+				clock := env.Clock()
+				ticker := clock.NewTicker(3 * time.Second)
+				for {
+					<-ticker.C()
+					ticks++
+				}
+			}),
+		)
+		require.Equal(t, 3, ticks)
+		require.NotEmpty(t, history)
+	})
+
+	t.Run("real clock", func(t *testing.T) {
+		clock := desim.RealClock()
+		began := clock.Now()
+		clock.Sleep(time.Millisecond)
+		<-clock.After(time.Millisecond)
+		i, _ := clock.Wait(clock.NewTimer(time.Hour), clock.NewTimer(time.Millisecond))
+		require.Equal(t, 1, i)
+		require.True(t, time.Since(began) >= 3*time.Millisecond)
+		require.True(t, clock.NewTimer(time.Hour).Stop())
+		fired := make(chan struct{})
+		clock.AfterFunc(time.Millisecond, func() { close(fired) })
+		<-fired
+	})
+}
+
+// loopback serves the scheduler made by mkSchd to its actors over the
+// network, dropping the connection after every dropAfter responses.
+func loopback(t testing.TB, network string, dropAfter int, opts ...desim.RemoteOption) desim.SchedulerFn {
+	return func(actorCount int, resources []desim.Resource) (desim.Scheduler, desim.SchedulerClient) {
+		addr := "127.0.0.1:0"
+		if network == "unix" {
+			addr = filepath.Join(t.TempDir(), "scheduler.sock")
+		}
+		l, err := net.Listen(network, addr)
+		require.NoError(t, err)
+		schd, client := desim.NewLocalScheduler(actorCount, resources)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() {
+			served <- desim.ServeScheduler(ctx, &flakyListener{Listener: l, dropAfter: dropAfter}, client, opts...)
+		}()
+
+		remote, err := desim.DialScheduler(network, l.Addr().String(), append(opts, desim.WithRedial(time.Millisecond, 100))...)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			cancel()
+			require.NoError(t, <-served)
+			require.NoError(t, remote.Close())
+		})
+		return schd, remote
+	}
+}
+
+// flakyListener accepts connections that break after so many writes.
+type flakyListener struct {
+	net.Listener
+	dropAfter int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || l.dropAfter == 0 {
+		return conn, err
+	}
+	return &flakyConn{Conn: conn, writesLeft: l.dropAfter}, nil
+}
+
+type flakyConn struct {
+	net.Conn
+	mu         sync.Mutex
+	writesLeft int
+}
+
+func (conn *flakyConn) Write(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.writesLeft == 0 {
+		_ = conn.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	conn.writesLeft--
+	return conn.Conn.Write(b)
+}
+
+func TestRemoteScheduler(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		network   string
+		dropAfter int
+		opts      []desim.RemoteOption
+	}{
+		{name: "tcp", network: "tcp"},
+		{name: "unix", network: "unix"},
+		{name: "json", network: "tcp", opts: []desim.RemoteOption{desim.WithCodec(desim.JSONCodec)}},
+		{name: "reconnecting", network: "tcp", dropAfter: 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range conformanceModels {
+				t.Run(m.name, func(t *testing.T) {
+					want := runModel(t, desim.NewLocalScheduler, m)
+					got := runModel(t, loopback(t, tt.network, tt.dropAfter, tt.opts...), m)
+					require.Equal(t, want, got)
+				})
+			}
+		})
+	}
+
+	t.Run("filters can't go over the network", func(t *testing.T) {
+		store := desim.MakeStore("store", 1)
+		sim := desim.New(
+			loopback(t, "tcp", 0),
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(time.Unix(0, 0)),
+			gen.StaticTime(time.Unix(10, 0)),
+		)
+		_, err := sim.RunContext(context.Background(), []*desim.Actor{
+			desim.MakeActor("picky", func(env desim.Env) bool {
+				env.StoreGetFilter(store, func(interface{}) bool { return true }, gen.StaticDuration(time.Second))
+				return false
+			}),
+		}, []desim.Resource{store}, desim.LogMute())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "functions can't go over the network")
+	})
+
+	t.Run("no scheduler", func(t *testing.T) {
+		sim := desim.New(
+			desim.RemoteScheduler("tcp", "127.0.0.1:1", desim.WithRedial(time.Millisecond, 3)),
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(time.Unix(0, 0)),
+			gen.StaticTime(time.Unix(10, 0)),
+		)
+		_, err := sim.RunContext(context.Background(), []*desim.Actor{
+			desim.MakeActor("lonely", clock(3, time.Second)),
+		}, nil, desim.LogMute())
+		require.Error(t, err)
+	})
+}
+
+func TestConservativeScheduler(t *testing.T) {
+	lookahead := func(from, to int) time.Duration { return 100 * time.Millisecond }
+	for _, m := range conformanceModels {
+		t.Run(m.name, func(t *testing.T) {
+			want := runModel(t, desim.NewLocalScheduler, m)
+			partition := desim.Partition{Processes: 3, Actor: m.split, Lookahead: lookahead}
+			for i := 0; i < 5; i++ {
+				got := runModel(t, desim.NewConservativeScheduler(partition), m)
+				require.Equal(t, want, got)
+			}
+		})
+	}
+
+	t.Run("hash partition", func(t *testing.T) {
+		m := conformanceModels[len(conformanceModels)-1]
+		want := runModel(t, desim.NewLocalScheduler, m)
+		got := runModel(t, desim.NewConservativeScheduler(desim.HashPartition(4, 100*time.Millisecond)), m)
+		require.Equal(t, want, got)
+	})
+
+	run := func(partition desim.Partition, actors []*desim.Actor, resources ...desim.Resource) error {
+		sim := desim.New(
+			desim.NewConservativeScheduler(partition),
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(time.Unix(0, 0)),
+			gen.StaticTime(time.Unix(10, 0)),
+		)
+		_, err := sim.RunContext(context.Background(), actors, resources, desim.LogMute())
+		return err
+	}
+	apart := desim.Partition{
+		Processes: 2,
+		Actor:     func(actor string) int { return map[string]int{"a": 0, "b": 1}[actor] },
+		Lookahead: lookahead,
+	}
+
+	t.Run("resources can't be shared", func(t *testing.T) {
+		lock := desim.MakeFIFOResource("lock", 1)
+		err := run(apart, []*desim.Actor{
+			desim.MakeActor("a", clock(3, time.Second)),
+			desim.MakeActor("b", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				release, _ := env.Acquire(lock, gen.StaticDuration(time.Second))
+				release()
+				return false
+			}),
+		}, lock)
+		require.ErrorIs(t, err, desim.ErrCrossPartition)
+	})
+
+	t.Run("messages can't beat the lookahead", func(t *testing.T) {
+		err := run(apart, []*desim.Actor{
+			desim.MakeActor("a", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				env.Send("b", "hurry", gen.StaticDuration(10*time.Millisecond))
+				return false
+			}),
+			desim.MakeActor("b", func(env desim.Env) bool {
+				_, received := env.Receive(gen.StaticDuration(5 * time.Second))
+				return received
+			}),
+		})
+		require.ErrorIs(t, err, desim.ErrCrossPartition)
+	})
+}
+
+// A tally counts what an actor did, like the tokens it passed on, how
+// many times it was restored is shared by the actors.
+type tally struct {
+	count    int
+	restores *int64
+}
+
+func (t *tally) Snapshot() ([]byte, error) { return []byte(strconv.Itoa(t.count)), nil }
+
+func (t *tally) Restore(snapshot []byte) error {
+	count, err := strconv.Atoi(string(snapshot))
+	if err != nil {
+		return err
+	}
+	t.count = count
+	atomic.AddInt64(t.restores, 1)
+	return nil
+}
+
+func TestOptimisticScheduler(t *testing.T) {
+	for _, m := range conformanceModels {
+		t.Run(m.name, func(t *testing.T) {
+			want := runModel(t, desim.NewLocalScheduler, m)
+			partition := desim.Partition{Processes: 3, Actor: m.split}
+			for _, window := range []time.Duration{0, 100 * time.Millisecond} {
+				for i := 0; i < 2; i++ {
+					got := runModel(t, desim.NewOptimisticScheduler(partition, window), m)
+					require.Equal(t, want, got)
+				}
+			}
+		})
+	}
+
+	t.Run("hash partition", func(t *testing.T) {
+		m := conformanceModels[len(conformanceModels)-1]
+		want := runModel(t, desim.NewLocalScheduler, m)
+		got := runModel(t, desim.NewOptimisticScheduler(desim.HashPartition(4, 0), 100*time.Millisecond), m)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("rollbacks", func(t *testing.T) {
+		var restores int64
+		m := model{name: "tally", end: 10 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+			// the first node is slow, the others run ahead of it
+			const nodes = 6
+			node := func(i int) string { return fmt.Sprintf("node%02d", i) }
+			var actors []*desim.Actor
+			for i := 0; i < nodes; i++ {
+				i, state := i, &tally{restores: &restores}
+				actors = append(actors, desim.MakeActor(node(i), func(env desim.Env) bool {
+					msg, received := env.Receive(gen.StaticDuration(time.Second))
+					if i == 0 {
+						time.Sleep(time.Millisecond)
+					}
+					delay := gen.StaticDuration(time.Duration(1+env.Rand().Intn(300)) * time.Millisecond)
+					if !received {
+						env.Send(node((i+1)%nodes), state.count, delay)
+						return true
+					}
+					state.count++
+					env.Send(node((i+1)%nodes), state.count+msg.Payload.(int), delay)
+					return true
+				}, desim.WithSnapshotter(state)))
+			}
+			return actors, nil
+		}, split: func(actor string) int {
+			var i int
+			_, _ = fmt.Sscanf(actor, "node%d", &i)
+			return i % 3
+		}}
+		want := runModel(t, desim.NewLocalScheduler, m)
+		got := runModel(t, desim.NewOptimisticScheduler(desim.Partition{Processes: 3, Actor: m.split}, 0), m)
+		require.Equal(t, want, got)
+		require.NotZero(t, atomic.LoadInt64(&restores))
+	})
+
+	t.Run("rollbacks go back to the latest save", func(t *testing.T) {
+		var calls int64
+		m := model{name: "straggler", end: 10 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+			return []*desim.Actor{
+				desim.MakeActor("a", func(env desim.Env) bool {
+					env.Sleep(gen.StaticDuration(9 * time.Second))
+					// b runs ahead meanwhile
+					time.Sleep(50 * time.Millisecond)
+					env.Send("b", "late", gen.StaticDuration(time.Millisecond))
+					return false
+				}),
+				desim.MakeActor("b", func(env desim.Env) bool {
+					atomic.AddInt64(&calls, 1)
+					_, _ = env.Receive(gen.StaticDuration(10 * time.Millisecond))
+					return true
+				}),
+			}, nil
+		}, split: func(actor string) int {
+			return map[string]int{"a": 0, "b": 1}[actor]
+		}}
+		want := runModel(t, desim.NewLocalScheduler, m)
+		atomic.StoreInt64(&calls, 0)
+		got := runModel(t, desim.NewOptimisticScheduler(desim.Partition{Processes: 2, Actor: m.split}, 0), m)
+		require.Equal(t, want, got)
+		// b made a thousand calls, it didn't make the first 900 again
+		require.Less(t, atomic.LoadInt64(&calls), int64(1200))
+	})
+
+	run := func(actors []*desim.Actor, resources ...desim.Resource) error {
+		sim := desim.New(
+			desim.NewOptimisticScheduler(desim.Partition{
+				Processes: 2,
+				Actor:     func(actor string) int { return map[string]int{"a": 0, "b": 1}[actor] },
+			}, 0),
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(time.Unix(0, 0)),
+			gen.StaticTime(time.Unix(10, 0)),
+		)
+		_, err := sim.RunContext(context.Background(), actors, resources, desim.LogMute())
+		return err
+	}
+
+	t.Run("resources can't be shared", func(t *testing.T) {
+		lock := desim.MakeFIFOResource("lock", 1)
+		err := run([]*desim.Actor{
+			desim.MakeActor("a", clock(3, time.Second)),
+			desim.MakeActor("b", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				release, _ := env.Acquire(lock, gen.StaticDuration(time.Second))
+				release()
+				return false
+			}),
+		}, lock)
+		require.ErrorIs(t, err, desim.ErrCrossPartition)
+	})
+
+	t.Run("messages take some time", func(t *testing.T) {
+		err := run([]*desim.Actor{
+			desim.MakeActor("a", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				env.Send("b", "now", gen.StaticDuration(0))
+				return false
+			}),
+			desim.MakeActor("b", func(env desim.Env) bool {
+				_, received := env.Receive(gen.StaticDuration(5 * time.Second))
+				return received
+			}),
+		})
+		require.ErrorIs(t, err, desim.ErrCrossPartition)
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	run := func(mkSchd desim.SchedulerFn, m model, opts ...desim.Option) ([]string, error) {
+		sim := desim.New(
+			mkSchd,
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(start),
+			gen.StaticTime(start.Add(m.end)),
+			opts...,
+		)
+		actors, resources := m.make()
+		res, err := sim.RunContext(context.Background(), actors, resources, desim.LogMute())
+		if err != nil {
+			return nil, err
+		}
+		history := make([]string, 0, len(res.History))
+		for _, ev := range res.History {
+			history = append(history, fmt.Sprintf("%v %s %q", ev.Time.Sub(start), ev.Actor, ev.Kind))
+		}
+		return history, nil
+	}
+	// checkpoint runs a model, taking a checkpoint halfway through, and
+	// reads it back
+	checkpoint := func(t *testing.T, mkSchd desim.SchedulerFn, m model) ([]string, *desim.Checkpoint) {
+		var saved bytes.Buffer
+		history, err := run(mkSchd, m, desim.WithCheckpoint(start.Add(m.end/2), func(cp *desim.Checkpoint) error {
+			_, err := cp.WriteTo(&saved)
+			return err
+		}))
+		require.NoError(t, err)
+		cp, err := desim.ReadCheckpoint(&saved)
+		require.NoError(t, err)
+		return history, cp
+	}
+
+	for _, m := range conformanceModels {
+		t.Run(m.name, func(t *testing.T) {
+			want, cp := checkpoint(t, desim.NewLocalScheduler, m)
+			require.Equal(t, start.Add(m.end/2), cp.Time)
+			got, err := run(desim.NewLocalScheduler, m, desim.WithRestore(cp))
+			require.NoError(t, err)
+			require.Equal(t, want[cp.Events:], got)
+		})
+	}
+
+	// the tokens go around a ring of actors that count them
+	ring := func(first int) model {
+		return model{name: "ring", end: 10 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+			const nodes = 4
+			node := func(i int) string { return fmt.Sprintf("node%d", i) }
+			var actors []*desim.Actor
+			for i := 0; i < nodes; i++ {
+				i, state := i, &tally{count: first, restores: new(int64)}
+				actors = append(actors, desim.MakeActor(node(i), func(env desim.Env) bool {
+					msg, received := env.Receive(gen.StaticDuration(time.Second))
+					next := node((i + 1) % nodes)
+					if !received {
+						env.Send(next, state.count, gen.StaticDuration(time.Duration(1+env.Rand().Intn(300))*time.Millisecond))
+						return true
+					}
+					state.count++
+					env.Send(next, state.count+msg.Payload.(int), gen.StaticDuration(100*time.Millisecond))
+					return true
+				}, desim.WithSnapshotter(state)))
+			}
+			return actors, nil
+		}}
+	}
+
+	t.Run("actors start from their snapshot", func(t *testing.T) {
+		want, cp := checkpoint(t, desim.NewLocalScheduler, ring(0))
+		require.NotEmpty(t, cp.Actors[0].State)
+		got, err := run(desim.NewLocalScheduler, ring(1000), desim.WithRestore(cp))
+		require.NoError(t, err)
+		require.Equal(t, want[cp.Events:], got)
+	})
+
+	// the worker counts its calls, in which it does two things
+	worker := func(calls *int, first, second func(env desim.Env)) model {
+		return model{name: "worker", end: 10 * time.Second, make: func() ([]*desim.Actor, []desim.Resource) {
+			return []*desim.Actor{desim.MakeActor("worker", func(env desim.Env) bool {
+				*calls++
+				first(env)
+				second(env)
+				return true
+			})}, nil
+		}}
+	}
+	sleep := func(env desim.Env) { env.Sleep(gen.StaticDuration(time.Second)) }
+	receive := func(env desim.Env) { env.Receive(gen.StaticDuration(time.Second)) }
+
+	t.Run("actors go on from the call they were in", func(t *testing.T) {
+		var calls int
+		want, cp := checkpoint(t, desim.NewLocalScheduler, worker(&calls, sleep, sleep))
+		// the calls start at 0s, 2s, ... and 10s, when the simulation ends
+		require.Equal(t, 6, calls)
+		calls = 0
+		got, err := run(desim.NewLocalScheduler, worker(&calls, sleep, sleep), desim.WithRestore(cp))
+		require.NoError(t, err)
+		require.Equal(t, want[cp.Events:], got)
+		// the call at 4s, that waited at the checkpoint, then those at 6s,
+		// 8s and 10s
+		require.Equal(t, 4, calls)
+	})
+
+	t.Run("actors must make the same requests", func(t *testing.T) {
+		var calls int
+		_, cp := checkpoint(t, desim.NewLocalScheduler, worker(&calls, sleep, sleep))
+		// the worker slept before the checkpoint
+		_, err := run(desim.NewLocalScheduler, worker(&calls, receive, sleep), desim.WithRestore(cp))
+		require.ErrorIs(t, err, desim.ErrNotDeterministic)
+		// and was sleeping at the checkpoint
+		_, err = run(desim.NewLocalScheduler, worker(&calls, sleep, receive), desim.WithRestore(cp))
+		require.ErrorIs(t, err, desim.ErrNotDeterministic)
+	})
+
+	t.Run("the actors must be those of the checkpoint", func(t *testing.T) {
+		_, cp := checkpoint(t, desim.NewLocalScheduler, ring(0))
+		other := conformanceModels[len(conformanceModels)-1]
+		other.end = ring(0).end
+		_, err := run(desim.NewLocalScheduler, other, desim.WithRestore(cp))
+		require.Error(t, err)
+	})
+
+	t.Run("the simulation must get to the checkpoint", func(t *testing.T) {
+		m := ring(0)
+		_, cp := checkpoint(t, desim.NewLocalScheduler, m)
+		m.end /= 4
+		_, err := run(desim.NewLocalScheduler, m, desim.WithRestore(cp))
+		require.Error(t, err)
+	})
+
+	t.Run("parallel schedulers don't take checkpoints", func(t *testing.T) {
+		_, err := run(desim.NewConservativeScheduler(desim.HashPartition(2, time.Second)), ring(0), desim.WithCheckpoint(start, func(*desim.Checkpoint) error { return nil }))
+		require.Error(t, err)
+	})
+}
+
+func TestFork(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	newSim := func(mkSchd desim.SchedulerFn, end time.Duration) desim.Simulation {
+		return desim.New(
+			mkSchd,
+			rand.New(rand.NewSource(42)),
+			gen.StaticTime(start),
+			gen.StaticTime(start.Add(end)),
+		)
+	}
+	kinds := func(events []*desim.Event) []string {
+		history := make([]string, 0, len(events))
+		for _, ev := range events {
+			history = append(history, fmt.Sprintf("%v %s %q", ev.Time.Sub(start), ev.Actor, ev.Kind))
+		}
+		return history
+	}
+
+	for _, m := range conformanceModels {
+		t.Run(m.name, func(t *testing.T) {
+			want := runModel(t, desim.NewLocalScheduler, m)
+			branch, err := newSim(desim.NewLocalScheduler, m.end).RunUntil(context.Background(), start.Add(m.end/2), m.make, desim.LogMute())
+			require.NoError(t, err)
+			events := branch.Checkpoint.Events
+			require.Equal(t, want[:events], describeHistory(start, branch.Result.History))
+
+			results, err := branch.Forks(context.Background(), nil, nil)
+			require.NoError(t, err)
+			for _, res := range results {
+				require.Equal(t, want[events:], describeHistory(start, res.History))
+			}
+		})
+	}
+
+	// the ticker sleeps as many seconds as its state says, the receiver
+	// waits for messages
+	model := func() ([]*desim.Actor, []desim.Resource) {
+		state := &tally{count: 1, restores: new(int64)}
+		return []*desim.Actor{
+			desim.MakeActor("ticker", func(env desim.Env) bool {
+				return !env.Sleep(gen.StaticDuration(time.Duration(state.count) * time.Second))
+			}, desim.WithSnapshotter(state)),
+			desim.MakeActor("receiver", func(env desim.Env) bool {
+				_, received := env.Receive(gen.StaticDuration(time.Hour))
+				return received
+			}),
+		}, nil
+	}
+	branch, err := newSim(desim.NewLocalScheduler, 10*time.Second).RunUntil(context.Background(), start.Add(5*time.Second), model, desim.LogMute())
+	require.NoError(t, err)
+
+	t.Run("interventions", func(t *testing.T) {
+		branch, err := newSim(desim.NewLocalScheduler, 10*time.Second).RunUntil(context.Background(), start.Add(5*time.Second), model, desim.LogMute())
+		require.NoError(t, err)
+		results, err := branch.Forks(context.Background(),
+			[]desim.Intervention{desim.ChangeActor("ticker", func(state desim.Snapshotter) error {
+				state.(*tally).count = 2
+				return nil
+			})},
+			[]desim.Intervention{desim.InjectMessage("receiver", "hello", time.Second)},
+			[]desim.Intervention{desim.SpawnActor(desim.MakeActor("newcomer", func(env desim.Env) bool {
+				env.Sleep(gen.StaticDuration(time.Second))
+				return false
+			}))},
+		)
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			`6s ticker "waited a delay"`,
+			`8s ticker "waited a delay"`,
+			`10s ticker "waited a delay"`,
+		}, kinds(results[0].History))
+		require.Equal(t, []string{
+			`6s receiver "delivered injected message"`,
+			`6s receiver "received message after waiting"`,
+			`6s ticker "waited a delay"`,
+			`7s ticker "waited a delay"`,
+			`8s ticker "waited a delay"`,
+			`9s ticker "waited a delay"`,
+			`10s ticker "waited a delay"`,
+		}, kinds(results[1].History))
+		require.Equal(t, []string{
+			`6s newcomer "waited a delay"`,
+			`6s newcomer "actor is done"`,
+			`6s ticker "waited a delay"`,
+			`7s ticker "waited a delay"`,
+			`8s ticker "waited a delay"`,
+			`9s ticker "waited a delay"`,
+			`10s ticker "waited a delay"`,
+		}, kinds(results[2].History))
+	})
+
+	t.Run("forks don't run the history before the branch", func(t *testing.T) {
+		var before int64
+		model := func() ([]*desim.Actor, []desim.Resource) {
+			return []*desim.Actor{
+				desim.MakeActor("ticker", func(env desim.Env) bool {
+					if env.Now().Before(start.Add(5 * time.Second)) {
+						atomic.AddInt64(&before, 1)
+					}
+					return !env.Sleep(gen.StaticDuration(time.Second))
+				}),
+			}, nil
+		}
+		atomic.StoreInt64(&before, 0)
+		branch, err := newSim(desim.NewLocalScheduler, 10*time.Second).RunUntil(context.Background(), start.Add(5*time.Second), model, desim.LogMute())
+		require.NoError(t, err)
+		// the calls at 0s, 1s, ... and 4s
+		require.Equal(t, int64(5), atomic.LoadInt64(&before))
+		results, err := branch.Forks(context.Background(), nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), atomic.LoadInt64(&before))
+		for _, res := range results {
+			require.Equal(t, []string{
+				`6s ticker "waited a delay"`,
+				`7s ticker "waited a delay"`,
+				`8s ticker "waited a delay"`,
+				`9s ticker "waited a delay"`,
+				`10s ticker "waited a delay"`,
+			}, kinds(res.History))
+		}
+	})
+
+	t.Run("more capacity", func(t *testing.T) {
+		model := func() ([]*desim.Actor, []desim.Resource) {
+			desk := desim.MakeFIFOResource("desk", 1)
+			clerk := func(env desim.Env) bool {
+				release, obtained := env.Acquire(desk, gen.StaticDuration(time.Hour))
+				if obtained {
+					env.Sleep(gen.StaticDuration(3 * time.Second))
+					release()
+				}
+				return obtained
+			}
+			return []*desim.Actor{
+				desim.MakeActor("a", clerk),
+				desim.MakeActor("b", clerk),
+			}, []desim.Resource{desk}
+		}
+		branch, err := newSim(desim.NewLocalScheduler, 10*time.Second).RunUntil(context.Background(), start.Add(5*time.Second), model, desim.LogMute())
+		require.NoError(t, err)
+		var at time.Time
+		results, err := branch.Forks(context.Background(),
+			nil,
+			[]desim.Intervention{func(fork *desim.Fork) error {
+				at = fork.Time()
+				return desim.SetCapacity("desk", 2)(fork)
+			}},
+		)
+		require.NoError(t, err)
+		require.Equal(t, start.Add(5*time.Second), at)
+		require.Equal(t, 1, results[0].Resources["desk"].Capacity)
+		require.Equal(t, 2, results[1].Resources["desk"].Capacity)
+		require.Equal(t, []string{
+			`6s a "waited a delay"`,
+			`6s a "released resource"`,
+			`6s b "acquired resource after waiting"`,
+			`9s b "waited a delay"`,
+			`9s b "released resource"`,
+			`9s a "acquired resource after waiting"`,
+		}, kinds(results[0].History))
+		require.Equal(t, []string{
+			`5s b "acquired resource after waiting"`,
+			`6s a "waited a delay"`,
+			`6s a "released resource"`,
+			`6s a "acquired resource immediately"`,
+			`8s b "waited a delay"`,
+			`8s b "released resource"`,
+			`8s b "acquired resource immediately"`,
+			`9s a "waited a delay"`,
+			`9s a "released resource"`,
+			`9s a "acquired resource immediately"`,
+		}, kinds(results[1].History))
+	})
+
+	t.Run("spawned actors draw apart from the others", func(t *testing.T) {
+		var first, spawned int64
+		model := func() ([]*desim.Actor, []desim.Resource) {
+			return []*desim.Actor{
+				desim.MakeActor("first", func(env desim.Env) bool {
+					if env.Now().Equal(start) {
+						first = env.Rand().Int63()
+					}
+					return !env.Sleep(gen.StaticDuration(time.Second))
+				}),
+			}, nil
+		}
+		branch, err := newSim(desim.NewLocalScheduler, 10*time.Second).RunUntil(context.Background(), start.Add(5*time.Second), model, desim.LogMute())
+		require.NoError(t, err)
+		_, err = branch.Fork(context.Background(), desim.SpawnActor(desim.MakeActor("spawned", func(env desim.Env) bool {
+			spawned = env.Rand().Int63()
+			return false
+		})))
+		require.NoError(t, err)
+		require.NotZero(t, first)
+		require.NotEqual(t, first, spawned)
+	})
+
+	t.Run("interventions that can't apply", func(t *testing.T) {
+		for _, intervention := range []desim.Intervention{
+			desim.SetCapacity("unknown", 2),
+			desim.ChangeActor("receiver", func(desim.Snapshotter) error { return nil }),
+			desim.SpawnActor(desim.MakeActor("ticker", func(desim.Env) bool { return false })),
+		} {
+			_, err := branch.Fork(context.Background(), intervention)
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("branches must be before the end", func(t *testing.T) {
+		_, err := newSim(desim.NewLocalScheduler, 10*time.Second).RunUntil(context.Background(), start.Add(time.Minute), model, desim.LogMute())
+		require.Error(t, err)
+	})
+}
@@ -2,9 +2,13 @@
 package desim
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math/rand"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aybabtme/desim/pkg/gen"
@@ -13,19 +17,73 @@ import (
 type SchedulerFn func(actorCount int, res []Resource) (Scheduler, SchedulerClient)
 
 type Simulation interface {
+	// Run the simulation, panicking if it fails.
 	Run([]*Actor, []Resource, Logger) []*Event
+	// RunContext runs the simulation until it completes, fails or
+	// the context is cancelled.
+	RunContext(context.Context, []*Actor, []Resource, Logger) (*Result, error)
+	// RunUntil runs the simulation of a model until the given time, and
+	// returns a branch to fork it from there.
+	RunUntil(ctx context.Context, until time.Time, model Model, actorlog Logger) (*Branch, error)
+}
+
+// Result of a simulation.
+type Result struct {
+	// History of the events, only kept if the simulation is using the
+	// default event sink.
+	History []*Event
+	// Resources are the statistics gathered on each resource, by name.
+	Resources map[string]*ResourceStats
+	// Containers are the statistics gathered on each container, by name.
+	Containers map[string]*ContainerStats
+	// Stores are the statistics gathered on each store, by name. Their
+	// level is the number of items they hold.
+	Stores map[string]*ContainerStats
+	// Deadlocks are the deadlocks found, if the simulation reports them.
+	Deadlocks []*Deadlock
+	// Leaks are the reservations that actors didn't release before they
+	// were done, or before the simulation ended.
+	Leaks []*Leak
 }
 
 type Actor struct {
 	name   string
 	action Action
+	state  Snapshotter
 }
 
-func MakeActor(name string, action Action) *Actor {
-	return &Actor{
+func MakeActor(name string, action Action, opts ...ActorOption) *Actor {
+	actor := &Actor{
 		name:   name,
 		action: action,
 	}
+	for _, opt := range opts {
+		opt(actor)
+	}
+	return actor
+}
+
+// An ActorOption changes how an actor is made.
+type ActorOption func(*Actor)
+
+// A Snapshotter saves and restores the state that an actor keeps between
+// the calls to its action, like the variables its closure captures.
+// Schedulers that run actors again from their start, like
+// NewOptimisticScheduler, restore it first. Simulations that take
+// checkpoints snapshot it when each call starts, to restore the call that
+// waited on the scheduler at the checkpoint.
+type Snapshotter interface {
+	// Snapshot encodes the state.
+	Snapshot() ([]byte, error)
+	// Restore sets the state back to a snapshot. It may be given the same
+	// snapshot more than once.
+	Restore(snapshot []byte) error
+}
+
+// WithSnapshotter gives the state of the actor. It's snapshotted before
+// the simulation starts.
+func WithSnapshotter(state Snapshotter) ActorOption {
+	return func(actor *Actor) { actor.state = state }
 }
 
 type Action func(Env) bool
@@ -33,15 +91,37 @@ type Action func(Env) bool
 type Env interface {
 	Now() time.Time
 	Rand() *rand.Rand
+	// Clock is a clock in the simulated time of the actor, whose timers
+	// are events of the scheduler. C waits until its timer fires, so it
+	// must be called for every receive. Only the goroutine of the actor
+	// may use it.
+	Clock() Clock
 
 	IsRunning() bool
 
 	Sleep(gen.Duration) (interrupted bool)
+	Interrupt(actor, cause string)
+	Interruption() *Interruption
 	Abort()
 	Done(gen.Duration)
 
-	Acquire(res Resource, timeout gen.Duration) (release func(), obtained bool)
-	UseAsync(res Resource, duration, timeout gen.Duration) (obtained bool)
+	Acquire(res Resource, timeout gen.Duration, opts ...AcquireOption) (release func(), obtained bool)
+	AcquireN(res Resource, n int, timeout gen.Duration, opts ...AcquireOption) (release func(), obtained bool)
+	AcquireAll(res []Resource, timeout gen.Duration, opts ...AcquireOption) (release func(), obtained bool)
+	UseAsync(res Resource, duration, timeout gen.Duration, opts ...AcquireOption) (obtained bool)
+
+	Put(c Container, amount float64, timeout gen.Duration) (ok bool)
+	Get(c Container, amount float64, timeout gen.Duration) (ok bool)
+
+	StorePut(s Store, item interface{}) (ok bool)
+	StoreGet(s Store, timeout gen.Duration) (item interface{}, ok bool)
+	StoreGetFilter(s Store, match func(item interface{}) bool, timeout gen.Duration) (item interface{}, ok bool)
+
+	Spawn(name string, action Action)
+	Join(actor string, timeout gen.Duration) (joined bool)
+
+	Send(to string, payload interface{}, delay gen.Duration)
+	Receive(timeout gen.Duration) (msg *Message, received bool)
 
 	Log() Logger
 }
@@ -53,72 +133,409 @@ type Logger interface {
 	Event(string)
 }
 
+// An AcquireOption changes how a resource is acquired.
+type AcquireOption func(*acquireOptions)
+
+type acquireOptions struct {
+	priority int32
+}
+
+// WithPriority acquires a resource with the given priority. Priority
+// resources serve higher priorities first, and the events of the request
+// are ordered by this priority when they happen at the same time. The
+// default priority is 0.
+func WithPriority(priority int32) AcquireOption {
+	return func(opts *acquireOptions) { opts.priority = priority }
+}
+
+func makeAcquireOptions(opts []AcquireOption) acquireOptions {
+	var acqOpts acquireOptions
+	for _, opt := range opts {
+		opt(&acqOpts)
+	}
+	return acqOpts
+}
+
+// An Option changes how a simulation is run.
+type Option func(*sim)
+
+// WithEventSink sends the events of the simulation to the given sink,
+// instead of keeping all of them in memory.
+func WithEventSink(sink EventSink) Option {
+	return func(sim *sim) { sim.sink = sink }
+}
+
+// WithDeadlockDetection looks for actors waiting on each other for
+// resources, or joining each other, every time all the actors are waiting
+// on the scheduler. The policy says whether deadlocks are reported in the
+// result or abort the simulation.
+func WithDeadlockDetection(policy DeadlockPolicy) Option {
+	return func(sim *sim) { sim.deadlocks = policy }
+}
+
 // New creates a simulation that will start from the given time.
-func New(mkSchd SchedulerFn, r *rand.Rand, start, end gen.Time) Simulation {
-	return &sim{mkSchd: mkSchd, r: r, start: start, end: end}
+func New(mkSchd SchedulerFn, r *rand.Rand, start, end gen.Time, opts ...Option) Simulation {
+	sim := &sim{mkSchd: mkSchd, r: r, start: start, end: end}
+	for _, opt := range opts {
+		opt(sim)
+	}
+	return sim
 }
 
 type sim struct {
-	mkSchd     SchedulerFn
-	r          *rand.Rand
-	start, end gen.Time
+	mkSchd      SchedulerFn
+	r           *rand.Rand
+	start, end  gen.Time
+	sink        EventSink
+	deadlocks   DeadlockPolicy
+	mkList      func() EventList
+	pacer       *Pacer
+	checkpoints []checkpointRequest
+	restore     *Checkpoint
+	// samples is true if the statistics keep their samples
+	samples bool
+	// interventions change the simulation at the checkpoint it goes on
+	// from
+	interventions []Intervention
 }
 
 func (sim *sim) Run(actors []*Actor, resources []Resource, actorlog Logger) []*Event {
+	res, err := sim.RunContext(context.Background(), actors, resources, actorlog)
+	if err != nil {
+		panic(err)
+	}
+	return res.History
+}
+
+func (sim *sim) RunContext(ctx context.Context, actors []*Actor, resources []Resource, actorlog Logger) (*Result, error) {
 
 	var (
-		r     = rand.New(rand.NewSource(sim.r.Int63()))
+		seed  = sim.r.Int63()
 		start = sim.start.Gen()
 		end   = sim.end.Gen()
 	)
+	if sim.restore != nil {
+		// the simulation goes on from the checkpoint
+		seed, start = sim.restore.Seed, sim.restore.Time
+		if end.Before(start) {
+			return nil, fmt.Errorf("the simulation ends at %v, before the checkpoint at %v", end, start)
+		}
+	}
+	r := rand.New(rand.NewSource(seed))
 	schd, client := sim.mkSchd(len(actors), resources)
+	// the options apply to the scheduler under the wrappers
+	inner := schd
+	for {
+		w, ok := inner.(wrappingScheduler)
+		if !ok {
+			break
+		}
+		inner = w.unwrap()
+	}
+	var detector deadlockDetector
+	if sim.deadlocks != IgnoreDeadlocks {
+		var ok bool
+		detector, ok = inner.(deadlockDetector)
+		if !ok {
+			return nil, fmt.Errorf("scheduler %T can't detect deadlocks", inner)
+		}
+		detector.detectDeadlocks(sim.deadlocks)
+	}
+	if sim.mkList != nil {
+		lister, ok := inner.(eventLister)
+		if !ok {
+			return nil, fmt.Errorf("scheduler %T can't use another event list", inner)
+		}
+		lister.useEventList(sim.mkList())
+	}
+	if sim.pacer != nil {
+		paced, ok := inner.(pacedScheduler)
+		if !ok {
+			return nil, fmt.Errorf("scheduler %T can't be paced", inner)
+		}
+		paced.paceWith(sim.pacer)
+	}
 
-	var wg sync.WaitGroup
-	for id, actor := range actors {
+	for _, resource := range resources {
+		switch resource := resource.(type) {
+		case slotResource:
+			resource.monitor().samples = sim.samples
+		case Container:
+			resource.monitor().samples = sim.samples
+		case Store:
+			resource.monitor().samples = sim.samples
+		}
+	}
+
+	// the state of the actors when they start, to start them again
+	snapshots := make([][]byte, len(actors))
+	if _, ok := inner.(restartingScheduler); ok {
+		for i, actor := range actors {
+			if actor.state == nil {
+				continue
+			}
+			snapshot, err := actor.state.Snapshot()
+			if err != nil {
+				return nil, fmt.Errorf("snapshotting actor %q: %w", actor.name, err)
+			}
+			snapshots[i] = snapshot
+		}
+	}
+
+	sink := sim.sink
+	history, keepHistory := sink.(*SliceSink)
+	if sink == nil {
+		// keep everything in memory by default
+		history, keepHistory = SinkSlice(), true
+		sink = history
+	}
+	var checkpoints *checkpointer
+	if len(sim.checkpoints) > 0 || sim.restore != nil {
+		taker, ok := inner.(checkpointingScheduler)
+		if !ok {
+			return nil, fmt.Errorf("scheduler %T can't take checkpoints", inner)
+		}
+		checkpoints = newCheckpointer(seed, start, sink, sim.restore)
+		sink = checkpoints.sink
+		for _, req := range sim.checkpoints {
+			taker.checkpointAt(req.at, checkpoints.save(req.save))
+		}
+		if sim.restore != nil {
+			state, err := decodeSchedulerState(sim.restore.Scheduler)
+			if err != nil {
+				return nil, err
+			}
+			taker.goOnFrom(state, checkpoints.resumed)
+		}
+	} else if _, ok := inner.(restartingScheduler); ok {
+		// the scheduler saves the actors in memory, to roll them back
+		checkpoints = newCheckpointer(seed, start, sink, nil)
+		checkpoints.memory = true
+	}
+
+	var (
+		wg    sync.WaitGroup
+		late  lateReleases
+		run   func(client SchedulerClient, actor *Actor, env *env)
+		spawn func(client SchedulerClient, seed int64, now time.Time, actor *Actor)
+	)
+	spawn = func(client SchedulerClient, seed int64, now time.Time, actor *Actor) {
+		actorEnv := makeEnv(seed, now, client, actorlog.KV("actor", actor.name), actor.name)
+		if checkpoints != nil {
+			checkpoints.started(actor, seed, actorEnv)
+		}
+		run(client, actor, actorEnv)
+	}
+	run = func(client SchedulerClient, actor *Actor, actorEnv *env) {
 		wg.Add(1)
-		env := makeEnv(r.Int63(), start, client, actorlog.KV("actor", actor.name), actor.name)
-		go func(id int, env Env, actor *Actor) {
+		group, _ := client.(actorGroup)
+		if group != nil {
+			group.actorStarted()
+		}
+		actorEnv.spawn = spawn
+		actorEnv.late = &late
+		go func(env *env, actor *Actor) {
 			defer wg.Done()
+			if group != nil {
+				defer group.actorExited()
+			}
+			defer atomic.StoreInt32(&env.exited, 1)
 			defer func() {
 				if e := recover(); e != nil {
 					if e == stopAllActors {
 						// the simulation stopped
 						return
 					}
-					panic(e)
+					// let the scheduler know, it will stop the simulation
+					_ = client.Schedule(&Request{
+						Actor: env.actorName,
+						Type: &RequestType{
+							Panic: &RequestPanic{Time: env.now, Value: e, Stack: debug.Stack()},
+						},
+					})
 				}
 			}()
 			for env.IsRunning() {
+				if env.call != nil {
+					env.call.start(env, actor.state)
+				}
 				if !actor.action(env) {
+					// the others may go on before the goroutine returns
+					atomic.StoreInt32(&env.exited, 1)
 					env.Done(gen.StaticDuration(0))
 					return
 				}
 			}
-		}(id, env, actor)
+		}(actorEnv, actor)
+	}
+	if len(sim.interventions) > 0 {
+		// the simulation goes on from a checkpoint, so the scheduler
+		// takes them
+		checkpoints.fork = &Fork{
+			at:            sim.restore.Time,
+			interventions: sim.interventions,
+			schd:          inner.(checkpointingScheduler).local(),
+			checkpoints:   checkpoints,
+			r:             rand.New(rand.NewSource(spawnSeed(seed, sim.restore.EventID))),
+			spawn: func(seed int64, actor *Actor) {
+				spawn(client, seed, sim.restore.Time, actor)
+			},
+		}
+	}
+	given := make(map[string]*Actor, len(actors))
+	for _, actor := range actors {
+		given[actor.name] = actor
+	}
+	resume := func(cp *Checkpoint, client SchedulerClient) error {
+		resumed, envs, err := checkpoints.resume(cp, given, func(actor *Actor, seed int64, now time.Time) *env {
+			return makeEnv(seed, now, client, actorlog.KV("actor", actor.name), actor.name)
+		})
+		if err != nil {
+			return err
+		}
+		for i, actor := range resumed {
+			run(client, actor, envs[i])
+		}
+		return nil
+	}
+	if sim.restore != nil {
+		// the actors go on from the checkpoint
+		saved := make(map[string]bool, len(sim.restore.Actors))
+		for _, actor := range sim.restore.Actors {
+			saved[actor.Name] = true
+		}
+		for _, actor := range actors {
+			if !saved[actor.name] {
+				return nil, fmt.Errorf("actor %q isn't in the checkpoint", actor.name)
+			}
+		}
+		if err := resume(sim.restore, client); err != nil {
+			return nil, err
+		}
+	} else if restarter, ok := inner.(restartingScheduler); ok {
+		// the scheduler starts the actors, maybe more than once
+		var (
+			names   = make([]string, len(actors))
+			seeds   = make([]int64, len(actors))
+			started = make([]bool, len(actors))
+		)
+		for i, actor := range actors {
+			names[i], seeds[i] = actor.name, r.Int63()
+		}
+		restarter.startActorsWith(names, func(i int, client SchedulerClient) error {
+			actor := actors[i]
+			if started[i] && actor.state != nil {
+				if err := actor.state.Restore(snapshots[i]); err != nil {
+					return fmt.Errorf("restoring actor %q: %w", actor.name, err)
+				}
+			}
+			started[i] = true
+			spawn(client, seeds[i], start, actor)
+			return nil
+		})
+		restarter.resumeActorsWith(checkpoints.complete, resume)
+	} else {
+		for _, actor := range actors {
+			spawn(client, r.Int63(), start, actor)
+		}
 	}
 
-	history := schd.Run(r, start, end)
+	err := schd.Run(ctx, r, start, end, sink)
 	wg.Wait()
-	return history
+	if err == nil {
+		err = late.err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Resources:  make(map[string]*ResourceStats),
+		Containers: make(map[string]*ContainerStats),
+		Stores:     make(map[string]*ContainerStats),
+	}
+	if keepHistory {
+		res.History = history.Events
+	}
+	if detector != nil {
+		res.Deadlocks = detector.deadlocks()
+	}
+	if reporter, ok := inner.(leakReporter); ok {
+		res.Leaks = reporter.leaks()
+	}
+	for _, resource := range resources {
+		switch resource := resource.(type) {
+		case slotResource:
+			stats := resource.monitor().stats
+			res.Resources[resource.id()] = &stats
+		case Container:
+			stats := resource.monitor().stats
+			res.Containers[resource.id()] = &stats
+		case Store:
+			stats := resource.monitor().stats
+			res.Stores[resource.id()] = &stats
+		}
+	}
+	return res, nil
+}
+
+// wrappingScheduler is implemented by the schedulers that add to another
+// scheduler, like serving it to remote actors.
+type wrappingScheduler interface {
+	unwrap() Scheduler
+}
+
+// restartingScheduler is implemented by the schedulers that start the
+// actors themselves, so that they can start them again.
+type restartingScheduler interface {
+	// startActorsWith is given the names of the actors before the
+	// simulation runs. The scheduler starts them with start, which
+	// restores the state of an actor if it was started before. Each
+	// actor makes its requests to the client it's started with, and so
+	// do the actors it spawns.
+	startActorsWith(actors []string, start func(actor int, client SchedulerClient) error)
+	// resumeActorsWith is given how to save the actors in a checkpoint
+	// the scheduler keeps in memory, with the actors of its state, and
+	// how to resume them from it. They make their requests to the
+	// client they're resumed with.
+	resumeActorsWith(save func(cp *Checkpoint) error, resume func(cp *Checkpoint, client SchedulerClient) error)
+}
+
+// actorGroup is implemented by the clients that keep track of the
+// goroutines of the actors making requests to them.
+type actorGroup interface {
+	actorStarted()
+	actorExited()
 }
 
 func makeEnv(seed int64, now time.Time, schd SchedulerClient, log Logger, actorName string) *env {
-	r := rand.New(rand.NewSource(seed))
-	return &env{r: r, now: now, schd: schd, log: log, actorName: actorName, aborted: false, stopped: false}
+	src := &countingSource{Source64: rand.NewSource(seed).(rand.Source64)}
+	return &env{r: rand.New(src), src: src, now: now, schd: schd, log: log, actorName: actorName, aborted: false, stopped: false}
 }
 
 var _ Env = (*env)(nil)
 
 type env struct {
 	r    *rand.Rand
+	src  *countingSource
 	now  time.Time
 	schd SchedulerClient
 	log  Logger
 
 	actorName string
+	spawn     func(client SchedulerClient, seed int64, now time.Time, actor *Actor)
 
 	aborted bool
 	stopped bool
+	// exited is set once the actor is done or its goroutine returned
+	exited int32
+	// late records the releases that came after exited was set
+	late  *lateReleases
+	clock *envClock
+
+	interruption *Interruption
+	// call logs the current call of the actor, if the simulation can be
+	// checkpointed
+	call *actorCall
 }
 
 func (env *env) Now() time.Time   { return env.now }
@@ -129,33 +546,51 @@ func (env *env) IsRunning() bool  { return !env.aborted || !env.stopped }
 func (env *env) Sleep(d gen.Duration) (interrupted bool) {
 	resp := env.send(0, &RequestType{
 		Delay: &RequestDelay{Delay: d.Gen()},
-	}, false, 0)
+	}, 0, false, 0)
 	return resp.Interrupted
 }
 
+func (env *env) Interrupt(actor, cause string) {
+	_ = env.send(0, &RequestType{
+		Interrupt: &RequestInterrupt{Actor: actor, Cause: cause},
+	}, 0, false, 0)
+}
+
+// Interruption returns what woke up the actor during its last call, or
+// nil if the call wasn't interrupted.
+func (env *env) Interruption() *Interruption { return env.interruption }
+
 func (env *env) Abort() {
 	env.stopped = true
 	env.aborted = true
 	_ = env.send(SignalAbort, &RequestType{
 		Abort: &RequestAbort{},
-	}, false, 0)
+	}, 0, false, 0)
 }
 
 func (env *env) Done(d gen.Duration) {
 	env.stopped = true
 	_ = env.send(SignalActorDone, &RequestType{
 		Done: &RequestDone{},
-	}, false, 0)
+	}, 0, false, 0)
+}
+
+func (env *env) Acquire(res Resource, timeout gen.Duration, opts ...AcquireOption) (release func(), obtained bool) {
+	return env.AcquireN(res, 1, timeout, opts...)
 }
 
-func (env *env) Acquire(res Resource, timeout gen.Duration) (release func(), obtained bool) {
+// AcquireN waits until n slots of the resource are free and takes them
+// all. The release function gives them all back.
+func (env *env) AcquireN(res Resource, n int, timeout gen.Duration, opts ...AcquireOption) (release func(), obtained bool) {
+	acqOpts := makeAcquireOptions(opts)
 	resp := env.send(0, &RequestType{
 		AcquireResource: &RequestAcquireResource{
 			ResourceID: res.id(),
+			Units:      n,
 			Timeout:    timeout.Gen(),
 		},
-	}, false, 0)
-	if resp.Timedout {
+	}, acqOpts.priority, false, 0)
+	if resp.Timedout || resp.Interrupted {
 		return nil, false
 	}
 	releaseReq := &RequestType{
@@ -165,20 +600,105 @@ func (env *env) Acquire(res Resource, timeout gen.Duration) (release func(), obt
 		},
 	}
 	releaseFn := func() {
-		_ = env.send(0, releaseReq, false, 0)
+		if env.releasedLate(res) {
+			return
+		}
+		_ = env.send(0, releaseReq, acqOpts.priority, false, 0)
 	}
 
 	return releaseFn, true
 }
 
-func (env *env) UseAsync(res Resource, duration, timeout gen.Duration) (obtained bool) {
+// AcquireAll waits until a slot of every resource is free and takes them
+// all at once, or none of them. It doesn't wait in the line of the
+// resources, so it doesn't hold some slots while waiting for the others.
+// The release function gives them all back.
+func (env *env) AcquireAll(res []Resource, timeout gen.Duration, opts ...AcquireOption) (release func(), obtained bool) {
+	acqOpts := makeAcquireOptions(opts)
+	ids := make([]string, 0, len(res))
+	for _, r := range res {
+		ids = append(ids, r.id())
+	}
+	resp := env.send(0, &RequestType{
+		AcquireResources: &RequestAcquireResources{
+			ResourceIDs: ids,
+			Timeout:     timeout.Gen(),
+		},
+	}, acqOpts.priority, false, 0)
+	if resp.Timedout || resp.Interrupted {
+		return nil, false
+	}
+	// a resource that is claimed twice only has one reservation
+	var releaseIDs []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			releaseIDs = append(releaseIDs, id)
+		}
+	}
+	releaseReq := &RequestType{
+		ReleaseResources: &RequestReleaseResources{
+			ResourceIDs:     releaseIDs,
+			ReservationKeys: resp.ReservationKeys,
+		},
+	}
+	releaseFn := func() {
+		if env.releasedLate(res...) {
+			return
+		}
+		_ = env.send(0, releaseReq, acqOpts.priority, false, 0)
+	}
+	return releaseFn, true
+}
+
+// releasedLate records a reservation of the actor that is released
+// after the actor is done, or after the simulation ended. There's nothing
+// left to release it, the simulation fails with ErrReleaseAfterEnd
+// instead.
+func (env *env) releasedLate(res ...Resource) bool {
+	if atomic.LoadInt32(&env.exited) == 0 {
+		return false
+	}
+	ids := make([]string, 0, len(res))
+	for _, r := range res {
+		ids = append(ids, r.id())
+	}
+	env.late.record(fmt.Errorf("%w: actor %q released %v after it was done or the simulation ended", ErrReleaseAfterEnd, env.actorName, ids))
+	return true
+}
+
+// lateReleases keeps the first release that came after its actor exited,
+// from whichever goroutine made it. Those made after RunContext returned
+// have no simulation left to fail.
+type lateReleases struct {
+	mu    sync.Mutex
+	first error
+}
+
+func (late *lateReleases) record(err error) {
+	late.mu.Lock()
+	defer late.mu.Unlock()
+	if late.first == nil {
+		late.first = err
+	}
+}
+
+func (late *lateReleases) err() error {
+	late.mu.Lock()
+	defer late.mu.Unlock()
+	return late.first
+}
+
+func (env *env) UseAsync(res Resource, duration, timeout gen.Duration, opts ...AcquireOption) (obtained bool) {
+	acqOpts := makeAcquireOptions(opts)
 	resp := env.send(0, &RequestType{
 		AcquireResource: &RequestAcquireResource{
 			ResourceID: res.id(),
 			Timeout:    timeout.Gen(),
 		},
-	}, false, 0)
-	if resp.Timedout {
+	}, acqOpts.priority, false, 0)
+	if resp.Timedout || resp.Interrupted {
 		return false
 	}
 	// we don't wait
@@ -187,21 +707,134 @@ func (env *env) UseAsync(res Resource, duration, timeout gen.Duration) (obtained
 			ResourceID:     res.id(),
 			ReservationKey: resp.ReservationKey,
 		},
-	}, true, duration.Gen())
+	}, acqOpts.priority, true, duration.Gen())
 
 	return true
 }
 
+// Put waits until there's room in the container, then adds the amount to
+// it.
+func (env *env) Put(c Container, amount float64, timeout gen.Duration) (ok bool) {
+	resp := env.send(0, &RequestType{
+		PutContainer: &RequestPutContainer{
+			ContainerID: c.id(),
+			Amount:      amount,
+			Timeout:     timeout.Gen(),
+		},
+	}, 0, false, 0)
+	return !resp.Timedout && !resp.Interrupted
+}
+
+// Get waits until the container holds at least the amount, then takes it
+// out.
+func (env *env) Get(c Container, amount float64, timeout gen.Duration) (ok bool) {
+	resp := env.send(0, &RequestType{
+		GetContainer: &RequestGetContainer{
+			ContainerID: c.id(),
+			Amount:      amount,
+			Timeout:     timeout.Gen(),
+		},
+	}, 0, false, 0)
+	return !resp.Timedout && !resp.Interrupted
+}
+
+// StorePut waits until there's room in the store, then puts the item in
+// it. It only fails if the actor is interrupted.
+func (env *env) StorePut(s Store, item interface{}) (ok bool) {
+	resp := env.send(0, &RequestType{
+		PutStore: &RequestPutStore{
+			StoreID: s.id(),
+			Item:    item,
+		},
+	}, 0, false, 0)
+	return !resp.Interrupted
+}
+
+// StoreGet waits until the store holds an item, then takes it out.
+func (env *env) StoreGet(s Store, timeout gen.Duration) (item interface{}, ok bool) {
+	return env.storeGet(s, nil, timeout)
+}
+
+// StoreGetFilter waits until a filter store holds an item matching the
+// predicate, then takes it out. The predicate is called by the scheduler
+// and must not use the Env.
+func (env *env) StoreGetFilter(s Store, match func(item interface{}) bool, timeout gen.Duration) (item interface{}, ok bool) {
+	return env.storeGet(s, match, timeout)
+}
+
+func (env *env) storeGet(s Store, match func(item interface{}) bool, timeout gen.Duration) (item interface{}, ok bool) {
+	resp := env.send(0, &RequestType{
+		GetStore: &RequestGetStore{
+			StoreID: s.id(),
+			Filter:  match,
+			Timeout: timeout.Gen(),
+		},
+	}, 0, false, 0)
+	if resp.Timedout || resp.Interrupted {
+		return nil, false
+	}
+	return resp.Item, true
+}
+
+// Spawn starts a new actor in the simulation. The name of the actor must
+// be unique.
+func (env *env) Spawn(name string, action Action) {
+	// the new actor gets its own stream of random numbers
+	seed := env.r.Int63()
+	// an actor resuming from a checkpoint spawned it before, the
+	// checkpoint has it
+	replayed := env.call != nil && env.call.replaying
+	resp := env.send(0, &RequestType{
+		Spawn: &RequestSpawn{Actor: name},
+	}, 0, false, 0)
+	if !replayed {
+		env.spawn(env.schd, seed, resp.Now, MakeActor(name, action))
+	}
+}
+
+// Join waits until the given actor is done.
+func (env *env) Join(actor string, timeout gen.Duration) (joined bool) {
+	resp := env.send(0, &RequestType{
+		Join: &RequestJoin{
+			Actor:   actor,
+			Timeout: timeout.Gen(),
+		},
+	}, 0, false, 0)
+	return !resp.Timedout && !resp.Interrupted
+}
+
+func (env *env) Send(to string, payload interface{}, delay gen.Duration) {
+	// we don't wait for the message to be delivered
+	_ = env.send(0, &RequestType{
+		SendMessage: &RequestSendMessage{
+			To:      to,
+			Payload: payload,
+		},
+	}, 0, true, delay.Gen())
+}
+
+func (env *env) Receive(timeout gen.Duration) (msg *Message, received bool) {
+	resp := env.send(0, &RequestType{
+		ReceiveMessage: &RequestReceiveMessage{
+			Timeout: timeout.Gen(),
+		},
+	}, 0, false, 0)
+	if resp.Timedout || resp.Interrupted {
+		return nil, false
+	}
+	return resp.Message, true
+}
+
 var stopAllActors = struct{}{}
 
-func (env *env) send(sig Signal, reqType *RequestType, async bool, asyncDelay time.Duration) *Response {
+func (env *env) send(sig Signal, reqType *RequestType, priority int32, async bool, asyncDelay time.Duration) *Response {
 	if D {
 		log.Printf("%q: sending an event", env.actorName)
 	}
-	resp := env.schd.Schedule(&Request{
+	req := &Request{
 		Actor:    env.actorName,
 		Type:     reqType,
-		Priority: 0,
+		Priority: priority,
 		TieBreakers: [4]int32{
 			env.r.Int31(),
 			env.r.Int31(),
@@ -212,8 +845,22 @@ func (env *env) send(sig Signal, reqType *RequestType, async bool, asyncDelay ti
 		Labels:     map[string]string{"name": env.actorName},
 		Async:      async,
 		AsyncDelay: asyncDelay,
-	})
+	}
+	var resp *Response
+	switch call := env.call; {
+	case call != nil && call.replaying:
+		// the actor resumed from a checkpoint, it made the request before
+		resp = call.replay(env.actorName, reqType)
+	case call != nil:
+		resp = env.schd.Schedule(req)
+		if !resp.Done {
+			call.log(reqType, resp)
+		}
+	default:
+		resp = env.schd.Schedule(req)
+	}
 	env.now = resp.Now
+	env.interruption = resp.Interruption
 	if resp.Done {
 		if !env.stopped {
 			env.stopped = resp.Done
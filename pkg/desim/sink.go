@@ -0,0 +1,138 @@
+package desim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// An EventSink receives the events of a simulation as they happen.
+type EventSink interface {
+	Handle(*Event) error
+}
+
+// SinkDiscard drops every event.
+func SinkDiscard() EventSink { return discardSink{} }
+
+type discardSink struct{}
+
+func (discardSink) Handle(*Event) error { return nil }
+
+// SinkSlice keeps every event in memory.
+func SinkSlice() *SliceSink { return &SliceSink{} }
+
+// SliceSink keeps every event in memory.
+type SliceSink struct {
+	Events []*Event
+}
+
+func (sink *SliceSink) Handle(ev *Event) error {
+	sink.Events = append(sink.Events, ev)
+	return nil
+}
+
+// SinkRing keeps only the last `size` events in memory.
+func SinkRing(size int) *RingSink {
+	return &RingSink{buf: make([]*Event, size)}
+}
+
+// RingSink keeps the last events in a bounded buffer.
+type RingSink struct {
+	buf   []*Event
+	head  int
+	count int
+}
+
+func (sink *RingSink) Handle(ev *Event) error {
+	if len(sink.buf) == 0 {
+		return nil
+	}
+	sink.buf[sink.head] = ev
+	sink.head = (sink.head + 1) % len(sink.buf)
+	if sink.count < len(sink.buf) {
+		sink.count++
+	}
+	return nil
+}
+
+// Events returns the events kept in the buffer, from oldest to newest.
+func (sink *RingSink) Events() []*Event {
+	out := make([]*Event, 0, sink.count)
+	if sink.count == 0 {
+		return out
+	}
+	first := (sink.head - sink.count + len(sink.buf)) % len(sink.buf)
+	for i := 0; i < sink.count; i++ {
+		out = append(out, sink.buf[(first+i)%len(sink.buf)])
+	}
+	return out
+}
+
+// SinkJSON writes each event as a line of JSON.
+func SinkJSON(w io.Writer) EventSink {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+type jsonSink struct {
+	enc *json.Encoder
+}
+
+type jsonEvent struct {
+	ID              int               `json:"id"`
+	Time            time.Time         `json:"time"`
+	Actor           string            `json:"actor"`
+	Kind            string            `json:"kind"`
+	Priority        int32             `json:"priority,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Interrupted     bool              `json:"interrupted,omitempty"`
+	Timedout        bool              `json:"timedout,omitempty"`
+	ReservationKey  string            `json:"reservation_key,omitempty"`
+	ReservationKeys []string          `json:"reservation_keys,omitempty"`
+	Message         *jsonMessage      `json:"message,omitempty"`
+	Interruption    *jsonInterruption `json:"interruption,omitempty"`
+	ItemKind        string            `json:"item_kind,omitempty"`
+}
+
+type jsonMessage struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+type jsonInterruption struct {
+	By        string        `json:"by"`
+	Cause     string        `json:"cause"`
+	Resource  string        `json:"resource,omitempty"`
+	Remaining time.Duration `json:"remaining,omitempty"`
+}
+
+func (sink *jsonSink) Handle(ev *Event) error {
+	jev := jsonEvent{
+		ID:              ev.ID,
+		Time:            ev.Time,
+		Actor:           ev.Actor,
+		Kind:            ev.Kind,
+		Priority:        ev.Priority,
+		Labels:          ev.Labels,
+		Interrupted:     ev.Interrupted,
+		Timedout:        ev.Timedout,
+		ReservationKey:  ev.ReservationKey,
+		ReservationKeys: ev.ReservationKeys,
+	}
+	if msg := ev.Message; msg != nil {
+		jev.Message = &jsonMessage{From: msg.From, To: msg.To, Kind: msg.Kind()}
+	}
+	if intr := ev.Interruption; intr != nil {
+		jev.Interruption = &jsonInterruption{
+			By:        intr.By,
+			Cause:     intr.Cause,
+			Resource:  intr.Resource,
+			Remaining: intr.Remaining,
+		}
+	}
+	if ev.Item != nil {
+		jev.ItemKind = fmt.Sprintf("%T", ev.Item)
+	}
+	return sink.enc.Encode(jev)
+}
@@ -0,0 +1,281 @@
+package desim
+
+import (
+	"time"
+)
+
+// A Store is a resource holding items, like the parts waiting between two
+// workstations. Actors put items in it and get items out of it, waiting
+// until there's room or an item is available.
+type Store interface {
+	Resource
+	// Len is the number of items in the store. Actors can look at it
+	// during their actions.
+	Len() int
+	// Capacity is the largest number of items the store can hold.
+	Capacity() int
+
+	monitor() *containerMonitor
+	// filters is true if gets can wait for an item matching a predicate
+	filters() bool
+	// request to put or get an item, serving the requests that can be
+	// satisfied. The request waits in line if it isn't served.
+	request(req *storeRequest, now time.Time, notify func(*storeRequest)) *storeRequest
+	// cancel gives up on a request that is waiting in line. The requests
+	// it was holding up must be served afterward.
+	cancel(req *storeRequest, now time.Time, timedout bool)
+	// serve the requests that can be satisfied, in the order they were
+	// made
+	serve(now time.Time, notify func(*storeRequest))
+	// save describes the items, the requests in line and the statistics
+	// of the store, restore sets them back. The requests of filter stores
+	// are restored without their filter.
+	save() *savedStore
+	restore(saved *savedStore)
+	// waitingFor is the request of an actor waiting in line, or nil
+	waitingFor(actor string, put bool) *storeRequest
+}
+
+// MakeStore makes a store holding up to capacity items. Items are taken
+// out in the order they were put in. Puts and gets are each served in
+// first-in first-out order.
+func MakeStore(name string, capacity int) Store {
+	return &store{name: name, capacity: capacity}
+}
+
+// MakeFilterStore makes a store from which actors can get the first item
+// matching a predicate, with Env.StoreGetFilter. A get waiting for an
+// item that isn't there doesn't hold up the gets behind it.
+func MakeFilterStore(name string, capacity int) Store {
+	return &store{name: name, capacity: capacity, filter: true}
+}
+
+type storeRequest struct {
+	put         bool
+	actor       string
+	item        interface{}
+	match       func(item interface{}) bool
+	requestedAt time.Time
+
+	served    bool
+	waiting   bool
+	cancelled bool
+}
+
+type store struct {
+	name     string
+	capacity int
+	filter   bool
+
+	items   []interface{}
+	puts    []*storeRequest
+	gets    []*storeRequest
+	waiting int
+
+	mon containerMonitor
+}
+
+func (s *store) id() string                 { return s.name }
+func (s *store) Len() int                   { return len(s.items) }
+func (s *store) Capacity() int              { return s.capacity }
+func (s *store) monitor() *containerMonitor { return &s.mon }
+func (s *store) filters() bool              { return s.filter }
+
+func (s *store) begin(now time.Time) {
+	s.items, s.puts, s.gets, s.waiting = nil, nil, nil, 0
+	s.mon.begin(s.name, float64(s.capacity), 0, now)
+}
+
+func (s *store) end(now time.Time) { s.mon.end(now) }
+
+func (s *store) request(req *storeRequest, now time.Time, notify func(*storeRequest)) *storeRequest {
+	req.requestedAt = now
+	if req.put {
+		s.puts = append(s.puts, req)
+	} else {
+		s.gets = append(s.gets, req)
+	}
+	s.serve(now, notify)
+	if !req.served {
+		req.waiting = true
+		s.waiting++
+		s.mon.setQueued(now, s.waiting)
+	}
+	return req
+}
+
+func (s *store) cancel(req *storeRequest, now time.Time, timedout bool) {
+	if req.cancelled || req.served {
+		return
+	}
+	// it will be skipped when its turn comes
+	req.cancelled = true
+	s.waiting--
+	s.mon.setQueued(now, s.waiting)
+	if timedout {
+		s.mon.timedout()
+	}
+}
+
+func (s *store) serve(now time.Time, notify func(*storeRequest)) {
+	for progress := true; progress; {
+		progress = false
+		for len(s.puts) > 0 {
+			req := s.puts[0]
+			if !req.cancelled {
+				if len(s.items) >= s.capacity {
+					break
+				}
+				s.items = append(s.items, req.item)
+				s.served(req, now, notify)
+				progress = true
+			}
+			s.puts[0] = nil
+			s.puts = s.puts[1:]
+		}
+		if s.serveGets(now, notify) {
+			progress = true
+		}
+	}
+}
+
+func (s *store) serveGets(now time.Time, notify func(*storeRequest)) (progress bool) {
+	if !s.filter {
+		for len(s.gets) > 0 {
+			req := s.gets[0]
+			if !req.cancelled {
+				if len(s.items) == 0 {
+					break
+				}
+				req.item = s.items[0]
+				s.items[0] = nil
+				s.items = s.items[1:]
+				s.served(req, now, notify)
+				progress = true
+			}
+			s.gets[0] = nil
+			s.gets = s.gets[1:]
+		}
+		return progress
+	}
+	// every get takes the first item it wants, in the order of the gets
+	waiting := s.gets[:0]
+	for _, req := range s.gets {
+		if req.cancelled {
+			continue
+		}
+		i := s.find(req.match)
+		if i < 0 {
+			waiting = append(waiting, req)
+			continue
+		}
+		req.item = s.items[i]
+		copy(s.items[i:], s.items[i+1:])
+		s.items[len(s.items)-1] = nil
+		s.items = s.items[:len(s.items)-1]
+		s.served(req, now, notify)
+		progress = true
+	}
+	for i := len(waiting); i < len(s.gets); i++ {
+		s.gets[i] = nil
+	}
+	s.gets = waiting
+	return progress
+}
+
+func (s *store) find(match func(item interface{}) bool) int {
+	for i, item := range s.items {
+		if match == nil || match(item) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *store) served(req *storeRequest, now time.Time, notify func(*storeRequest)) {
+	req.served = true
+	if req.waiting {
+		s.waiting--
+		s.mon.setQueued(now, s.waiting)
+	}
+	s.mon.served(now, req.put, req.requestedAt, float64(len(s.items)))
+	notify(req)
+}
+
+// savedStore is a store in a checkpoint.
+type savedStore struct {
+	Name       string
+	Items      []interface{}
+	Puts, Gets []savedStoreRequest
+	Waiting    int
+	Monitor    savedContainerMonitor
+}
+
+// savedStoreRequest is a storeRequest waiting in line in a checkpoint.
+type savedStoreRequest struct {
+	Actor       string
+	Item        interface{}
+	RequestedAt time.Time
+	Waiting     bool
+	Cancelled   bool
+}
+
+func saveStoreRequests(reqs []*storeRequest) []savedStoreRequest {
+	saved := make([]savedStoreRequest, 0, len(reqs))
+	for _, req := range reqs {
+		saved = append(saved, savedStoreRequest{
+			Actor:       req.actor,
+			Item:        req.item,
+			RequestedAt: req.requestedAt,
+			Waiting:     req.waiting,
+			Cancelled:   req.cancelled,
+		})
+	}
+	return saved
+}
+
+func restoreStoreRequests(put bool, saved []savedStoreRequest) []*storeRequest {
+	reqs := make([]*storeRequest, 0, len(saved))
+	for _, req := range saved {
+		reqs = append(reqs, &storeRequest{
+			put:         put,
+			actor:       req.Actor,
+			item:        req.Item,
+			requestedAt: req.RequestedAt,
+			waiting:     req.Waiting,
+			cancelled:   req.Cancelled,
+		})
+	}
+	return reqs
+}
+
+func (s *store) save() *savedStore {
+	return &savedStore{
+		Name:    s.name,
+		Items:   append([]interface{}(nil), s.items...),
+		Puts:    saveStoreRequests(s.puts),
+		Gets:    saveStoreRequests(s.gets),
+		Waiting: s.waiting,
+		Monitor: s.mon.save(),
+	}
+}
+
+func (s *store) restore(saved *savedStore) {
+	s.items, s.waiting = append([]interface{}(nil), saved.Items...), saved.Waiting
+	s.puts = restoreStoreRequests(true, saved.Puts)
+	s.gets = restoreStoreRequests(false, saved.Gets)
+	s.mon.restore(saved.Monitor)
+}
+
+func (s *store) waitingFor(actor string, put bool) *storeRequest {
+	reqs := s.gets
+	if put {
+		reqs = s.puts
+	}
+	for _, req := range reqs {
+		if req.actor == actor && !req.cancelled {
+			return req
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package desim
+
+import "time"
+
+// timer is a handle on an event of the scheduler, which can be stopped
+// or moved until it happens, in O(log n). The timeouts of the requests and
+// the timers of Env.Clock are timers.
+type timer struct {
+	events EventList
+	ev     *Event
+}
+
+// newTimer makes a timer for an event, without scheduling it.
+func (schd *localScheduler) newTimer(ev *Event) *timer {
+	return &timer{events: schd.events, ev: ev}
+}
+
+// startTimer schedules an event, returning a timer for it.
+func (schd *localScheduler) startTimer(ev *Event) *timer {
+	t := schd.newTimer(ev)
+	t.events.Push(ev)
+	return t
+}
+
+// cancelTimeout stops the timeout of a waiting actor. The actor won't be
+// answered by it.
+func (schd *localScheduler) cancelTimeout(waiting *waitingRequest) {
+	waiting.timeout.Stop()
+	delete(schd.pendingResponse, waiting.timeout.ev.ID)
+}
+
+// When the event happens.
+func (t *timer) When() time.Time { return t.ev.Time }
+
+// Pending is true until the event happens or the timer is stopped.
+func (t *timer) Pending() bool { return t.events.Contains(t.ev) }
+
+// Stop prevents the event from happening. It returns false if it already
+// happened or the timer was already stopped.
+func (t *timer) Stop() bool { return t.events.Remove(t.ev) }
+
+// Reset moves the event to happen at another time, scheduling it again if
+// it already happened or the timer was stopped. It returns true if the
+// event was pending.
+func (t *timer) Reset(at time.Time) bool {
+	pending := t.events.Remove(t.ev)
+	// an event list may still hold on to the stopped event, it's queued
+	// again as a copy
+	moved := *t.ev
+	moved.Time = at
+	moved.index = 0
+	t.ev = &moved
+	t.events.Push(t.ev)
+	return pending
+}
@@ -0,0 +1,153 @@
+package experiment
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// A Param is a dimension of the parameter space of a sweep. Grid designs
+// use its levels, sampling designs draw values in [Min, Max].
+type Param struct {
+	Name   string
+	Levels []float64
+	Min    float64
+	Max    float64
+}
+
+// Levels is a parameter taking the given values. Sampling designs draw
+// values between the smallest and the largest level.
+func Levels(name string, levels ...float64) Param {
+	p := Param{Name: name, Levels: levels}
+	for i, lvl := range levels {
+		if i == 0 || lvl < p.Min {
+			p.Min = lvl
+		}
+		if i == 0 || lvl > p.Max {
+			p.Max = lvl
+		}
+	}
+	return p
+}
+
+// Range is a parameter going from min to max. Grid designs use n evenly
+// spaced levels, including both bounds.
+func Range(name string, min, max float64, n int) Param {
+	p := Param{Name: name, Min: min, Max: max}
+	switch {
+	case n == 1:
+		p.Levels = []float64{min + (max-min)/2}
+	case n > 1:
+		step := (max - min) / float64(n-1)
+		for i := 0; i < n; i++ {
+			p.Levels = append(p.Levels, min+float64(i)*step)
+		}
+	}
+	return p
+}
+
+// A Point of the parameter space, giving a value to each parameter by
+// name.
+type Point map[string]float64
+
+// A Design chooses the points of the parameter space to evaluate.
+type Design func(space []Param) ([]Point, error)
+
+// FullFactorial evaluates every combination of the levels of the
+// parameters. The first parameter varies the slowest.
+func FullFactorial() Design {
+	return func(space []Param) ([]Point, error) {
+		if err := validateSpace(space); err != nil {
+			return nil, err
+		}
+		points := []Point{{}}
+		for _, p := range space {
+			if len(p.Levels) == 0 {
+				return nil, fmt.Errorf("parameter %q has no levels", p.Name)
+			}
+			next := make([]Point, 0, len(points)*len(p.Levels))
+			for _, pt := range points {
+				for _, lvl := range p.Levels {
+					cp := make(Point, len(pt)+1)
+					for k, v := range pt {
+						cp[k] = v
+					}
+					cp[p.Name] = lvl
+					next = append(next, cp)
+				}
+			}
+			points = next
+		}
+		return points, nil
+	}
+}
+
+// LatinHypercube draws n points such that, for every parameter, each of
+// the n equal intervals of [Min, Max] holds exactly one point.
+func LatinHypercube(n int, seed int64) Design {
+	return func(space []Param) ([]Point, error) {
+		if err := validateSpace(space); err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("need at least 1 point, got %d", n)
+		}
+		r := rand.New(rand.NewSource(seed))
+		points := makePoints(n)
+		for _, p := range space {
+			for i, stratum := range r.Perm(n) {
+				u := (float64(stratum) + r.Float64()) / float64(n)
+				points[i][p.Name] = p.Min + u*(p.Max-p.Min)
+			}
+		}
+		return points, nil
+	}
+}
+
+// RandomSampling draws n points uniformly at random in the parameter
+// space.
+func RandomSampling(n int, seed int64) Design {
+	return func(space []Param) ([]Point, error) {
+		if err := validateSpace(space); err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("need at least 1 point, got %d", n)
+		}
+		r := rand.New(rand.NewSource(seed))
+		points := makePoints(n)
+		for _, pt := range points {
+			for _, p := range space {
+				pt[p.Name] = p.Min + r.Float64()*(p.Max-p.Min)
+			}
+		}
+		return points, nil
+	}
+}
+
+func makePoints(n int) []Point {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = make(Point)
+	}
+	return points
+}
+
+func validateSpace(space []Param) error {
+	if len(space) == 0 {
+		return fmt.Errorf("parameter space is empty")
+	}
+	seen := make(map[string]bool, len(space))
+	for _, p := range space {
+		if p.Name == "" {
+			return fmt.Errorf("parameter has no name")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("parameter %q appears more than once", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Min > p.Max {
+			return fmt.Errorf("parameter %q has min %g greater than max %g", p.Name, p.Min, p.Max)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package experiment_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aybabtme/desim/pkg/desim"
+	"github.com/aybabtme/desim/pkg/experiment"
+	"github.com/aybabtme/desim/pkg/gen"
+)
+
+// bank is a model of customers arriving at random at a single teller.
+func bank(ctx context.Context, seed int64) (experiment.Outputs, error) {
+	return queue(ctx, time.Minute, 45*time.Second, seed)
+}
+
+// bankAt is the bank model, where the mean time between arrivals and the
+// mean service time are parameters given in seconds.
+func bankAt(ctx context.Context, point experiment.Point, seed int64) (experiment.Outputs, error) {
+	arrival := time.Duration(point["arrival_secs"] * float64(time.Second))
+	service := time.Duration(point["service_secs"] * float64(time.Second))
+	return queue(ctx, arrival, service, seed)
+}
+
+func queue(ctx context.Context, meanArrival, meanService time.Duration, seed int64) (experiment.Outputs, error) {
+	var (
+		r     = rand.New(rand.NewSource(seed))
+		start = time.Unix(0, 0).UTC()
+		end   = start.Add(2 * time.Hour)
+	)
+	sim := desim.New(
+		desim.NewLocalScheduler,
+		r,
+		gen.StaticTime(start),
+		gen.StaticTime(end),
+	)
+
+	teller := desim.MakeFIFOResource("teller", 1)
+	arrivals := expDuration(rand.New(rand.NewSource(r.Int63())), meanArrival)
+	service := expDuration(rand.New(rand.NewSource(r.Int63())), meanService)
+
+	customer := func(env desim.Env) bool {
+		release, obtained := env.Acquire(teller, gen.StaticDuration(time.Hour))
+		if !obtained {
+			return false
+		}
+		env.Sleep(service)
+		release()
+		return false
+	}
+	count := 0
+	source := func(env desim.Env) bool {
+		env.Sleep(arrivals)
+		count++
+		env.Spawn(fmt.Sprintf("customer%d", count), customer)
+		return true
+	}
+
+	res, err := sim.RunContext(ctx,
+		[]*desim.Actor{desim.MakeActor("source", source)},
+		[]desim.Resource{teller},
+		desim.LogJSON(ioutil.Discard),
+	)
+	if err != nil {
+		return nil, err
+	}
+	stats := res.Resources["teller"]
+	return experiment.Outputs{
+		"utilization":  stats.Utilization,
+		"wait_minutes": stats.MeanWait().Minutes(),
+	}, nil
+}
+
+func ExampleReplicate() {
+	report, err := experiment.Replicate(context.Background(), experiment.Config{
+		Replications: 20,
+		Seed:         42,
+		Confidence:   0.95,
+	}, bank)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("replications: %d\n", report.Replications)
+	for _, name := range report.Names() {
+		sum := report.Outputs[name]
+		fmt.Printf("%s: %.2f [%.2f, %.2f]\n", name, sum.Mean, sum.Lower(), sum.Upper())
+	}
+
+	// Output:
+	// replications: 20
+	// utilization: 0.72 [0.68, 0.76]
+	// wait_minutes: 1.91 [1.26, 2.57]
+}
+
+func ExampleReplicate_stopEarly() {
+	report, err := experiment.Replicate(context.Background(), experiment.Config{
+		Replications:       1000,
+		MinReplications:    5,
+		Seed:               42,
+		TargetRelHalfWidth: 0.1,
+	}, bank)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("stopped early: %v\n", report.StoppedEarly)
+	fmt.Printf("replications: %d\n", report.Replications)
+	for _, name := range report.Names() {
+		fmt.Printf("%s: within %.1f%% of the mean\n", name, report.Outputs[name].RelHalfWidth()*100)
+	}
+
+	// Output:
+	// stopped early: true
+	// replications: 238
+	// utilization: within 1.6% of the mean
+	// wait_minutes: within 10.0% of the mean
+}
+
+func ExampleSweep() {
+	space := []experiment.Param{
+		experiment.Levels("arrival_secs", 60, 90),
+		experiment.Levels("service_secs", 30, 45),
+	}
+	reports, err := experiment.Sweep(context.Background(), space, experiment.FullFactorial(), experiment.Config{
+		Replications: 10,
+		Seed:         42,
+	}, bankAt, nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, report := range reports {
+		wait := report.Outputs["wait_minutes"]
+		fmt.Printf("arrival=%gs service=%gs: wait %.2f [%.2f, %.2f] minutes\n",
+			report.Point["arrival_secs"], report.Point["service_secs"],
+			wait.Mean, wait.Lower(), wait.Upper(),
+		)
+	}
+
+	// Output:
+	// arrival=60s service=30s: wait 0.51 [0.30, 0.73] minutes
+	// arrival=60s service=45s: wait 2.10 [0.79, 3.41] minutes
+	// arrival=90s service=30s: wait 0.28 [0.13, 0.43] minutes
+	// arrival=90s service=45s: wait 0.91 [0.45, 1.36] minutes
+}
+
+func ExampleCSVTable() {
+	space := []experiment.Param{
+		experiment.Range("service_secs", 30, 60, 3),
+	}
+	model := func(ctx context.Context, point experiment.Point, seed int64) (experiment.Outputs, error) {
+		outs, err := bankAt(ctx, experiment.Point{"arrival_secs": 60, "service_secs": point["service_secs"]}, seed)
+		for name, v := range outs {
+			outs[name] = math.Round(v*1000) / 1000
+		}
+		return outs, err
+	}
+	table := experiment.CSVTable(os.Stdout)
+	_, err := experiment.Sweep(context.Background(), space, experiment.FullFactorial(), experiment.Config{
+		Replications: 2,
+		Seed:         42,
+	}, model, table)
+	if err != nil {
+		panic(err)
+	}
+
+	// Output:
+	// point,replication,seed,service_secs,utilization,wait_minutes
+	// 0,0,3440579354231278675,30,0.403,0.407
+	// 0,1,608747136543856411,30,0.532,1.062
+	// 1,0,3440579354231278675,45,0.604,1.333
+	// 1,1,608747136543856411,45,0.797,4.771
+	// 2,0,3440579354231278675,60,0.806,3.174
+	// 2,1,608747136543856411,60,0.999,14.309
+}
+
+func ExampleLatinHypercube() {
+	space := []experiment.Param{
+		experiment.Range("loan_rate", 2, 6, 0),
+		experiment.Range("loan_ltv", 50, 80, 0),
+	}
+	points, err := experiment.LatinHypercube(4, 42)(space)
+	if err != nil {
+		panic(err)
+	}
+	for _, pt := range points {
+		fmt.Printf("loan_rate=%.2f loan_ltv=%.1f\n", pt["loan_rate"], pt["loan_ltv"])
+	}
+
+	// Output:
+	// loan_rate=2.04 loan_ltv=52.7
+	// loan_rate=3.38 loan_ltv=65.9
+	// loan_rate=5.81 loan_ltv=62.5
+	// loan_rate=4.38 loan_ltv=76.0
+}
+
+func expDuration(r *rand.Rand, mean time.Duration) gen.Duration {
+	return gen.DurationFunc(func() time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	})
+}
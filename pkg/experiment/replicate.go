@@ -0,0 +1,260 @@
+// Package experiment runs many replications of a simulation model and
+// summarizes their outputs.
+package experiment
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/aybabtme/desim/pkg/utilmath"
+)
+
+// A Model runs one replication of a simulation, using the given seed for
+// every random decision it makes, and returns the outputs it measured.
+type Model func(ctx context.Context, seed int64) (Outputs, error)
+
+// Outputs are the scalar values measured on a replication, by name.
+type Outputs map[string]float64
+
+// Config of a replication experiment.
+type Config struct {
+	// Replications is the maximum number of replications to run.
+	Replications int
+	// MinReplications is the number of replications to run before
+	// considering to stop early. Defaults to 2.
+	MinReplications int
+	// Workers running replications concurrently. Defaults to GOMAXPROCS.
+	Workers int
+	// Seed from which the seed of each replication is derived.
+	Seed int64
+	// Confidence level of the intervals. Defaults to 0.95.
+	Confidence float64
+	// TargetRelHalfWidth stops the experiment early once the half-width of
+	// the confidence interval of every output, relative to its mean, is at
+	// most this value. Zero disables early stopping.
+	TargetRelHalfWidth float64
+}
+
+// Report summarizes the outputs of the replications.
+type Report struct {
+	Replications int
+	// StoppedEarly is true if the target relative half-width was reached
+	// before running all the replications.
+	StoppedEarly bool
+	Outputs      map[string]*Summary
+}
+
+// Names of the outputs, sorted.
+func (report *Report) Names() []string {
+	names := make([]string, 0, len(report.Outputs))
+	for name := range report.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Summary of the values an output took across replications.
+type Summary struct {
+	N          int
+	Mean       float64
+	Variance   float64
+	Confidence float64
+	// HalfWidth of the Student-t confidence interval around the mean.
+	HalfWidth float64
+
+	m2 float64
+}
+
+// StdDev is the sample standard deviation.
+func (sum *Summary) StdDev() float64 { return math.Sqrt(sum.Variance) }
+
+// Lower bound of the confidence interval.
+func (sum *Summary) Lower() float64 { return sum.Mean - sum.HalfWidth }
+
+// Upper bound of the confidence interval.
+func (sum *Summary) Upper() float64 { return sum.Mean + sum.HalfWidth }
+
+// RelHalfWidth is the half-width of the confidence interval relative to
+// the mean.
+func (sum *Summary) RelHalfWidth() float64 {
+	if sum.Mean == 0 {
+		if sum.HalfWidth == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return math.Abs(sum.HalfWidth / sum.Mean)
+}
+
+func (sum *Summary) String() string {
+	return fmt.Sprintf("%g ± %g (n=%d, %g%% confidence)", sum.Mean, sum.HalfWidth, sum.N, sum.Confidence*100)
+}
+
+// add a value using Welford's online algorithm.
+func (sum *Summary) add(v float64) {
+	sum.N++
+	delta := v - sum.Mean
+	sum.Mean += delta / float64(sum.N)
+	sum.m2 += delta * (v - sum.Mean)
+	if sum.N < 2 {
+		sum.Variance, sum.HalfWidth = 0, math.Inf(1)
+		return
+	}
+	df := float64(sum.N - 1)
+	sum.Variance = sum.m2 / df
+	t := utilmath.StudentTQuantile(1-(1-sum.Confidence)/2, df)
+	sum.HalfWidth = t * math.Sqrt(sum.Variance/float64(sum.N))
+}
+
+// Seeds derives the seed of each replication from a root seed. The n-th
+// replication always gets the same seed, regardless of how many workers
+// run the experiment.
+func Seeds(seed int64, n int) []int64 {
+	r := rand.New(rand.NewSource(seed))
+	seeds := make([]int64, n)
+	for i := range seeds {
+		seeds[i] = r.Int63()
+	}
+	return seeds
+}
+
+type replication struct {
+	idx  int
+	outs Outputs
+	err  error
+}
+
+// Replicate runs independent replications of the model and summarizes
+// their outputs. Results are aggregated in the order of the replications,
+// so the report only depends on the seed and not on the number of
+// workers.
+func Replicate(ctx context.Context, cfg Config, model Model) (*Report, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return replicate(ctx, cfg, model, nil)
+}
+
+func (cfg Config) withDefaults() (Config, error) {
+	if cfg.Replications <= 0 {
+		return cfg, fmt.Errorf("need at least 1 replication, got %d", cfg.Replications)
+	}
+	if cfg.MinReplications < 2 {
+		cfg.MinReplications = 2
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.Confidence <= 0 || cfg.Confidence >= 1 {
+		cfg.Confidence = 0.95
+	}
+	return cfg, nil
+}
+
+// replicate runs the replications, calling observe on the outputs of each
+// one in the order of the replications.
+func replicate(ctx context.Context, cfg Config, model Model, observe func(idx int, seed int64, outs Outputs) error) (*Report, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	seeds := Seeds(cfg.Seed, cfg.Replications)
+	todo := make(chan int)
+	done := make(chan replication)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range todo {
+				outs, err := model(ctx, seeds[idx])
+				select {
+				case done <- replication{idx: idx, outs: outs, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(todo)
+		for idx := range seeds {
+			select {
+			case todo <- idx:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	report := &Report{Outputs: make(map[string]*Summary)}
+	pending := make(map[int]replication)
+	next := 0
+	for rep := range done {
+		pending[rep.idx] = rep
+		// aggregate in order of replication
+		for {
+			rep, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if rep.err != nil {
+				return nil, fmt.Errorf("replication %d: %w", rep.idx, rep.err)
+			}
+			if observe != nil {
+				if err := observe(rep.idx, seeds[rep.idx], rep.outs); err != nil {
+					return nil, err
+				}
+			}
+			report.add(cfg.Confidence, rep.outs)
+			if report.Replications == cfg.Replications {
+				return report, nil
+			}
+			if report.reached(cfg) {
+				report.StoppedEarly = true
+				return report, nil
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (report *Report) add(confidence float64, outs Outputs) {
+	report.Replications++
+	for name, v := range outs {
+		sum, ok := report.Outputs[name]
+		if !ok {
+			sum = &Summary{Confidence: confidence}
+			report.Outputs[name] = sum
+		}
+		sum.add(v)
+	}
+}
+
+func (report *Report) reached(cfg Config) bool {
+	if cfg.TargetRelHalfWidth <= 0 || report.Replications < cfg.MinReplications {
+		return false
+	}
+	for _, sum := range report.Outputs {
+		if sum.RelHalfWidth() > cfg.TargetRelHalfWidth {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package experiment
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// A PointModel runs one replication of a simulation at a point of the
+// parameter space.
+type PointModel func(ctx context.Context, point Point, seed int64) (Outputs, error)
+
+// PointReport summarizes the replications run at a point.
+type PointReport struct {
+	Point Point
+	*Report
+}
+
+// Sweep evaluates the model at each point chosen by the design, running
+// replications at each of them as configured. Every point uses the same
+// seeds, so differences between points come from the parameters and not
+// from the random numbers. Each replication is written as a row of the
+// table, which may be nil.
+func Sweep(ctx context.Context, space []Param, design Design, cfg Config, model PointModel, table Table) ([]*PointReport, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	points, err := design(space)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*PointReport, 0, len(points))
+	for i, point := range points {
+		point := point
+		pointModel := func(ctx context.Context, seed int64) (Outputs, error) {
+			return model(ctx, point, seed)
+		}
+		var observe func(idx int, seed int64, outs Outputs) error
+		if table != nil {
+			observe = func(idx int, seed int64, outs Outputs) error {
+				return table.Write(&Row{Point: i, Replication: idx, Seed: seed, Params: point, Outputs: outs})
+			}
+		}
+		report, err := replicate(ctx, cfg, pointModel, observe)
+		if err != nil {
+			return nil, fmt.Errorf("point %d: %w", i, err)
+		}
+		reports = append(reports, &PointReport{Point: point, Report: report})
+	}
+	if table != nil {
+		if err := table.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// A Row of a sweep table holds the outputs of one replication at one
+// point.
+type Row struct {
+	Point       int     `json:"point"`
+	Replication int     `json:"replication"`
+	Seed        int64   `json:"seed"`
+	Params      Point   `json:"params"`
+	Outputs     Outputs `json:"outputs"`
+}
+
+// A Table receives the rows of a sweep, in order.
+type Table interface {
+	Write(*Row) error
+	Flush() error
+}
+
+// CSVTable writes rows as CSV, with a column for each parameter and each
+// output, sorted by name. The columns are taken from the first row.
+func CSVTable(w io.Writer) Table {
+	return &csvTable{w: csv.NewWriter(w)}
+}
+
+type csvTable struct {
+	w       *csv.Writer
+	params  []string
+	outputs []string
+}
+
+func (tbl *csvTable) Write(row *Row) error {
+	if tbl.params == nil {
+		tbl.params = sortedKeys(row.Params)
+		tbl.outputs = sortedKeys(row.Outputs)
+		header := append([]string{"point", "replication", "seed"}, tbl.params...)
+		if err := tbl.w.Write(append(header, tbl.outputs...)); err != nil {
+			return err
+		}
+	}
+	if len(row.Params) != len(tbl.params) {
+		return fmt.Errorf("row has %d parameters, table has %d", len(row.Params), len(tbl.params))
+	}
+	for name := range row.Outputs {
+		if i := sort.SearchStrings(tbl.outputs, name); i == len(tbl.outputs) || tbl.outputs[i] != name {
+			return fmt.Errorf("output %q isn't a column of the table", name)
+		}
+	}
+	record := []string{
+		strconv.Itoa(row.Point),
+		strconv.Itoa(row.Replication),
+		strconv.FormatInt(row.Seed, 10),
+	}
+	for _, name := range tbl.params {
+		v, ok := row.Params[name]
+		if !ok {
+			return fmt.Errorf("row has no parameter %q", name)
+		}
+		record = append(record, formatFloat(v))
+	}
+	for _, name := range tbl.outputs {
+		v, ok := row.Outputs[name]
+		if !ok {
+			// missing outputs are left blank
+			record = append(record, "")
+			continue
+		}
+		record = append(record, formatFloat(v))
+	}
+	return tbl.w.Write(record)
+}
+
+func (tbl *csvTable) Flush() error {
+	tbl.w.Flush()
+	return tbl.w.Error()
+}
+
+// JSONTable writes rows as JSON objects, one per line.
+func JSONTable(w io.Writer) Table {
+	return &jsonTable{enc: json.NewEncoder(w)}
+}
+
+type jsonTable struct {
+	enc *json.Encoder
+}
+
+func (tbl *jsonTable) Write(row *Row) error { return tbl.enc.Encode(row) }
+func (tbl *jsonTable) Flush() error         { return nil }
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
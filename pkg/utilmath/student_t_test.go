@@ -0,0 +1,53 @@
+package utilmath
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStudentTQuantile(t *testing.T) {
+	type args struct {
+		p  float64
+		df float64
+	}
+	tests := []struct {
+		name string
+		args args
+		want float64
+	}{
+		{
+			name: "95% two-sided, 1 dof",
+			args: args{p: 0.975, df: 1},
+			want: 12.706205,
+		},
+		{
+			name: "95% two-sided, 10 dof",
+			args: args{p: 0.975, df: 10},
+			want: 2.228139,
+		},
+		{
+			name: "90% two-sided, 5 dof",
+			args: args{p: 0.95, df: 5},
+			want: 2.015048,
+		},
+		{
+			name: "99% two-sided, 30 dof",
+			args: args{p: 0.995, df: 30},
+			want: 2.749996,
+		},
+		{
+			name: "lower tail",
+			args: args{p: 0.025, df: 10},
+			want: -2.228139,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StudentTQuantile(tt.args.p, tt.args.df)
+			got = math.Round(got*1e6) / 1e6
+			require.Equal(t, tt.want, got)
+		})
+	}
+}